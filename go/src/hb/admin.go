@@ -1,40 +1,398 @@
 package hb
 
 import (
-	"net/http"
+	"encoding/json"
 	"fmt"
+	"hb/api"
+	"hb/auth"
+	"hb/card"
+	"hb/store"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
+// The admin API manages an org's users, as JSON over HTTP. Every request must carry the basic auth credentials of
+// a user with the admin role in the org it's for, which is given by the 'org' parameter or is the default org.
+//
+//	GET    /admin/users       lists users
+//	POST   /admin/users       creates a user from a NewUserReq; 400 if the id is invalid, 409 if it's taken
+//	GET    /admin/users/<id>  gets a user
+//	PATCH  /admin/users/<id>  changes a user, as described by a ChangeUserReq
+//	DELETE /admin/users/<id>  deletes a user
+//	GET    /admin/card-at     gets a card's props at a past revision, whoever it's shared with; see cardAtHandler
+//
+// Users are returned as AdminUser. Errors are returned as {"Error": "<message>"}, with an appropriate status.
+
+// A user, as the admin API shows it.
+type AdminUser struct {
+	Id       string
+	Roles    []string
+	Groups   []string
+	Disabled bool
+}
+
+type NewUserReq struct {
+	Id       string
+	Password string
+	Roles    []string
+	Groups   []string
+}
+
+// Fields left nil are unchanged. Disabling a user, or changing their password, roles or groups, ends their sessions.
+type ChangeUserReq struct {
+	Password *string
+	Roles    *[]string
+	Groups   *[]string
+	Disabled *bool
+}
+
+type adminErrorRsp struct {
+	Error string
+}
+
 func errorf(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJson(w, status, adminErrorRsp{Error: fmt.Sprintf(format, args...)})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	w.Write([]byte(fmt.Sprintf(format, args...)))
+	json.NewEncoder(w).Encode(v)
+}
+
+// Wraps an admin handler, checking that the request comes from an admin of the org it's for.
+func requireAdmin(handler func(w http.ResponseWriter, r *http.Request, orgId string, admin *store.User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			errorf(w, http.StatusBadRequest, "error parsing form: %s", err)
+			return
+		}
+		orgId := orgParam(r)
+		userId, pass, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hb admin"`)
+			errorf(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		user, err := Authenticate(orgId, userId, pass)
+		if err == store.ErrorNoOrg {
+			errorf(w, http.StatusNotFound, "no such org: %s", orgId)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hb admin"`)
+			errorf(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+		if !hasRole(user, AdminRole) {
+			errorf(w, http.StatusForbidden, "user %s is not an admin", userId)
+			return
+		}
+		handler(w, r, orgId, user)
+	}
 }
 
-func newUserHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// Gets the org named by a request's 'org' parameter, or the default org if there isn't one.
+func orgParam(r *http.Request) string {
+	if orgId := r.Form.Get("org"); orgId != "" {
+		return orgId
+	}
+	return store.DefaultOrg
+}
+
+// Handles /admin/users.
+func usersHandler(w http.ResponseWriter, r *http.Request, orgId string, admin *store.User) {
+	switch r.Method {
+	case "GET":
+		st, err := orgs.Get(orgId)
+		if err != nil {
+			errorf(w, http.StatusInternalServerError, "error opening org %s: %s", orgId, err)
+			return
+		}
+		users, err := st.ListUsers()
+		if err != nil {
+			errorf(w, http.StatusInternalServerError, "error listing users: %s", err)
+			return
+		}
+		rsp := make([]AdminUser, len(users))
+		for i, user := range users {
+			rsp[i] = adminUser(user)
+		}
+		writeJson(w, http.StatusOK, rsp)
+
+	case "POST":
+		var req NewUserReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorf(w, http.StatusBadRequest, "error parsing request: %s", err)
+			return
+		}
+		createUser(w, orgId, req)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		errorf(w, http.StatusMethodNotAllowed, "method not allowed: %s", r.Method)
+	}
+}
+
+// Handles /admin/users/<id>.
+func userHandler(w http.ResponseWriter, r *http.Request, orgId string, admin *store.User) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	if id == "" || strings.Contains(id, "/") {
+		errorf(w, http.StatusNotFound, "not found: %s", r.URL.Path)
+		return
+	}
+	st, err := orgs.Get(orgId)
 	if err != nil {
-		errorf(w, http.StatusBadRequest, "error parsing form : %s", err)
+		errorf(w, http.StatusInternalServerError, "error opening org %s: %s", orgId, err)
 		return
 	}
+	user, err := st.FindUser(id)
+	if err == store.ErrorNotFound {
+		errorf(w, http.StatusNotFound, "no such user: %s", id)
+		return
+	}
+	if err != nil {
+		errorf(w, http.StatusInternalServerError, "error finding user %s: %s", id, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, adminUser(user))
+
+	case "PATCH":
+		var req ChangeUserReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorf(w, http.StatusBadRequest, "error parsing request: %s", err)
+			return
+		}
+		// Admins can't lock themselves out.
+		self := user.Id == admin.Id
+		if self && (req.Disabled != nil && *req.Disabled || req.Roles != nil && !contains(*req.Roles, AdminRole)) {
+			errorf(w, http.StatusConflict, "admins can't disable or demote themselves")
+			return
+		}
+		if err := checkChange(req); err != nil {
+			errorf(w, http.StatusBadRequest, "error changing user %s: %s", id, err)
+			return
+		}
+		if err := changeUser(st, user, req); err != nil {
+			errorf(w, http.StatusInternalServerError, "error changing user %s: %s", id, err)
+			return
+		}
+		// Sessions act as the principals the user had when they logged in, so they have to log in again to pick
+		// up new roles or groups.
+		if req.Password != nil || req.Disabled != nil && *req.Disabled || req.Roles != nil || req.Groups != nil {
+			RevokeLogins(orgId, user.Id)
+		}
+		writeJson(w, http.StatusOK, adminUser(user))
+
+	case "DELETE":
+		if user.Id == admin.Id {
+			errorf(w, http.StatusConflict, "admins can't delete themselves")
+			return
+		}
+		if err := st.DeleteUser(id); err != nil {
+			errorf(w, http.StatusInternalServerError, "error deleting user %s: %s", id, err)
+			return
+		}
+		RevokeLogins(orgId, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		errorf(w, http.StatusMethodNotAllowed, "method not allowed: %s", r.Method)
+	}
+}
 
-	id := r.Form.Get("id")
-	pass := r.Form.Get("pass")
-	if id == "" || pass == "" {
-		errorf(w, http.StatusBadRequest, "missing 'id' or 'pass' parameter")
+// Handles /admin/new-user, which predates /admin/users: a POST with 'id' and 'pass' form parameters.
+func newUserHandler(w http.ResponseWriter, r *http.Request, orgId string, admin *store.User) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		errorf(w, http.StatusMethodNotAllowed, "method not allowed: %s", r.Method)
 		return
 	}
+	createUser(w, orgId, NewUserReq{Id: r.Form.Get("id"), Password: r.Form.Get("pass")})
+}
 
-// TODO: Don't clobber users. For now, this doesn't hurt anything, because there's no data apart from password.
-//	_, err = FindUser(id)
-//	if err != solr.ErrorNotFound {
-//		errorf(w, http.StatusForbidden, "cannot create user %s : %s", id, err)
-//		return
-//	}
+func createUser(w http.ResponseWriter, orgId string, req NewUserReq) {
+	if req.Id == "" || req.Password == "" {
+		errorf(w, http.StatusBadRequest, "missing id or password")
+		return
+	}
+	if err := checkUserId(req.Id); err != nil {
+		errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if err := checkRoles(req.Roles); err != nil {
+		errorf(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		errorf(w, http.StatusInternalServerError, "error opening org %s: %s", orgId, err)
+		return
+	}
+	creatingUsers.Lock()
+	defer creatingUsers.Unlock()
+	if _, err := st.FindUser(req.Id); err != store.ErrorNotFound {
+		if err == nil {
+			errorf(w, http.StatusConflict, "user %s already exists", req.Id)
+		} else {
+			errorf(w, http.StatusInternalServerError, "error finding user %s: %s", req.Id, err)
+		}
+		return
+	}
+
+	user := &store.User{Id: req.Id, Props: map[string]string{}}
+	if err := changeUser(st, user, ChangeUserReq{Password: &req.Password, Roles: &req.Roles, Groups: &req.Groups}); err != nil {
+		errorf(w, http.StatusInternalServerError, "error creating user %s: %s", req.Id, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, adminUser(user))
+}
+
+// Held while a user is checked for and created, so that two requests can't both create the same one.
+var creatingUsers sync.Mutex
+
+// Checks that a change to a user is valid, before it's applied.
+func checkChange(req ChangeUserReq) error {
+	if req.Roles != nil {
+		if err := checkRoles(*req.Roles); err != nil {
+			return err
+		}
+	}
+	if req.Password != nil && *req.Password == "" {
+		return fmt.Errorf("empty password")
+	}
+	return nil
+}
+
+// Applies a change to a user, which must have passed checkChange, and saves them.
+func changeUser(st store.Store, user *store.User, req ChangeUserReq) error {
+	if req.Roles != nil {
+		setListProp(user, rolesProp, *req.Roles)
+	}
+	if req.Groups != nil {
+		setListProp(user, auth.GroupsProp, *req.Groups)
+	}
+	if req.Disabled != nil {
+		if *req.Disabled {
+			user.Props[disabledProp] = "true"
+		} else {
+			delete(user.Props, disabledProp)
+		}
+	}
+	if req.Password != nil {
+		// Saves the user.
+		return setPassword(st, user, *req.Password)
+	}
+	return st.CreateUser(user)
+}
+
+// User ids can't be mistaken for group principals (see auth.GroupPrefix), or for paths in the admin API, and can't
+// hold the separator of the store's keys.
+func checkUserId(id string) error {
+	if strings.ContainsAny(id, ":|/") || strings.IndexFunc(id, unicode.IsSpace) >= 0 ||
+		strings.IndexFunc(id, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid user id: %q", id)
+	}
+	return nil
+}
 
-	err = NewUser(id, pass)
+func checkRoles(roles []string) error {
+	for _, role := range roles {
+		if !contains(Roles, role) {
+			return fmt.Errorf("unknown role: %s", role)
+		}
+	}
+	return nil
+}
+
+func setListProp(user *store.User, name string, list []string) {
+	if len(list) == 0 {
+		delete(user.Props, name)
+		return
+	}
+	buf, _ := json.Marshal(list)
+	user.Props[name] = string(buf)
+}
+
+func adminUser(user *store.User) AdminUser {
+	var groups []string
+	json.Unmarshal([]byte(user.Props[auth.GroupsProp]), &groups)
+	return AdminUser{Id: user.Id, Roles: userRoles(user), Groups: groups, Disabled: isDisabled(user)}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets a card's props as of a past revision: /admin/card-at?id=<cardId>&rev=<rev> or &time=<RFC 3339 time>.
+func cardAtHandler(w http.ResponseWriter, r *http.Request, orgId string, admin *store.User) {
+	cardId := r.Form.Get("id")
+	if cardId == "" {
+		errorf(w, http.StatusBadRequest, "missing 'id' parameter")
+		return
+	}
+	var err error
+	var rev int
+	var t time.Time
+	if s := r.Form.Get("time"); s != "" {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			errorf(w, http.StatusBadRequest, "invalid 'time' parameter: %s", err)
+			return
+		}
+	} else if rev, err = strconv.Atoi(r.Form.Get("rev")); err != nil {
+		errorf(w, http.StatusBadRequest, "missing or invalid 'rev' or 'time' parameter")
+		return
+	}
+
+	rev, props, err := card.PropsAt(orgId, cardId, rev, t, nil)
 	if err != nil {
-		errorf(w, http.StatusInternalServerError, "error creating new user: %s", err)
+		errorf(w, http.StatusNotFound, "error getting card %s: %s", cardId, err)
+		return
 	}
+	writeJson(w, http.StatusOK, api.GetCardAtRsp{CardId: cardId, Rev: rev, Props: props})
+}
 
-	w.Write([]byte("success"))
+// Creates an admin user in each org that doesn't already have a user with that id, so that a new server can be
+// administered. Existing users are left alone.
+func BootstrapAdmin(userId, pass string) error {
+	if err := checkUserId(userId); err != nil {
+		return err
+	}
+	roles := []string{AdminRole}
+	req := ChangeUserReq{Password: &pass, Roles: &roles}
+	if err := checkChange(req); err != nil {
+		return err
+	}
+	creatingUsers.Lock()
+	defer creatingUsers.Unlock()
+	for _, orgId := range orgs.Ids() {
+		st, err := orgs.Get(orgId)
+		if err != nil {
+			return err
+		}
+		if _, err := st.FindUser(userId); err != store.ErrorNotFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		user := &store.User{Id: userId, Props: map[string]string{}}
+		if err := changeUser(st, user, req); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -4,67 +4,137 @@ import (
 	"bytes"
 	"encoding/json"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
-	"log"
 	"hb/ot"
+	"log"
+	"time"
 )
 
 const (
 	MsgLogin             = "login"
-	MsgSubscribeCard      = "subscribecard"
-	MsgUnsubscribeCard    = "unsubscribecard"
+	MsgResume            = "resume"
+	MsgLogout            = "logout"
+	MsgSubscribeCard     = "subscribecard"
+	MsgUnsubscribeCard   = "unsubscribecard"
 	MsgRevise            = "revise"
 	MsgSubscribeSearch   = "subscribesearch"
 	MsgUnsubscribeSearch = "unsubscribesearch"
+	MsgPageSearch        = "pagesearch"
 	MsgSearchResults     = "searchresults"
-	MsgCreateCard         = "createcard"
+	MsgCreateCard        = "createcard"
+	MsgGetCardAt         = "getcardat"
+	MsgRestoreCard       = "restorecard"
+	MsgUndo              = "undo"
+	MsgRedo              = "redo"
+	MsgShareCard         = "sharecard"
+	MsgUnshareCard       = "unsharecard"
+	MsgCursor            = "cursor"
+	MsgPresence          = "presence"
+	MsgComment           = "comment"
+	MsgResolveComment    = "resolvecomment"
+	MsgShutdown          = "shutdown"
 	MsgError             = "error"
 )
 
+// A change to a single prop: either text OT ops, or, if Set isn't nil, a value replacing the prop's whole value.
+// Typed props (see package schema) are usually changed with Set. Either way, the server validates the resulting
+// value against the prop's type, and broadcasts the change as ops.
 type Change struct {
 	Prop string
 	Ops  ot.Ops
+	Set  *string `json:",omitempty"`
 }
 
 // Requests.
 type Req struct {
 	Type              string
 	Login             *LoginReq             `json:",omitempty"`
-	SubscribeCard      *SubscribeCardReq      `json:",omitempty"`
-	UnsubscribeCard    *UnsubscribeCardReq    `json:",omitempty"`
+	Resume            *ResumeReq            `json:",omitempty"`
+	Logout            *LogoutReq            `json:",omitempty"`
+	SubscribeCard     *SubscribeCardReq     `json:",omitempty"`
+	UnsubscribeCard   *UnsubscribeCardReq   `json:",omitempty"`
 	Revise            *ReviseReq            `json:",omitempty"`
 	SubscribeSearch   *SubscribeSearchReq   `json:",omitempty"`
 	UnsubscribeSearch *UnsubscribeSearchReq `json:",omitempty"`
-	CreateCard         *CreateCardReq         `json:",omitempty"`
+	PageSearch        *PageSearchReq        `json:",omitempty"`
+	CreateCard        *CreateCardReq        `json:",omitempty"`
+	GetCardAt         *GetCardAtReq         `json:",omitempty"`
+	RestoreCard       *RestoreCardReq       `json:",omitempty"`
+	Undo              *UndoReq              `json:",omitempty"`
+	Redo              *RedoReq              `json:",omitempty"`
+	ShareCard         *ShareCardReq         `json:",omitempty"`
+	UnshareCard       *UnshareCardReq       `json:",omitempty"`
+	Cursor            *CursorReq            `json:",omitempty"`
+	Comment           *CommentReq           `json:",omitempty"`
+	ResolveComment    *ResolveCommentReq    `json:",omitempty"`
 }
 
+// OrgId selects the organization the user belongs to; if empty, it's the server's default org. Users, cards and
+// searches are all scoped to the org logged in to.
+// Units selects what Op.N counts in this connection's ops: "bytes" (the default), "runes" (Unicode code points),
+// or "utf16" (UTF-16 code units, as JavaScript strings are indexed).
 type LoginReq struct {
-	UserId string
+	OrgId    string
+	UserId   string
 	Password string
+	Units    string
+}
+
+// Resumes a login on a new connection, given the session token from its LoginRsp. The connection gets the login's
+// user and units, and is re-subscribed to the cards and searches its last connection was subscribed to.
+type ResumeReq struct {
+	Token string
+}
+
+// Ends the connection's login, revoking its session token. The connection stays open, but has to log in again.
+type LogoutReq struct {
 }
 
 type SubscribeCardReq struct {
 	CardId string
-	SubId int
+	SubId  int
 }
 
 type UnsubscribeCardReq struct {
 	SubId int
 }
 
+// Revises a subscribed card. CardId must be the subscription's card. The revision is attributed to the
+// connection and user that sent it.
 type ReviseReq struct {
-	ConnId string
 	SubId  int
-	CardId  string
+	CardId string
 	Rev    int
 	Change Change
 }
 
+// Query is in hb's query language; see package query. Filters are further queries that results must match, without
+// sorts, and Sort sorts results as a query's sort would (e.g. "title asc"), overriding the query's own. Start and
+// Rows select the page of results to send: Rows results (or a default number, if 0), skipping the first Start. Fields
+// names the props that results hold, and Snippets the props they hold snippets of, rather than their whole text; if
+// nil, each defaults to a few common props. Facets names props to count the values of among all the results.
+// SubId is picked by the client, unique among its search subscriptions, and names the subscription in the
+// requests and responses that follow, so a connection can subscribe to the same query more than once.
 type SubscribeSearchReq struct {
-	Query string
+	SubId    int
+	Query    string
+	Filters  []string `json:",omitempty"`
+	Sort     string   `json:",omitempty"`
+	Start    int
+	Rows     int
+	Fields   []string
+	Snippets []string
+	Facets   []string `json:",omitempty"`
 }
 
 type UnsubscribeSearchReq struct {
-	Query string
+	SubId int
+}
+
+// Moves a search subscription to another page of its results, which is sent in full.
+type PageSearchReq struct {
+	SubId int
+	Start int
+	Rows  int
 }
 
 type CreateCardReq struct {
@@ -72,36 +142,163 @@ type CreateCardReq struct {
 	Props    map[string]string
 }
 
+// Asks for a card's props as of a past revision. If Time is set, it selects the last revision made at or
+// before that time, and Rev is ignored.
+type GetCardAtReq struct {
+	CardId string
+	Rev    int
+	Time   time.Time
+}
+
+// Restores a subscribed card to its state as of a past revision (or time, as in GetCardAtReq).
+// The restoration is itself a new revision, broadcast to all subscribers.
+type RestoreCardReq struct {
+	SubId int
+	Rev   int
+	Time  time.Time
+}
+
+// Undoes the requesting user's last change to a subscribed card that hasn't already been undone.
+// The undo is itself a new revision, broadcast to all subscribers.
+type UndoReq struct {
+	SubId int
+}
+
+// Redoes the requesting user's last undo, as long as they haven't made other changes to the card since.
+type RedoReq struct {
+	SubId int
+}
+
+// Shares a subscribed card, which the requesting user must own, with a principal: a user id, or "group:<name>"
+// for every member of a group. Role is "viewer" or "editor", and replaces any role the principal had. The change
+// to the card's ACL is a new revision, broadcast to all subscribers.
+type ShareCardReq struct {
+	SubId     int
+	Principal string
+	Role      string
+}
+
+// Revokes whatever role a principal was granted on a subscribed card. Its subscribers who can no longer view the
+// card lose their subscriptions.
+type UnshareCardReq struct {
+	SubId     int
+	Principal string
+}
+
+// A subscriber's cursor or selection in a prop, from Start to End (which are equal for a plain cursor), counted in
+// the connection's units against revision Rev of the card.
+type Cursor struct {
+	Prop  string
+	Rev   int
+	Start int
+	End   int
+}
+
+// Publishes the cursor of a subscription, or clears it if Cursor is nil. The server maps it through any revisions
+// made since Cursor.Rev, and relays it to the card's other subscribers.
+type CursorReq struct {
+	SubId  int
+	Cursor *Cursor
+}
+
+// Comments on a subscribed card's text, from Start to End of Prop, counted in the connection's units against
+// revision Rev. The comment is a card of type "comment", whose "target" is the commented card and whose "body" is
+// Body; it can be read by whoever could read the commented card when it was made. Its anchor is kept in the
+// commented card's "_comments" prop, which is a new revision, and follows edits to the text from then on.
+type CommentReq struct {
+	SubId int
+	Prop  string
+	Rev   int
+	Start int
+	End   int
+	Body  string
+}
+
+// Marks a comment on a subscribed card resolved, or reopens it. Only the comment's author and the card's editors
+// can. Like commenting, it's a new revision of the card's "_comments" prop.
+type ResolveCommentReq struct {
+	SubId     int
+	CommentId string
+	Resolved  bool
+}
+
 // Responses.
 type Rsp struct {
 	Type string
 
 	Login             *LoginRsp             `json:",omitempty"`
+	Resume            *ResumeRsp            `json:",omitempty"`
+	Logout            *LogoutRsp            `json:",omitempty"`
 	Revise            *ReviseRsp            `json:",omitempty"`
-	SubscribeCard      *SubscribeCardRsp      `json:",omitempty"`
-	UnsubscribeCard    *UnsubscribeCardRsp    `json:",omitempty"`
+	SubscribeCard     *SubscribeCardRsp     `json:",omitempty"`
+	UnsubscribeCard   *UnsubscribeCardRsp   `json:",omitempty"`
 	SubscribeSearch   *SubscribeSearchRsp   `json:",omitempty"`
 	UnsubscribeSearch *UnsubscribeSearchRsp `json:",omitempty"`
-	CreateCard         *CreateCardRsp         `json:",omitempty"`
+	CreateCard        *CreateCardRsp        `json:",omitempty"`
+	GetCardAt         *GetCardAtRsp         `json:",omitempty"`
+	RestoreCard       *RestoreCardRsp       `json:",omitempty"`
+	Undo              *UndoRsp              `json:",omitempty"`
+	Redo              *RedoRsp              `json:",omitempty"`
+	ShareCard         *ShareCardRsp         `json:",omitempty"`
+	UnshareCard       *UnshareCardRsp       `json:",omitempty"`
+	Presence          *PresenceRsp          `json:",omitempty"`
+	Comment           *CommentRsp           `json:",omitempty"`
+	ResolveComment    *ResolveCommentRsp    `json:",omitempty"`
 
 	SearchResults *SearchResultsRsp `json:",omitempty"`
+	Shutdown      *ShutdownRsp      `json:",omitempty"`
 	Error         *ErrorRsp         `json:",omitempty"`
 }
 
+// Units is the unit mode in effect for the connection. Token can be used to resume the login on another
+// connection until it expires or is revoked.
 type LoginRsp struct {
-	UserId string
-	ConnId string
+	OrgId   string
+	UserId  string
+	ConnId  string
+	Units   string
+	Token   string
+	Expires time.Time
 }
 
 func (rsp LoginRsp) Send(sock sockjs.Session) error {
 	return sendRsp(sock, &Rsp{Type: MsgLogin, Login: &rsp})
 }
 
+// Cards lists the sub ids of the card subscriptions being re-established, and Searches those of the searches being
+// re-subscribed. Each card's state follows in a SubscribeCardRsp, and each search's results as usual.
+type ResumeRsp struct {
+	OrgId    string
+	UserId   string
+	ConnId   string
+	Units    string
+	Token    string
+	Expires  time.Time
+	Cards    []int
+	Searches []int
+}
+
+func (rsp ResumeRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgResume, Resume: &rsp})
+}
+
+type LogoutRsp struct {
+	UserId string
+}
+
+func (rsp LogoutRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgLogout, Logout: &rsp})
+}
+
+// Present lists the card's other subscribers, as of when the subscription was made. Comments lists the comments
+// anchored to the card's text, as of Rev.
 type SubscribeCardRsp struct {
-	CardId string
-	SubId int
-	Rev   int
-	Props map[string]string
+	CardId   string
+	SubId    int
+	Rev      int
+	Props    map[string]string
+	Present  []Presence `json:",omitempty"`
+	Comments []Comment  `json:",omitempty"`
 }
 
 func (rsp SubscribeCardRsp) Send(sock sockjs.Session) error {
@@ -116,10 +313,13 @@ func (rsp UnsubscribeCardRsp) Send(sock sockjs.Session) error {
 	return sendRsp(sock, &Rsp{Type: MsgUnsubscribeCard, UnsubscribeCard: &rsp})
 }
 
+// OrigConnId and OrigSubId identify the revision's sender. OrigConnId is empty for revisions made by the
+// server itself, such as restores. AuthorId is the user whose change it was, including for restores and undos.
 type ReviseRsp struct {
 	OrigConnId string
 	OrigSubId  int
-	CardId      string
+	AuthorId   string
+	CardId     string
 	SubIds     []int
 	Rev        int
 	Change     Change
@@ -129,8 +329,73 @@ func (rsp ReviseRsp) Send(sock sockjs.Session) error {
 	return sendRsp(sock, &Rsp{Type: MsgRevise, Revise: &rsp})
 }
 
+// A comment anchored to the text of a card's prop, from Start to End, counted in the connection's units. Text
+// inserted at either end isn't taken into the range. A comment whose text is all deleted is orphaned, and stays
+// so, anchored to where its text was.
+type Comment struct {
+	Id       string // The comment card's id.
+	UserId   string
+	Prop     string
+	Start    int
+	End      int
+	Resolved bool
+	Orphaned bool
+}
+
+type CommentRsp struct {
+	CardId    string
+	SubId     int
+	CommentId string
+	Rev       int // The card's revision after anchoring the comment.
+}
+
+func (rsp CommentRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgComment, Comment: &rsp})
+}
+
+type ResolveCommentRsp struct {
+	CardId    string
+	SubId     int
+	CommentId string
+	Resolved  bool
+	Rev       int // The card's revision after resolving or reopening the comment.
+}
+
+func (rsp ResolveCommentRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgResolveComment, ResolveComment: &rsp})
+}
+
+// A subscription to a card, as seen by the card's other subscribers.
+type Presence struct {
+	ConnId string
+	SubId  int
+	UserId string
+	Cursor *Cursor `json:",omitempty"`
+}
+
+// Presence events.
+const (
+	PresenceJoin   = "join"   // A subscriber arrived.
+	PresenceLeave  = "leave"  // A subscriber unsubscribed, disconnected or lost access.
+	PresenceCursor = "cursor" // A subscriber moved or cleared its cursor.
+)
+
+// Tells a card's subscribers about an event concerning another of its subscribers. SubIds are the receiving
+// connection's subscriptions to the card.
+type PresenceRsp struct {
+	CardId   string
+	SubIds   []int
+	Event    string
+	Presence Presence
+}
+
+func (rsp PresenceRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgPresence, Presence: &rsp})
+}
+
 // TODO: Send initial results here?
 type SubscribeSearchRsp struct {
+	SubId int
 	Query string
 }
 
@@ -139,7 +404,7 @@ func (rsp SubscribeSearchRsp) Send(sock sockjs.Session) error {
 }
 
 type UnsubscribeSearchRsp struct {
-	Query string
+	SubId int
 }
 
 func (rsp UnsubscribeSearchRsp) Send(sock sockjs.Session) error {
@@ -148,29 +413,143 @@ func (rsp UnsubscribeSearchRsp) Send(sock sockjs.Session) error {
 
 type CreateCardRsp struct {
 	CreateId int
-	CardId    string
+	CardId   string
 }
 
 func (rsp CreateCardRsp) Send(sock sockjs.Session) error {
 	return sendRsp(sock, &Rsp{Type: MsgCreateCard, CreateCard: &rsp})
 }
 
+type GetCardAtRsp struct {
+	CardId string
+	Rev    int
+	Props  map[string]string
+}
+
+func (rsp GetCardAtRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgGetCardAt, GetCardAt: &rsp})
+}
+
+type RestoreCardRsp struct {
+	CardId  string
+	SubId   int
+	FromRev int // The revision that was restored.
+	Rev     int // The card's revision after restoring.
+}
+
+func (rsp RestoreCardRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgRestoreCard, RestoreCard: &rsp})
+}
+
+type UndoRsp struct {
+	CardId    string
+	SubId     int
+	UndoneRev int // The revision that was undone.
+	Rev       int // The card's revision after undoing it.
+}
+
+func (rsp UndoRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgUndo, Undo: &rsp})
+}
+
+type RedoRsp struct {
+	CardId    string
+	SubId     int
+	RedoneRev int // The undo revision that was reverted.
+	Rev       int // The card's revision after redoing.
+}
+
+func (rsp RedoRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgRedo, Redo: &rsp})
+}
+
+type ShareCardRsp struct {
+	CardId    string
+	SubId     int
+	Principal string
+	Role      string
+	Rev       int // The card's revision after sharing.
+}
+
+func (rsp ShareCardRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgShareCard, ShareCard: &rsp})
+}
+
+type UnshareCardRsp struct {
+	CardId    string
+	SubId     int
+	Principal string
+	Rev       int // The card's revision after unsharing.
+}
+
+func (rsp UnshareCardRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgUnshareCard, UnshareCard: &rsp})
+}
+
+// A page of a search's results. If Reset is set, Results holds the whole page; subscribers are sent this first, and
+// whenever the subscription moves to another page. After that, they're sent how the page changes: results that
+// left it are Removed, results that joined it are Added at their index, and results that stayed but changed their
+// position or content are Moved or Updated. To apply these, drop the removed results, put the added and moved ones
+// at their indexes, fill the rest of the page with the other results in the order they were in, and then replace
+// the updated ones.
+//
+// Facets holds the counts of the facets asked for, keyed by prop name, if there are any. Pages that aren't Reset
+// only hold them if they changed.
 type SearchResultsRsp struct {
+	SubId   int
 	Query   string
+	Start   int
+	Rows    int
 	Total   int
-	Results []SearchResult
+	Reset   bool                `json:",omitempty"`
+	Results []SearchResult      `json:",omitempty"`
+	Removed []string            `json:",omitempty"` // card ids
+	Added   []AddedSearchResult `json:",omitempty"`
+	Moved   []MovedSearchResult `json:",omitempty"`
+	Updated []SearchResult      `json:",omitempty"`
+	Facets  map[string][]Facet  `json:",omitempty"`
 }
 
+// A value of a prop, and how many of a search's results have it. A prop's facets are its most common values, most
+// common first. Text is counted lower-cased, and lists by their items.
+type Facet struct {
+	Value string
+	Count int
+}
+
+// Props holds those of the props asked for that the card has. Snippets holds HTML snippets of the text of others,
+// around words that match the query, with those words in <em>.
 type SearchResult struct {
+	CardId   string
+	Modified time.Time
+	Props    map[string]string `json:",omitempty"`
+	Snippets map[string]string `json:",omitempty"`
+}
+
+// Indexes count from the start of the page.
+type AddedSearchResult struct {
+	Index int
+	SearchResult
+}
+
+type MovedSearchResult struct {
 	CardId string
-	Title string
-	Body  string
+	Index  int
 }
 
 func (rsp SearchResultsRsp) Send(sock sockjs.Session) error {
 	return sendRsp(sock, &Rsp{Type: MsgSearchResults, SearchResults: &rsp})
 }
 
+// Sent to every connection when the server is going away. The connection is closed right after.
+type ShutdownRsp struct {
+	Msg string
+}
+
+func (rsp ShutdownRsp) Send(sock sockjs.Session) error {
+	return sendRsp(sock, &Rsp{Type: MsgShutdown, Shutdown: &rsp})
+}
+
 type ErrorRsp struct {
 	Msg string
 }
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Cards carry their access control lists in reserved props, which can't be edited like other props: the owner is a
+// user id, and editors and viewers are JSON arrays of principals. A principal is a user id, or "group:<name>" for
+// every member of a group. Cards without an owner predate ACLs, and are open to everyone.
+const (
+	OwnerProp   = "_owner"
+	EditorsProp = "_editors"
+	ViewersProp = "_viewers"
+)
+
+// The user prop listing the groups a user belongs to, as a JSON array of group names.
+const GroupsProp = "groups"
+
+const GroupPrefix = "group:"
+
+// A group that every user belongs to. Sharing a card with it makes the card public.
+const Everyone = GroupPrefix + "everyone"
+
+// What a principal may do with a card. Each role can do everything the ones before it can.
+type Role int
+
+const (
+	NoRole Role = iota
+	Viewer      // Subscribe, search and read history.
+	Editor      // Revise, restore, undo and redo.
+	Owner       // Share and unshare.
+)
+
+var roleNames = []string{"none", "viewer", "editor", "owner"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// Parses a role that a card can be shared with: "viewer" or "editor".
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "viewer":
+		return Viewer, nil
+	case "editor":
+		return Editor, nil
+	}
+	return NoRole, fmt.Errorf("unknown role: %q", s)
+}
+
+// Reports whether a prop is part of a card's ACL.
+func IsACLProp(name string) bool {
+	return name == OwnerProp || name == EditorsProp || name == ViewersProp
+}
+
+// Returns the principals a user acts as: their id, Everyone, and each of their groups.
+func Principals(userId string, props map[string]string) []string {
+	principals := []string{userId, Everyone}
+	var groups []string
+	json.Unmarshal([]byte(props[GroupsProp]), &groups)
+	for _, group := range groups {
+		principals = append(principals, GroupPrefix+group)
+	}
+	return principals
+}
+
+// A card's access control list.
+type ACL struct {
+	Owner   string
+	Editors []string
+	Viewers []string
+}
+
+// Reads a card's ACL from its props. Malformed lists are treated as empty.
+func ACLOf(props map[string]string) *ACL {
+	acl := &ACL{Owner: props[OwnerProp]}
+	json.Unmarshal([]byte(props[EditorsProp]), &acl.Editors)
+	json.Unmarshal([]byte(props[ViewersProp]), &acl.Viewers)
+	return acl
+}
+
+// Gets the highest role held by any of the given principals.
+func (acl *ACL) RoleOf(principals []string) Role {
+	if acl.Owner == "" {
+		return Editor
+	}
+	role := NoRole
+	for _, p := range principals {
+		switch {
+		case p == acl.Owner:
+			return Owner
+		case contains(acl.Editors, p):
+			role = Editor
+		case contains(acl.Viewers, p) && role < Viewer:
+			role = Viewer
+		}
+	}
+	return role
+}
+
+// Lists the principals that may read the card, for indexing.
+func (acl *ACL) Readers() []string {
+	if acl.Owner == "" {
+		return []string{Everyone}
+	}
+	readers := append([]string{acl.Owner}, acl.Editors...)
+	for _, p := range acl.Viewers {
+		if !contains(readers, p) {
+			readers = append(readers, p)
+		}
+	}
+	return readers
+}
+
+// Grants a principal a role, replacing any role it had.
+func (acl *ACL) Share(principal string, role Role) error {
+	if principal == "" || principal == acl.Owner {
+		return fmt.Errorf("can't share with %q", principal)
+	}
+	acl.Unshare(principal)
+	switch role {
+	case Viewer:
+		acl.Viewers = append(acl.Viewers, principal)
+	case Editor:
+		acl.Editors = append(acl.Editors, principal)
+	default:
+		return fmt.Errorf("can't share as %s", role)
+	}
+	return nil
+}
+
+// Revokes whatever role a principal was granted.
+func (acl *ACL) Unshare(principal string) {
+	acl.Editors = remove(acl.Editors, principal)
+	acl.Viewers = remove(acl.Viewers, principal)
+}
+
+// Encodes the ACL as card props. Lists are sorted, so that equal ACLs have equal props.
+func (acl *ACL) Props() map[string]string {
+	return map[string]string{
+		OwnerProp:   acl.Owner,
+		EditorsProp: encodeList(acl.Editors),
+		ViewersProp: encodeList(acl.Viewers),
+	}
+}
+
+func encodeList(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	list = append([]string(nil), list...)
+	sort.Strings(list)
+	buf, _ := json.Marshal(list)
+	return string(buf)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	out := list[:0]
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
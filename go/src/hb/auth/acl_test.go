@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	joel := Principals("joel", map[string]string{GroupsProp: `["eng"]`})
+	if !reflect.DeepEqual(joel, []string{"joel", Everyone, "group:eng"}) {
+		t.Errorf("unexpected principals %v", joel)
+	}
+	bob := Principals("bob", nil)
+
+	// Cards without owners are open to everyone.
+	if role := ACLOf(map[string]string{"title": "old"}).RoleOf(bob); role != Editor {
+		t.Errorf("expected editor of an ownerless card, got %s", role)
+	}
+
+	acl := ACLOf(map[string]string{OwnerProp: "bob"})
+	if acl.RoleOf(bob) != Owner || acl.RoleOf(joel) != NoRole {
+		t.Errorf("expected only bob to have access, got %s and %s", acl.RoleOf(bob), acl.RoleOf(joel))
+	}
+	acl.Share("group:eng", Viewer)
+	if role := acl.RoleOf(joel); role != Viewer {
+		t.Errorf("expected viewer through group, got %s", role)
+	}
+	acl.Share("joel", Editor)
+	if role := acl.RoleOf(joel); role != Editor {
+		t.Errorf("expected editor, got %s", role)
+	}
+	if err := acl.Share("bob", Viewer); err == nil {
+		t.Error("expected sharing with the owner to fail")
+	}
+
+	// Props round trip, with sorted lists.
+	props := acl.Props()
+	if props[EditorsProp] != `["joel"]` || props[ViewersProp] != `["group:eng"]` {
+		t.Errorf("unexpected props %v", props)
+	}
+	if readers := ACLOf(props).Readers(); !reflect.DeepEqual(readers, []string{"bob", "joel", "group:eng"}) {
+		t.Errorf("unexpected readers %v", readers)
+	}
+
+	acl.Unshare("joel")
+	if role := acl.RoleOf(joel); role != Viewer {
+		t.Errorf("expected viewer after unsharing user, got %s", role)
+	}
+	acl.Unshare("group:eng")
+	if role := acl.RoleOf(joel); role != NoRole {
+		t.Errorf("expected no access after unsharing group, got %s", role)
+	}
+	if props := acl.Props(); props[EditorsProp] != "" || props[ViewersProp] != "" {
+		t.Errorf("expected empty lists, got %v", props)
+	}
+
+	if _, err := ParseRole("owner"); err == nil {
+		t.Error("expected owner not to be a shareable role")
+	}
+}
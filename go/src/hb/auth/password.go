@@ -0,0 +1,73 @@
+// Package auth handles user credentials and card access control.
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Password hashes are PBKDF2-SHA256, encoded as "pbkdf2-sha256$<iterations>$<salt>$<hash>" with base64 salt and
+// hash. The iteration count is part of the encoding, so raising it only affects new hashes; hashes made with fewer
+// iterations are reported by CheckPassword as needing a rehash.
+const scheme = "pbkdf2-sha256"
+
+var Iterations = 600000
+
+const (
+	saltLen = 16
+	hashLen = 32
+)
+
+// Hashes a password with a fresh random salt.
+func HashPassword(pass string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashPassword(pass, salt, Iterations)
+}
+
+func hashPassword(pass string, salt []byte, iterations int) (string, error) {
+	hash, err := pbkdf2.Key(sha256.New, pass, salt, iterations, hashLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", scheme, iterations, enc.EncodeToString(salt), enc.EncodeToString(hash)), nil
+}
+
+// Checks a password against a hash made by HashPassword, in constant time. If it matches, rehash reports whether
+// the hash is weaker than HashPassword would make now, and should be replaced.
+func CheckPassword(hash, pass string) (ok, rehash bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return false, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false
+	}
+	expected, err := hashPassword(pass, salt, iterations)
+	if err != nil {
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) != 1 {
+		return false, false
+	}
+	return true, iterations < Iterations
+}
+
+// Compares a legacy plaintext password in constant time.
+func CheckPlaintext(stored, pass string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+}
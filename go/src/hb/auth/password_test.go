@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassword(t *testing.T) {
+	defer func(n int) { Iterations = n }(Iterations)
+	Iterations = 1000
+
+	hash, err := HashPassword("wut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "wut") {
+		t.Errorf("hash contains the password: %s", hash)
+	}
+	if ok, rehash := CheckPassword(hash, "wut"); !ok || rehash {
+		t.Errorf("expected match without rehash, got %v %v", ok, rehash)
+	}
+	if ok, _ := CheckPassword(hash, "wat"); ok {
+		t.Error("expected wrong password not to match")
+	}
+
+	// Salts differ, so equal passwords hash differently.
+	if other, _ := HashPassword("wut"); other == hash {
+		t.Error("expected different salts")
+	}
+
+	// Hashes made with fewer iterations than current still match, but need rehashing.
+	Iterations = 2000
+	if ok, rehash := CheckPassword(hash, "wut"); !ok || !rehash {
+		t.Errorf("expected match with rehash, got %v %v", ok, rehash)
+	}
+
+	for _, bad := range []string{"", "wut", "md5$1$abc$def", "pbkdf2-sha256$x$abc$def", "pbkdf2-sha256$1000$!!$def"} {
+		if ok, _ := CheckPassword(bad, "wut"); ok {
+			t.Errorf("expected malformed hash %q not to match", bad)
+		}
+	}
+}
+
+func TestCheckPlaintext(t *testing.T) {
+	if !CheckPlaintext("wut", "wut") || CheckPlaintext("wut", "wu") || CheckPlaintext("wut", "") {
+		t.Error("unexpected plaintext comparison")
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorBadToken     = errors.New("invalid token")
+	ErrorExpiredToken = errors.New("expired token")
+)
+
+// Tokens signs and verifies expiring tokens that carry an id, such as a session id. Tokens are
+// "<id>.<expiry>.<signature>", with the expiry in unix seconds and an HMAC-SHA256 signature, all base64-encoded.
+// They can't be forged without the key, but revoking them is up to whoever keeps track of the ids.
+type Tokens struct {
+	key []byte
+}
+
+// Creates a Tokens that signs with the given key. If key is empty, a random one is generated, so that tokens are
+// only valid until the process exits.
+func NewTokens(key []byte) (*Tokens, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Tokens{key: key}, nil
+}
+
+// Generates a random id, suitable for signing.
+func NewId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Signs an id, returning a token that's valid until expires.
+func (t *Tokens) Sign(id string, expires time.Time) string {
+	payload := encode([]byte(id)) + "." + encode([]byte(strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + encode(t.mac(payload))
+}
+
+// Verifies a token, returning the id it was signed with.
+func (t *Tokens) Verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrorBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, t.mac(parts[0]+"."+parts[1])) {
+		return "", ErrorBadToken
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrorBadToken
+	}
+	expiry, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrorBadToken
+	}
+	secs, err := strconv.ParseInt(string(expiry), 10, 64)
+	if err != nil {
+		return "", ErrorBadToken
+	}
+	if !now.Before(time.Unix(secs, 0)) {
+		return "", ErrorExpiredToken
+	}
+	return string(id), nil
+}
+
+func (t *Tokens) mac(payload string) []byte {
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func encode(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
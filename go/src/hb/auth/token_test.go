@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token := tokens.Sign("session1", now.Add(time.Hour))
+
+	if id, err := tokens.Verify(token, now); err != nil || id != "session1" {
+		t.Errorf("expected session1, got %q, %v", id, err)
+	}
+	if _, err := tokens.Verify(token, now.Add(2*time.Hour)); err != ErrorExpiredToken {
+		t.Errorf("expected ErrorExpiredToken, got %v", err)
+	}
+
+	// Tokens signed with another key, or tampered with, are rejected.
+	other, _ := NewTokens([]byte("other key"))
+	if _, err := other.Verify(token, now); err != ErrorBadToken {
+		t.Errorf("expected ErrorBadToken for another key, got %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged := encode([]byte("session2")) + "." + parts[1] + "." + parts[2]
+	if _, err := tokens.Verify(forged, now); err != ErrorBadToken {
+		t.Errorf("expected ErrorBadToken for a forged id, got %v", err)
+	}
+	for _, bad := range []string{"", "a.b", "a.b.c", token + "x"} {
+		if _, err := tokens.Verify(bad, now); err != ErrorBadToken {
+			t.Errorf("%q: expected ErrorBadToken, got %v", bad, err)
+		}
+	}
+
+	id1, _ := NewId()
+	id2, _ := NewId()
+	if id1 == "" || id1 == id2 {
+		t.Errorf("expected distinct ids, got %q and %q", id1, id2)
+	}
+}
@@ -1,38 +1,83 @@
 package card
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
-	"log"
+	"hash/fnv"
+	"hb/api"
 	. "hb/api"
+	"hb/auth"
 	"hb/ot"
-	"hb/solr"
-	"strconv"
-	"strings"
-	"hb/api"
-	"hash/fnv"
+	"hb/schema"
+	"hb/search"
+	"hb/store"
+	"log"
+	"sort"
+	"sync"
 	"time"
-	"encoding/base64"
-	"bytes"
-	"encoding/binary"
+)
+
+// The org stores that cards are loaded from and persisted to. Set by Init().
+var orgs *store.Orgs
+
+// Changes are logged as they happen, but saving a card's props is deferred. A card is saved at most
+// FlushInterval after its first unsaved change, as soon as it has MaxDirtyOps unsaved changes, and when
+// it's dropped.
+var (
+	FlushInterval = 5 * time.Second
+	MaxDirtyOps   = 100
 )
 
 var master struct {
-	cards   map[string]*Card
-	subs   chan subReq
-	unsubs chan unsubReq
+	cards   map[string]*Card // cardKey -> Card
+	subs    chan subReq
+	unsubs  chan unsubReq
+	lists   chan chan []*Card
+	stops   chan chan []*Card
+	stopped chan bool // closed when the master loop stops
+}
+
+var (
+	ErrorShutdown  = errors.New("cards are shut down")
+	ErrorForbidden = errors.New("access denied")
+)
+
+// Reports whether a prop is maintained by the server, and can't be changed by revising it.
+func reserved(name string) bool {
+	return auth.IsACLProp(name) || name == CommentsProp
+}
+
+func reservedError(name string) error {
+	if name == CommentsProp {
+		return fmt.Errorf("%s can only be changed by commenting", name)
+	}
+	return fmt.Errorf("%s can only be changed by sharing", name)
 }
 
 type subReq struct {
-	cardId    string
-	connId   string
-	subId    int
-	sock     sockjs.Session
-	response chan<- *Card
+	orgId      string
+	cardId     string
+	connId     string
+	userId     string
+	subId      int
+	units      ot.Unit
+	principals []string
+	sock       sockjs.Session
+	response   chan<- subRsp
+}
+
+type subRsp struct {
+	card *Card
+	rsp  *api.SubscribeCardRsp
+	err  error
 }
 
 type unsubReq struct {
-	card    *Card
+	card   *Card
 	connId string
 	subId  int
 }
@@ -41,9 +86,22 @@ func init() {
 	master.cards = make(map[string]*Card)
 	master.subs = make(chan subReq)
 	master.unsubs = make(chan unsubReq)
+	master.lists = make(chan chan []*Card)
+	master.stops = make(chan chan []*Card)
+	master.stopped = make(chan bool)
 	go run()
 }
 
+// Sets the org stores that cards are loaded from and persisted to. Must be called before any cards are used.
+func Init(o *store.Orgs) {
+	orgs = o
+}
+
+// Cards are kept per org, so that orgs' card ids can't collide.
+func cardKey(orgId, cardId string) string {
+	return orgId + "/" + cardId
+}
+
 // Main card subscription loop. Controls access to Card structs via the un[subs] channels.
 func run() {
 	done := make(chan *Card)
@@ -51,140 +109,450 @@ func run() {
 	for {
 		select {
 		case req := <-master.subs:
-			card, exists := master.cards[req.cardId]
-			if !exists {
-				var err error
-				card, err = newCard(req.cardId, done)
-				if err != nil {
-					// TODO: something.
-					continue
-				}
-				master.cards[req.cardId] = card
-			}
-			card.subs <- req
-			req.response <- card
-			log.Printf("%d cards total", len(master.cards))
+			route(req, done)
 
 		case req := <-master.unsubs:
-			req.card.unsubs <- req
+			unsubscribe(req, done)
 
 		case card := <-done:
-			delete(master.cards, card.id)
+			forget(card)
+
+		case rsp := <-master.lists:
+			rsp <- openCards()
+
+		case rsp := <-master.stops:
+			close(master.stopped)
+			rsp <- openCards()
+			return
+		}
+	}
+}
+
+// Hands a subscribe request to its card, which responds once it's checked the subscriber's access, loading the
+// card if it isn't open. Cards that drop themselves meanwhile are forgotten; if it's the request's card, it's
+// loaded again.
+func route(req subReq, done chan *Card) {
+	for {
+		card, exists := master.cards[cardKey(req.orgId, req.cardId)]
+		if !exists {
+			var err error
+			card, err = newCard(req.orgId, req.cardId, done)
+			if err != nil {
+				log.Printf("error loading card %s: %s", req.cardId, err)
+				req.response <- subRsp{err: fmt.Errorf("unable to load card %s", req.cardId)}
+				return
+			}
+			master.cards[cardKey(req.orgId, req.cardId)] = card
+		}
+		select {
+		case card.subs <- req:
 			log.Printf("%d cards total", len(master.cards))
+			return
+		case dropped := <-done:
+			forget(dropped)
 		}
 	}
 }
 
+// Hands an unsubscribe request to its card, unless it's stopped. Cards that drop themselves meanwhile are forgotten.
+func unsubscribe(req unsubReq, done chan *Card) {
+	for {
+		select {
+		case req.card.unsubs <- req:
+			return
+		case <-req.card.stopped:
+			return
+		case dropped := <-done:
+			forget(dropped)
+		}
+	}
+}
+
+func forget(card *Card) {
+	delete(master.cards, cardKey(card.orgId, card.id))
+	log.Printf("%d cards total", len(master.cards))
+}
+
+func openCards() []*Card {
+	cards := make([]*Card, 0, len(master.cards))
+	for _, card := range master.cards {
+		cards = append(cards, card)
+	}
+	return cards
+}
+
 type Card struct {
+	orgId         string
+	db            store.Store // the org's store
 	id            string
 	props         map[string]*ot.Doc
-	history       []api.Change
-	subscriptions map[string]sockjs.Session
+	history       []*store.Change          // history[i] produced revision i+1
+	subscriptions map[string]*subscription // subKey -> subscription
 	subs          chan subReq
 	unsubs        chan unsubReq
 	updates       chan cardUpdate
+	restores      chan restoreReq
+	undos         chan undoReq
+	shares        chan shareReq
+	cursors       chan cursorReq
+	comments      chan commentReq
+	resolves      chan resolveReq
+	anchors       map[string]*anchor    // commentId -> anchor, as of the current revision
+	orphaned      bool                  // set when anchors are orphaned, until that's saved
+	undoStates    map[string]*undoState // userId -> undo state
+	flushes       chan chan bool
+	stopped       chan bool         // closed when the card's goroutine exits
+	savedRev      int               // the revision last saved to the store
+	savedProps    map[string]string // the props last saved to the store
+	flushTimer    <-chan time.Time  // non-nil while a flush is pending
+}
+
+// A connection's subscription to a card.
+type subscription struct {
+	sock       sockjs.Session
+	connId     string
+	userId     string
+	subId      int
+	units      ot.Unit     // what the subscriber's ops count
+	principals []string    // who the subscriber acts as, for access control
+	revoked    bool        // set once the subscriber loses access to the card
+	cursor     *api.Cursor // counted in bytes against the current revision; nil if the subscriber has none
 }
 
 type cardUpdate struct {
 	connId string
+	userId string
 	subId  int
 	rev    int
 	change api.Change
 }
 
-func newCard(cardId string, done chan<- *Card) (*Card, error) {
+func newCard(orgId, cardId string, done chan<- *Card) (*Card, error) {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return nil, err
+	}
 	card := &Card{
+		orgId:         orgId,
+		db:            st,
 		id:            cardId,
 		props:         make(map[string]*ot.Doc),
-		history:       make([]api.Change, 0),
-		subscriptions: make(map[string]sockjs.Session),
+		history:       make([]*store.Change, 0),
+		subscriptions: make(map[string]*subscription),
 		subs:          make(chan subReq),
 		unsubs:        make(chan unsubReq),
 		updates:       make(chan cardUpdate), // TODO: consider increasing channel size
+		restores:      make(chan restoreReq),
+		undos:         make(chan undoReq),
+		shares:        make(chan shareReq),
+		cursors:       make(chan cursorReq),
+		comments:      make(chan commentReq),
+		resolves:      make(chan resolveReq),
+		undoStates:    make(map[string]*undoState),
+		flushes:       make(chan chan bool),
+		stopped:       make(chan bool),
 	}
 
-	// TODO: I don't like the way we're dealing with JsonObject here.
-	// Consider ditching it and just keeping its little 'get-walker' as a helper func.
-	solrDoc, err := solr.GetDoc("hb", cardId)
+	doc, err := st.LoadCard(cardId)
 	if err != nil {
 		return nil, err
 	}
-	solrMap := map[string]interface{}(solrDoc)
-	for k, v := range solrMap {
-		if strings.HasPrefix(k, "prop_") {
-			card.props[k[5:]] = ot.NewDoc(v.(string))
+	changes, err := st.LoadChanges(cardId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cards stored before change logs existed get their current props logged as a baseline,
+	// so that their history can always be replayed from revision 0.
+	if len(changes) == 0 && doc.Rev == 0 {
+		if changes, err = appendBaseline(st, cardId, doc.Props, "", ""); err != nil {
+			return nil, err
 		}
+		doc.Rev = len(changes)
+	}
+	if doc.Rev > len(changes) {
+		return nil, fmt.Errorf("change log for card %s ends at rev %d, before its saved rev %d", cardId, len(changes), doc.Rev)
 	}
 
+	// Start with the saved props, then catch up with any changes logged after they were saved.
+	for k, v := range doc.Props {
+		card.props[k] = ot.NewDoc(v)
+	}
+	for _, change := range changes[doc.Rev:] {
+		if err = card.prop(change.Prop).Apply(change.Ops); err != nil {
+			return nil, fmt.Errorf("failed to replay rev %d of card %s: %s", change.Rev, cardId, err)
+		}
+	}
+	card.history = changes
+	card.savedRev = doc.Rev
+	card.savedProps = doc.Props
+	card.loadAnchors()
+
 	go card.run(done)
 	return card, nil
 }
 
-// Creates a new, empty card.
-func Create(connId string, props map[string]string) (cardId string, err error) {
-	// Create a 64-bit cardid by hashing a combination of the connection id and the unix epoch time in nanos.
-	// Hopefully this is good enough to make collisions extremely unlikely. I really don't want super-long ids.
-	h := fnv.New64a()
-	h.Write([]byte(connId))
-	cardIdInt := h.Sum64() ^ uint64(time.Now().UnixNano())
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, cardIdInt)
-	cardIdBuf := &bytes.Buffer{}
-	base64.NewEncoder(base64.URLEncoding, cardIdBuf).Write(buf)
-	cardId = cardIdBuf.String()
+// Creates a new card in an org with the given initial props, owned by the given user.
+func Create(orgId, connId, userId string, props map[string]string) (cardId string, err error) {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return "", err
+	}
+	if err = schema.ValidateProps(props); err != nil {
+		return "", err
+	}
+	owned := map[string]string{auth.OwnerProp: userId}
+	for name, value := range props {
+		if reserved(name) {
+			return "", reservedError(name)
+		}
+		owned[name] = value
+	}
+	return create(orgId, st, connId, userId, owned)
+}
 
-	newProps := make(map[string]*ot.Doc)
-	for k, v := range props {
-		newProps[k] = ot.NewDoc(v)
+// Creates a card in an org's store with the given props, which aren't checked.
+func create(orgId string, st store.Store, connId, userId string, props map[string]string) (cardId string, err error) {
+	creating.Lock()
+	defer creating.Unlock()
+	if cardId, err = newCardId(st, connId); err != nil {
+		return "", err
 	}
 
-	if err = solr.UpdateDoc("hb", cardId, newProps, true); err != nil {
+	changes, err := appendBaseline(st, cardId, props, connId, userId)
+	if err != nil {
+		return "", err
+	}
+	if err = st.CreateCard(cardId, len(changes), props); err != nil {
 		return "", err
 	}
+	search.Changed(orgId, cardId, nil, props)
 
 	return
 }
 
-// Subscribes to a card, potentially loading it.
-func Subscribe(cardId string, connId string, subId int, sock sockjs.Session) (*Card, error) {
-	rsp := make(chan *Card)
-	master.subs <- subReq{cardId: cardId, connId: connId, subId: subId, sock: sock, response: rsp}
-	return <-rsp, nil
+// Held while a new card is given an id and created, so that no other card can take the id in between.
+var creating sync.Mutex
+
+// How many ids a new card tries before giving up.
+const maxIdTries = 10
+
+// Picks an id that no card in a store has, saved or logged.
+func newCardId(st store.Store, connId string) (string, error) {
+	for try := 0; try < maxIdTries; try++ {
+		// Create a 64-bit cardid by hashing a combination of the connection id and the unix epoch time in nanos.
+		// Hopefully this is good enough to make collisions extremely unlikely. I really don't want super-long ids.
+		// Retries hash in the try too, as cards created close together can get the same time.
+		h := fnv.New64a()
+		h.Write([]byte(connId))
+		if try > 0 {
+			fmt.Fprintf(h, "#%d", try)
+		}
+		cardIdInt := h.Sum64() ^ uint64(time.Now().UnixNano())
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, cardIdInt)
+		cardIdBuf := &bytes.Buffer{}
+		base64.NewEncoder(base64.URLEncoding, cardIdBuf).Write(buf)
+		cardId := cardIdBuf.String()
+
+		if _, err := st.LoadCard(cardId); err != store.ErrorNotFound {
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		changes, err := st.LoadChanges(cardId)
+		if err != nil {
+			return "", err
+		}
+		if len(changes) == 0 {
+			return cardId, nil
+		}
+	}
+	return "", errors.New("unable to find an unused card id")
+}
+
+// Logs changes that take a card from empty (revision 0) to the given props, one per non-empty prop.
+func appendBaseline(st store.Store, cardId string, props map[string]string, connId, userId string) ([]*store.Change, error) {
+	names := make([]string, 0, len(props))
+	for name, value := range props {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]*store.Change, len(names))
+	for i, name := range names {
+		changes[i] = &store.Change{
+			Rev:    i + 1,
+			Prop:   name,
+			Ops:    ot.Ops{{S: props[name]}},
+			ConnId: connId,
+			UserId: userId,
+			Time:   time.Now().UTC(),
+		}
+		if err := st.AppendChange(cardId, changes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// Subscribes a user's connection to an org's card, potentially loading it. The subscriber's ops count the given
+// units, and it acts as the given principals: it must be able to view the card, and to edit it to make changes.
+// Returns the card's state as of subscribing, with its other subscribers, who are told of the new one, and its
+// comments; or ErrorForbidden if it can't view the card.
+func Subscribe(orgId, cardId, connId, userId string, subId int, units ot.Unit, principals []string, sock sockjs.Session) (*Card, *api.SubscribeCardRsp, error) {
+	rsp := make(chan subRsp)
+	req := subReq{
+		orgId:      orgId,
+		cardId:     cardId,
+		connId:     connId,
+		userId:     userId,
+		subId:      subId,
+		units:      units,
+		principals: principals,
+		sock:       sock,
+		response:   rsp,
+	}
+	select {
+	case master.subs <- req:
+	case <-master.stopped:
+		return nil, nil, ErrorShutdown
+	}
+	sub := <-rsp
+	return sub.card, sub.rsp, sub.err
 }
 
-// Receives a change, transforms and applies it, returning the transformed change.
-// Sending the updated change to connected clients is the caller's responsibility.
-func (card *Card) Recv(rev int, change api.Change) (api.Change, error) {
+// Receives a change, then transforms, logs and applies it, returning its history entry. If it can't be logged, the
+// card is left untouched. Sending the entry to connected clients is the caller's responsibility.
+func (card *Card) Recv(rev int, change api.Change, connId, userId string) (*store.Change, error) {
 	if rev < 0 || len(card.history) < rev {
-		return api.Change{}, fmt.Errorf("Revision not in history")
+		return nil, fmt.Errorf("Revision not in history")
 	}
 
 	var err error
 	outops := change.Ops
-
-	// Transform ops against all operations that happened since rev.
-	for _, other := range card.history[rev:] {
-		if other.Prop == change.Prop {
-			if outops, _, err = ot.Transform(change.Ops, other.Ops); err != nil {
-				return api.Change{}, err
+	doc := card.prop(change.Prop)
+
+	if change.Set != nil {
+		// Sets replace whatever the current value is, so there's nothing to transform.
+		outops = ot.Diff(doc.String(), *change.Set)
+	} else {
+		// Transform ops against all operations that happened since rev.
+		for _, other := range card.history[rev:] {
+			if other.Prop == change.Prop && len(outops) > 0 {
+				if outops, _, err = ot.Transform(outops, other.Ops); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
+	// Ops that were entirely cancelled out by others become a no-op.
+	if len(outops) == 0 && len(*doc) > 0 {
+		outops = ot.Ops{{N: len(*doc)}}
+	}
+
+	// Apply to a copy, so that an invalid value leaves the card untouched.
+	next := append(ot.Doc(nil), *doc...)
+	if err = next.Apply(outops); err != nil {
+		return nil, err
+	}
+	if err = schema.Lookup(card.kind(), change.Prop).Validate(next.String()); err != nil {
+		return nil, err
+	}
+	entry := &store.Change{
+		Rev:    len(card.history) + 1,
+		Prop:   change.Prop,
+		Ops:    outops,
+		ConnId: connId,
+		UserId: userId,
+		Time:   time.Now().UTC(),
+	}
+	// The log must hold every revision in memory, or the card can't be loaded again.
+	if err = card.db.AppendChange(card.id, entry); err != nil {
+		return nil, fmt.Errorf("error logging rev %d: %s", entry.Rev, err)
+	}
+	*doc = next
+	card.moveCursors(change.Prop, outops)
+	card.moveAnchors(change.Prop, outops)
+	card.history = append(card.history, entry)
+	return entry, nil
+}
 
-	// Get the propery's card, initializing it if absent.
-	// TODO: Should we delete card entries when they become empty, or only do it during serialization?
-	prop, exists := card.props[change.Prop]
+// Gets the named property's doc, initializing it if absent.
+// TODO: Should we delete card entries when they become empty, or only do it during serialization?
+func (card *Card) prop(name string) *ot.Doc {
+	prop, exists := card.props[name]
 	if !exists {
 		prop = ot.NewDoc("")
-		card.props[change.Prop] = prop
+		card.props[name] = prop
+	}
+	return prop
+}
+
+// Gets the card's access control list.
+func (card *Card) acl() *auth.ACL {
+	props := make(map[string]string)
+	for _, name := range []string{auth.OwnerProp, auth.EditorsProp, auth.ViewersProp} {
+		if doc, exists := card.props[name]; exists {
+			props[name] = doc.String()
+		}
 	}
+	return auth.ACLOf(props)
+}
 
-	// Apply to card.
-	if err = prop.Apply(change.Ops); err != nil {
-		return api.Change{}, err
+// Finds a connection's subscription, checking that it holds at least the given role.
+func (card *Card) authorize(connId string, subId int, role auth.Role) (*subscription, error) {
+	sub, exists := card.subscriptions[subKey(connId, subId)]
+	if !exists {
+		return nil, fmt.Errorf("not subscribed")
+	}
+	if sub.revoked || card.acl().RoleOf(sub.principals) < role {
+		return sub, ErrorForbidden
 	}
-	card.history = append(card.history, change)
-	return api.Change{Prop: change.Prop, Ops: outops}, nil
+	return sub, nil
+}
+
+// Gets the card's kind, which determines its props' types.
+func (card *Card) kind() string {
+	if doc, exists := card.props[schema.KindProp]; exists {
+		return doc.String()
+	}
+	return ""
+}
+
+// Gets the named property's doc as of revision rev, replaying its history unless rev is current.
+func (card *Card) propAt(name string, rev int) (ot.Doc, error) {
+	if rev == card.Rev() {
+		return *card.prop(name), nil
+	}
+	if rev < 0 || rev > card.Rev() {
+		return nil, fmt.Errorf("revision %d not in history", rev)
+	}
+	doc := ot.NewDoc("")
+	for _, change := range card.history[:rev] {
+		if change.Prop == name {
+			if err := doc.Apply(change.Ops); err != nil {
+				return nil, fmt.Errorf("failed to replay rev %d: %s", change.Rev, err)
+			}
+		}
+	}
+	return *doc, nil
+}
+
+// Converts a change made against revision rev, counted in the given units, to bytes.
+func (card *Card) changeToBytes(rev int, change api.Change, units ot.Unit) (api.Change, error) {
+	if units == ot.Bytes || change.Set != nil {
+		return change, nil
+	}
+	doc, err := card.propAt(change.Prop, rev)
+	if err != nil {
+		return change, err
+	}
+	change.Ops, err = doc.ToBytes(change.Ops, units)
+	return change, err
 }
 
 // Gets the current card revision.
@@ -208,76 +576,267 @@ func (card *Card) Props() map[string]string {
 
 // Unsubscribes a connection from the card.
 func (card *Card) Unsubscribe(connId string, subId int) {
-	master.unsubs <- unsubReq{card: card, connId: connId, subId: subId}
-	log.Printf("[%d] unsub card %s: %s/%d", len(card.subscriptions), card.id, connId, subId)
+	select {
+	case master.unsubs <- unsubReq{card: card, connId: connId, subId: subId}:
+	case <-master.stopped:
+	}
+	// The card goroutine owns its subscriptions, so it logs how many are left.
+	log.Printf("unsub card %s: %s/%d", card.id, connId, subId)
 }
 
 // Revise a card. Its goroutine will ensure that the resulting ops
 // are broadcast to all subscribers.
-func (card *Card) Revise(connId string, subId int, rev int, change api.Change) {
-	card.updates <- cardUpdate{connId: connId, subId: subId, rev: rev, change: change}
+func (card *Card) Revise(connId, userId string, subId int, rev int, change api.Change) {
+	card.updates <- cardUpdate{connId: connId, userId: userId, subId: subId, rev: rev, change: change}
+}
+
+// Saves all open cards that have unsaved changes, returning once they're saved.
+func FlushAll() {
+	rsp := make(chan []*Card)
+	select {
+	case master.lists <- rsp:
+	case <-master.stopped:
+		return
+	}
+	for _, card := range <-rsp {
+		card.Flush()
+	}
+}
+
+// Flushes all open cards, then stops loading new ones. Returns once all cards are saved. Safe to call more than once.
+func Shutdown() {
+	shutdown.Do(func() {
+		rsp := make(chan []*Card)
+		master.stops <- rsp
+		for _, card := range <-rsp {
+			card.Flush()
+		}
+	})
+}
+
+var shutdown sync.Once
+
+// Saves the card if it has unsaved changes, returning once it's saved.
+func (card *Card) Flush() {
+	flushed := make(chan bool)
+	select {
+	case card.flushes <- flushed:
+		<-flushed
+	case <-card.stopped:
+		// Cards are always flushed when dropped.
+	}
 }
 
 // Main loop for each open Card. Maintains access to subscriptions via the subs/unsubs channels.
 func (card *Card) run(done chan<- *Card) {
+	defer close(card.stopped)
+
+	// Changes may have been replayed from the log on load.
+	card.scheduleFlush()
+
 	for {
 		select {
 		case req := <-card.subs:
-			card.subscriptions[subKey(req.connId, req.subId)] = req.sock
+			if card.acl().RoleOf(req.principals) < auth.Viewer {
+				req.response <- subRsp{err: ErrorForbidden}
+				if len(card.subscriptions) == 0 {
+					log.Printf("dropping card %s: %s", card.id, req.connId)
+					card.drop(done)
+					return
+				}
+				continue
+			}
+			sub := &subscription{
+				sock:       req.sock,
+				connId:     req.connId,
+				userId:     req.userId,
+				subId:      req.subId,
+				units:      req.units,
+				principals: req.principals,
+			}
+			card.subscriptions[subKey(req.connId, req.subId)] = sub
+			card.announce(sub, PresenceJoin)
+			req.response <- subRsp{card: card, rsp: &SubscribeCardRsp{
+				CardId:   card.id,
+				SubId:    req.subId,
+				Rev:      card.Rev(),
+				Props:    card.Props(),
+				Present:  card.presence(sub),
+				Comments: card.commentsIn(req.units),
+			}}
 			log.Printf("[%d] sub card %s: %s", len(card.subs), req.cardId, req.connId)
 
 		case req := <-card.unsubs:
-			delete(card.subscriptions, subKey(req.connId, req.subId))
+			key := subKey(req.connId, req.subId)
+			sub, exists := card.subscriptions[key]
+			delete(card.subscriptions, key)
+			if exists && !sub.revoked {
+				card.announce(sub, PresenceLeave)
+			}
 			if len(card.subscriptions) == 0 {
 				log.Printf("dropping card %s: %s", card.id, req.connId)
-				done <- card
+				card.drop(done)
 				return
 			}
 			log.Printf("[%d] unsub card %s: %s", len(card.subs), card.id, req.connId)
 
 		case update := <-card.updates:
-			outchange, err := card.Recv(update.rev, update.change)
-			if err != nil {
-				log.Printf("error applying ops to card %s: %s", card.id, err)
-				return
+			sub, err := card.authorize(update.connId, update.subId, auth.Editor)
+			if err == nil && reserved(update.change.Prop) {
+				err = reservedError(update.change.Prop)
+			}
+			var entry *store.Change
+			base := append(ot.Doc(nil), *card.prop(update.change.Prop)...)
+			if err == nil {
+				var change api.Change
+				change, err = card.changeToBytes(update.rev, update.change, sub.units)
+				if err == nil {
+					entry, err = card.Recv(update.rev, change, update.connId, update.userId)
+				}
 			}
-			card.broadcast(update, outchange)
-			err = card.persist() // TODO: Persist less aggressively.
 			if err != nil {
-				log.Printf("error persisting card: %s", err.Error())
+				card.fail(update.connId, update.subId, "revising", err)
+				continue
+			}
+			card.recordUndo(update.userId, entry.Rev)
+			card.broadcast(update, api.Change{Prop: entry.Prop, Ops: entry.Ops}, base)
+			card.scheduleFlush()
+
+		case req := <-card.restores:
+			if err := card.restore(req); err != nil {
+				card.fail(req.connId, req.subId, "restoring", err)
+			}
+			card.scheduleFlush()
+
+		case req := <-card.shares:
+			if err := card.share(req); err != nil {
+				card.fail(req.connId, req.subId, "sharing", err)
+			}
+			// Save right away, so that searches see who can read the card.
+			card.flush()
+
+		case req := <-card.cursors:
+			if err := card.setCursor(req); err != nil {
+				card.fail(req.connId, req.subId, "setting cursor on", err)
+			}
+
+		case req := <-card.comments:
+			if err := card.comment(req); err != nil {
+				card.fail(req.connId, req.SubId, "commenting on", err)
+			}
+			card.scheduleFlush()
+
+		case req := <-card.resolves:
+			if err := card.resolve(req); err != nil {
+				card.fail(req.connId, req.subId, "resolving comment on", err)
 			}
+			card.scheduleFlush()
+
+		case req := <-card.undos:
+			if err := card.undo(req); err != nil {
+				card.fail(req.connId, req.subId, "undoing change to", err)
+			}
+			card.scheduleFlush()
+
+		case <-card.flushTimer:
+			card.flush()
+
+		case flushed := <-card.flushes:
+			card.flush()
+			flushed <- true
+		}
+
+		// Comments orphaned by a revision are saved as a revision of their own, following it.
+		if card.orphaned {
+			if err := card.saveAnchors("", ""); err != nil {
+				log.Printf("error saving orphaned comments on card %s: %s", card.id, err)
+			}
+			card.scheduleFlush()
 		}
 	}
 }
 
-func (card *Card) broadcast(update cardUpdate, change api.Change) {
+// Logs a request that failed, and tells the subscription that made it, if it's still there. what says what the
+// request was doing to the card, such as "sharing".
+func (card *Card) fail(connId string, subId int, what string, err error) {
+	log.Printf("error %s card %s: %s", what, card.id, err)
+	if sub, exists := card.subscriptions[subKey(connId, subId)]; exists {
+		ErrorRsp{Msg: fmt.Sprintf("error %s card %s: %s", what, card.id, err)}.Send(sub.sock)
+	}
+}
+
+// Saves the card and hands it back to the master loop to be forgotten. The card's goroutine must exit afterwards.
+func (card *Card) drop(done chan<- *Card) {
+	card.flush()
+	select {
+	case done <- card:
+	case <-master.stopped:
+	}
+}
+
+// Sends a change to all subscribers. base is the prop's doc before the change was applied, against which its
+// ops are converted to each subscriber's units.
+func (card *Card) broadcast(update cardUpdate, change api.Change, base ot.Doc) {
 	rsp := ReviseRsp{
 		OrigConnId: update.connId,
 		OrigSubId:  update.subId,
+		AuthorId:   update.userId,
 		Rev:        update.rev,
-		CardId:      card.id,
-		Change:     change,
+		CardId:     card.id,
 	}
 	socks := make(map[sockjs.Session][]int)
-	for key, sock := range card.subscriptions {
-		socks[sock] = append(socks[sock], connIdFromKey(key))
+	units := make(map[sockjs.Session]ot.Unit)
+	for _, sub := range card.subscriptions {
+		if sub.revoked {
+			continue
+		}
+		socks[sub.sock] = append(socks[sub.sock], sub.subId)
+		units[sub.sock] = sub.units
 	}
+	converted := make(map[ot.Unit]ot.Ops)
 	for sock, _ := range socks {
+		ops, exists := converted[units[sock]]
+		if !exists {
+			var err error
+			if ops, err = base.FromBytes(change.Ops, units[sock]); err != nil {
+				log.Printf("error converting rev %d of card %s to %s: %s", update.rev, card.id, units[sock], err)
+				continue
+			}
+			converted[units[sock]] = ops
+		}
+		rsp.Change = api.Change{Prop: change.Prop, Ops: ops}
 		rsp.SubIds = socks[sock]
 		rsp.Send(sock)
 	}
 }
 
-func (card *Card) persist() error {
-	return solr.UpdateDoc("hb", card.id, card.props, true)
+// Flushes immediately if the card has too many unsaved changes, or arranges for a flush soon if it has any.
+func (card *Card) scheduleFlush() {
+	switch {
+	case card.Rev()-card.savedRev >= MaxDirtyOps:
+		card.flush()
+	case card.Rev() > card.savedRev && card.flushTimer == nil:
+		card.flushTimer = time.After(FlushInterval)
+	}
 }
 
-func subKey(connId string, subId int) string {
-	return fmt.Sprintf("%s:%d", connId, subId)
+// Saves the card if it has unsaved changes. On failure, the flush is retried later.
+func (card *Card) flush() {
+	card.flushTimer = nil
+	if card.Rev() == card.savedRev {
+		return
+	}
+	props := card.Props()
+	if err := card.db.SaveCard(card.id, card.Rev(), props); err != nil {
+		log.Printf("error persisting card %s: %s", card.id, err)
+		card.flushTimer = time.After(FlushInterval)
+		return
+	}
+	search.Changed(card.orgId, card.id, card.savedProps, props)
+	card.savedRev = card.Rev()
+	card.savedProps = props
 }
 
-func connIdFromKey(key string) int {
-	parts := strings.Split(key, ":")
-	subId, _ := strconv.ParseInt(parts[1], 10, 32)
-	return int(subId)
+func subKey(connId string, subId int) string {
+	return fmt.Sprintf("%s:%d", connId, subId)
 }
@@ -0,0 +1,283 @@
+package card
+
+import (
+	"encoding/json"
+	"errors"
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const timeout = 5 * time.Second
+
+// A store whose change log can be made to fail.
+type flakyStore struct {
+	store.Store
+	lock sync.Mutex
+	fail bool
+}
+
+func (st *flakyStore) AppendChange(cardId string, change *store.Change) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.fail {
+		return errors.New("disk full")
+	}
+	return st.Store.AppendChange(cardId, change)
+}
+
+func (st *flakyStore) setFail(fail bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.fail = fail
+}
+
+// Sets up cards over a fresh disk store in the default org.
+func startCards(t *testing.T) (*flakyStore, func()) {
+	dir, err := ioutil.TempDir("", "hbcard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := store.NewDiskStore(filepath.Join(dir, "hb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &flakyStore{Store: disk}
+	orgs, err := store.NewOrgs(func(orgId string) (store.Store, error) { return st, nil }, store.DefaultOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Init(orgs)
+	return st, func() { os.RemoveAll(dir) }
+}
+
+// A sockjs session that collects the responses sent to it.
+type fakeSock struct {
+	id   string
+	rsps chan *api.Rsp
+}
+
+func newSock(id string) *fakeSock {
+	return &fakeSock{id: id, rsps: make(chan *api.Rsp, 100)}
+}
+
+func (s *fakeSock) ID() string                               { return s.id }
+func (s *fakeSock) Recv() (string, error)                    { select {} }
+func (s *fakeSock) Close(status uint32, reason string) error { return nil }
+
+func (s *fakeSock) Send(msg string) error {
+	var rsp api.Rsp
+	if err := json.Unmarshal([]byte(msg), &rsp); err != nil {
+		return err
+	}
+	s.rsps <- &rsp
+	return nil
+}
+
+// Waits for the next response of the given type, failing on errors and skipping presence events.
+func (s *fakeSock) next(t *testing.T, msgType string) *api.Rsp {
+	t.Helper()
+	for {
+		select {
+		case rsp := <-s.rsps:
+			if rsp.Type == msgType {
+				return rsp
+			}
+			if rsp.Type == api.MsgError {
+				t.Fatalf("%s: expected %s, got error: %s", s.id, msgType, rsp.Error.Msg)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("%s: timed out waiting for %s", s.id, msgType)
+		}
+	}
+}
+
+// Waits for an error response, skipping any others.
+func (s *fakeSock) nextError(t *testing.T) string {
+	t.Helper()
+	for {
+		select {
+		case rsp := <-s.rsps:
+			if rsp.Type == api.MsgError {
+				return rsp.Error.Msg
+			}
+		case <-time.After(timeout):
+			t.Fatalf("%s: timed out waiting for an error", s.id)
+		}
+	}
+}
+
+// Subscribes a user in no groups to a card, counting bytes.
+func subscribe(t *testing.T, cardId, userId string, subId int, sock *fakeSock) (*Card, *api.SubscribeCardRsp) {
+	t.Helper()
+	return subscribeAs(t, cardId, userId, auth.Principals(userId, nil), ot.Bytes, subId, sock)
+}
+
+func subscribeAs(t *testing.T, cardId, userId string, principals []string, units ot.Unit, subId int, sock *fakeSock) (*Card, *api.SubscribeCardRsp) {
+	t.Helper()
+	c, rsp, err := Subscribe(store.DefaultOrg, cardId, sock.ID(), userId, subId, units, principals, sock)
+	if err != nil {
+		t.Fatalf("error subscribing %s to card %s: %s", userId, cardId, err)
+	}
+	return c, rsp
+}
+
+func createCard(t *testing.T, userId string, props map[string]string) string {
+	t.Helper()
+	cardId, err := Create(store.DefaultOrg, "test", userId, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cardId
+}
+
+func TestReviseLogFailure(t *testing.T) {
+	st, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	sock := newSock("a")
+	c, sub := subscribe(t, cardId, "joel", 1, sock)
+
+	// A revision that can't be logged is refused, and leaves the card as it was.
+	st.setFail(true)
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{N: 4}, {S: "!"}}})
+	sock.nextError(t)
+	st.setFail(false)
+
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "Buy "}, {N: 4}}})
+	if rev := sock.next(t, api.MsgRevise).Revise; rev.Rev != sub.Rev {
+		t.Errorf("expected the revision to be made against rev %d, got %+v", sub.Rev, rev)
+	}
+	c.Flush()
+
+	// The log and the saved card agree, so the card can be loaded again.
+	doc, err := st.LoadCard(cardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := st.LoadChanges(cardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Rev != len(changes) || doc.Props["title"] != "Buy milk" {
+		t.Errorf("expected Buy milk saved at rev %d, got %q at rev %d", len(changes), doc.Props["title"], doc.Rev)
+	}
+	c.Unsubscribe(sock.ID(), 1)
+}
+
+func TestCreate(t *testing.T) {
+	st, cleanup := startCards(t)
+	defer cleanup()
+
+	if _, err := Create(store.DefaultOrg, "test", "joel", map[string]string{"type": "card", "kind": "chore"}); err == nil {
+		t.Error("expected a card of an unknown kind to be refused")
+	}
+	if _, err := Create(store.DefaultOrg, "test", "joel", map[string]string{"title": "mine", auth.OwnerProp: "bob"}); err == nil {
+		t.Error("expected a card naming its owner to be refused")
+	}
+	cardId := createCard(t, "joel", map[string]string{"type": "card", "kind": "effort"})
+	doc, err := st.LoadCard(cardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Props[auth.OwnerProp] != "joel" || doc.Props["kind"] != "effort" {
+		t.Errorf("expected an effort owned by joel, got %v", doc.Props)
+	}
+}
+
+func TestReviseUnits(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "café"})
+	runes, bytes := newSock("runes"), newSock("bytes")
+	c, sub := subscribeAs(t, cardId, "joel", auth.Principals("joel", nil), ot.Runes, 1, runes)
+	defer c.Unsubscribe(runes.ID(), 1)
+	subscribe(t, cardId, "joel", 1, bytes)
+	defer c.Unsubscribe(bytes.ID(), 1)
+
+	// Ops that split a character are refused.
+	c.Revise(bytes.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{N: 4}, {N: -1}}})
+	bytes.nextError(t)
+
+	// Replace the "é", counting runes. Subscribers counting bytes see it in bytes.
+	change := api.Change{Prop: "title", Ops: ot.Ops{{N: 3}, {N: -1}, {S: "e"}}}
+	c.Revise(runes.ID(), "joel", 1, sub.Rev, change)
+	if rsp := runes.next(t, api.MsgRevise).Revise; !rsp.Change.Ops.Equal(change.Ops) {
+		t.Errorf("expected ack of %v, got %v", change.Ops, rsp.Change.Ops)
+	}
+	if rsp, expected := bytes.next(t, api.MsgRevise).Revise, (ot.Ops{{N: 3}, {N: -2}, {S: "e"}}); !rsp.Change.Ops.Equal(expected) {
+		t.Errorf("expected revision %v, got %v", expected, rsp.Change.Ops)
+	}
+}
+
+func TestReviseTypedProps(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"type": "card", "kind": "effort"})
+	sock := newSock("a")
+	c, sub := subscribe(t, cardId, "joel", 1, sock)
+	defer c.Unsubscribe(sock.ID(), 1)
+
+	maybe, yes := "maybe", "true"
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "done", Set: &maybe})
+	sock.nextError(t)
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "done", Set: &yes})
+	if rsp := sock.next(t, api.MsgRevise).Revise; !rsp.Change.Ops.Equal(ot.Ops{{S: "true"}}) {
+		t.Errorf("expected set broadcast as ops, got %v", rsp.Change.Ops)
+	}
+}
+
+func TestCreateIds(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	// Ids are short, and cards created together get their own.
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		cardId := createCard(t, "joel", map[string]string{"title": "same"})
+		if len(cardId) != 8 || ids[cardId] {
+			t.Fatalf("expected a new 8-character id, got %q", cardId)
+		}
+		ids[cardId] = true
+	}
+}
+
+// Subscribing to a card while it drops itself gets the card loaded again.
+func TestSubscribeWhileDropping(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	sock := newSock("a")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			// Forbidden subscribers, and the last one to leave, each drop the card.
+			if _, _, err := Subscribe(store.DefaultOrg, cardId, "b", "bob", 1, ot.Bytes, auth.Principals("bob", nil), sock); err != ErrorForbidden {
+				t.Errorf("expected bob's subscribe to be forbidden, got %v", err)
+			}
+			c, rsp, err := Subscribe(store.DefaultOrg, cardId, sock.ID(), "joel", 1, ot.Bytes, auth.Principals("joel", nil), sock)
+			if err != nil || rsp.Props["title"] != "milk" {
+				t.Errorf("expected the card, got %+v, %v", rsp, err)
+				break
+			}
+			c.Unsubscribe(sock.ID(), 1)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out subscribing while the card drops itself")
+	}
+}
@@ -0,0 +1,261 @@
+package card
+
+import (
+	"encoding/json"
+	"fmt"
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/schema"
+	"log"
+	"sort"
+)
+
+// Comments are cards of their own kind, whose target prop is the id of the card they comment on. Comments anchored
+// to the text of a card are listed in its comments prop: a JSON object mapping comment ids to anchors, which only
+// the server changes. Each anchor is as of its own revision. Cards keep their anchors in memory as of the current
+// revision, moving them along with each change to the text.
+const (
+	CommentKind  = "comment"
+	TargetProp   = "target"
+	BodyProp     = "body"
+	CommentsProp = "_comments"
+)
+
+// Where a comment is anchored. Offsets count bytes. Text inserted at either end of the range is kept out of it.
+type anchor struct {
+	UserId   string
+	Prop     string
+	Rev      int
+	Start    int
+	End      int
+	Resolved bool `json:",omitempty"`
+	Orphaned bool `json:",omitempty"` // set once all of the anchor's text is deleted
+}
+
+type commentReq struct {
+	api.CommentReq
+	connId string
+	userId string
+}
+
+type resolveReq struct {
+	connId    string
+	userId    string
+	subId     int
+	commentId string
+	resolved  bool
+}
+
+// Comments on the card's text, as requested by one of its subscriptions. Its goroutine creates the comment card
+// and anchors it.
+func (card *Card) Comment(connId, userId string, req api.CommentReq) {
+	card.comments <- commentReq{CommentReq: req, connId: connId, userId: userId}
+}
+
+// Resolves or reopens a comment on the card, as requested by the given subscription.
+func (card *Card) Resolve(connId, userId string, subId int, commentId string, resolved bool) {
+	card.resolves <- resolveReq{connId: connId, userId: userId, subId: subId, commentId: commentId, resolved: resolved}
+}
+
+// Applies a comment request. Commenting needs no more than viewing the card.
+func (card *Card) comment(req commentReq) error {
+	sub, err := card.authorize(req.connId, req.SubId, auth.Viewer)
+	if err != nil {
+		return err
+	}
+	if reserved(req.Prop) {
+		return fmt.Errorf("can't comment on %s", req.Prop)
+	}
+	if _, exists := card.props[req.Prop]; !exists {
+		return fmt.Errorf("no such prop: %s", req.Prop)
+	}
+	if req.Start < 0 || req.End < req.Start {
+		return fmt.Errorf("invalid comment range %d-%d", req.Start, req.End)
+	}
+	doc, err := card.propAt(req.Prop, req.Rev)
+	if err != nil {
+		return err
+	}
+	a := &anchor{UserId: req.userId, Prop: req.Prop}
+	if a.Start, err = toBytes(doc, req.Start, sub.units); err != nil {
+		return err
+	}
+	if a.End, err = toBytes(doc, req.End, sub.units); err != nil {
+		return err
+	}
+	for _, change := range card.history[req.Rev:] {
+		if change.Prop == a.Prop {
+			if _, err = a.move(change.Ops); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The comment can be read by whoever can read the card now. Later changes to the card's ACL don't carry over.
+	acl := &auth.ACL{Owner: req.userId}
+	for _, p := range card.acl().Readers() {
+		if p != req.userId {
+			acl.Viewers = append(acl.Viewers, p)
+		}
+	}
+	props := map[string]string{schema.KindProp: CommentKind, TargetProp: card.id, BodyProp: req.Body}
+	for name, value := range acl.Props() {
+		if value != "" {
+			props[name] = value
+		}
+	}
+	if err = schema.ValidateProps(props); err != nil {
+		return err
+	}
+	commentId, err := create(card.orgId, card.db, req.connId, req.userId, props)
+	if err != nil {
+		return err
+	}
+
+	card.anchors[commentId] = a
+	if err = card.saveAnchors(req.connId, req.userId); err != nil {
+		return err
+	}
+	api.CommentRsp{CardId: card.id, SubId: req.SubId, CommentId: commentId, Rev: card.Rev()}.Send(sub.sock)
+	return nil
+}
+
+// Applies a resolve request. Comments can be resolved and reopened by their authors, and by the card's editors.
+func (card *Card) resolve(req resolveReq) error {
+	sub, err := card.authorize(req.connId, req.subId, auth.Viewer)
+	if err != nil {
+		return err
+	}
+	a, exists := card.anchors[req.commentId]
+	if !exists {
+		return fmt.Errorf("no such comment: %s", req.commentId)
+	}
+	if a.UserId != req.userId && card.acl().RoleOf(sub.principals) < auth.Editor {
+		return ErrorForbidden
+	}
+	a.Resolved = req.resolved
+	if err = card.saveAnchors(req.connId, req.userId); err != nil {
+		return err
+	}
+	api.ResolveCommentRsp{
+		CardId:    card.id,
+		SubId:     req.subId,
+		CommentId: req.commentId,
+		Resolved:  req.resolved,
+		Rev:       card.Rev(),
+	}.Send(sub.sock)
+	return nil
+}
+
+// Reads the anchors in the card's comments prop, moving each from its revision to the current one. Malformed
+// anchors are dropped.
+func (card *Card) loadAnchors() {
+	card.anchors = make(map[string]*anchor)
+	doc, exists := card.props[CommentsProp]
+	if !exists || len(*doc) == 0 {
+		return
+	}
+	var anchors map[string]*anchor
+	if err := json.Unmarshal(*doc, &anchors); err != nil {
+		log.Printf("error reading comments on card %s: %s", card.id, err)
+		return
+	}
+	for id, a := range anchors {
+		if a == nil || a.Rev < 0 || a.Rev > card.Rev() {
+			log.Printf("dropping malformed anchor of comment %s on card %s", id, card.id)
+			continue
+		}
+		var err error
+		for _, change := range card.history[a.Rev:] {
+			if change.Prop != a.Prop {
+				continue
+			}
+			var orphaned bool
+			if orphaned, err = a.move(change.Ops); err != nil {
+				break
+			}
+			card.orphaned = card.orphaned || orphaned
+		}
+		if err != nil {
+			log.Printf("dropping anchor of comment %s on card %s: %s", id, card.id, err)
+			continue
+		}
+		card.anchors[id] = a
+	}
+}
+
+// Moves the anchors in a prop along with a change to it, counted in bytes. Anchors that are orphaned by it are
+// saved once the revision has been broadcast.
+func (card *Card) moveAnchors(prop string, ops ot.Ops) {
+	for id, a := range card.anchors {
+		if a.Prop != prop {
+			continue
+		}
+		orphaned, err := a.move(ops)
+		if err != nil {
+			log.Printf("error moving anchor of comment %s on card %s: %s", id, card.id, err)
+			continue
+		}
+		card.orphaned = card.orphaned || orphaned
+	}
+}
+
+// Writes the card's anchors, as of the current revision, to its comments prop. Attributed to the given connection
+// and user, or to the server if they're empty.
+func (card *Card) saveAnchors(connId, userId string) error {
+	card.orphaned = false
+	value := ""
+	if len(card.anchors) > 0 {
+		for _, a := range card.anchors {
+			a.Rev = card.Rev()
+		}
+		buf, err := json.Marshal(card.anchors)
+		if err != nil {
+			return err
+		}
+		value = string(buf)
+	}
+	_, err := card.replaceProp(CommentsProp, value, connId, userId)
+	return err
+}
+
+// Lists the card's comments, ordered by id, with their anchors in the given units against the current revision.
+func (card *Card) commentsIn(units ot.Unit) []api.Comment {
+	ids := make([]string, 0, len(card.anchors))
+	for id := range card.anchors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var comments []api.Comment
+	for _, id := range ids {
+		a := card.anchors[id]
+		start, end, err := rangeFromBytes(*card.prop(a.Prop), a.Start, a.End, units)
+		if err != nil {
+			log.Printf("error converting anchor of comment %s on card %s: %s", id, card.id, err)
+			continue
+		}
+		comments = append(comments, api.Comment{
+			Id:       id,
+			UserId:   a.UserId,
+			Prop:     a.Prop,
+			Start:    start,
+			End:      end,
+			Resolved: a.Resolved,
+			Orphaned: a.Orphaned,
+		})
+	}
+	return comments
+}
+
+// Moves the anchor along with a change to its prop, reporting whether that orphaned it.
+func (a *anchor) move(ops ot.Ops) (bool, error) {
+	r, err := ot.TransformRange(ot.Range{Start: a.Start, End: a.End}, ops, ot.After, ot.Before)
+	if err != nil {
+		return false, err
+	}
+	orphaned := !a.Orphaned && a.Start < a.End && r.Start == r.End
+	a.Start, a.End = r.Start, r.End
+	a.Orphaned = a.Orphaned || orphaned
+	return orphaned, nil
+}
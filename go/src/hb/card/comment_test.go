@@ -0,0 +1,77 @@
+package card
+
+import (
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"testing"
+)
+
+func TestCommentAnchors(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"body": "the quick brown fox"})
+	alice, bob := newSock("alice"), newSock("bob")
+	c, sub := subscribe(t, cardId, "joel", 1, alice)
+	defer c.Unsubscribe(alice.ID(), 1)
+	rev := sub.Rev
+	commentsOf := func(userId string) []api.Comment {
+		t.Helper()
+		sock := newSock("peek")
+		_, rsp := subscribe(t, cardId, userId, 1, sock)
+		c.Unsubscribe(sock.ID(), 1)
+		return rsp.Comments
+	}
+	revise := func(ops ot.Ops) {
+		t.Helper()
+		c.Revise(alice.ID(), "joel", 1, rev, api.Change{Prop: "body", Ops: ops})
+		for {
+			if rsp := alice.next(t, api.MsgRevise).Revise; rsp.Change.Prop == "body" {
+				rev = rsp.Rev + 1
+				return
+			}
+		}
+	}
+
+	// Comment on "quick", which is made a comment card.
+	c.Comment(alice.ID(), "joel", api.CommentReq{SubId: 1, Prop: "body", Rev: rev, Start: 4, End: 9, Body: "fast?"})
+	rsp := alice.next(t, api.MsgComment).Comment
+	commentId, rev := rsp.CommentId, rsp.Rev
+	c.Comment(alice.ID(), "joel", api.CommentReq{SubId: 1, Prop: CommentsProp, Rev: rev, Body: "nope"})
+	alice.nextError(t)
+	comment, commentSub := subscribe(t, commentId, "joel", 1, alice)
+	if p := commentSub.Props; p["type"] != "comment" || p[TargetProp] != cardId || p[BodyProp] != "fast?" {
+		t.Errorf("unexpected comment card %+v", p)
+	}
+	comment.Unsubscribe(alice.ID(), 1)
+
+	// The anchor follows edits, keeping out text inserted at its ends.
+	revise(ot.Ops{{N: 4}, {S: "very "}, {N: 15}})
+	if c := commentsOf("joel"); len(c) != 1 || c[0].Id != commentId || c[0].UserId != "joel" || c[0].Start != 9 || c[0].End != 14 {
+		t.Errorf("unexpected comments %+v", c)
+	}
+
+	// Only the author and the card's editors can resolve it.
+	if _, _, err := Subscribe(store.DefaultOrg, cardId, bob.ID(), "bob", 1, ot.Bytes, auth.Principals("bob", nil), bob); err != ErrorForbidden {
+		t.Errorf("expected bob's subscribe to be forbidden, got %v", err)
+	}
+	c.Share(alice.ID(), "joel", 1, "bob", auth.Viewer)
+	rev = alice.next(t, api.MsgShareCard).ShareCard.Rev
+	subscribe(t, cardId, "bob", 1, bob)
+	defer c.Unsubscribe(bob.ID(), 1)
+	c.Resolve(bob.ID(), "bob", 1, commentId, true)
+	bob.nextError(t)
+	c.Resolve(alice.ID(), "joel", 1, commentId, true)
+	rev = alice.next(t, api.MsgResolveComment).ResolveComment.Rev
+	if c := commentsOf("bob"); len(c) != 1 || !c[0].Resolved || c[0].Orphaned {
+		t.Errorf("expected a resolved comment, got %+v", c)
+	}
+
+	// Deleting its text orphans it.
+	revise(ot.Ops{{N: 9}, {N: -5}, {N: 10}})
+	if c := commentsOf("bob"); len(c) != 1 || !c[0].Orphaned || c[0].Start != 9 || c[0].End != 9 {
+		t.Errorf("expected an orphaned comment, got %+v", c)
+	}
+}
@@ -0,0 +1,156 @@
+package card
+
+import (
+	"fmt"
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"sort"
+	"time"
+)
+
+type restoreReq struct {
+	connId string
+	userId string
+	subId  int
+	rev    int
+	time   time.Time
+}
+
+// Reconstructs an org's card's props as of the given revision, by replaying its change log.
+// If t is non-zero, it selects the last revision made at or before t instead.
+// Returns the selected revision along with the props, or ErrorForbidden if none of the given principals can
+// currently view the card. Nil principals aren't checked, for admin tools.
+func PropsAt(orgId, cardId string, rev int, t time.Time, principals []string) (int, map[string]string, error) {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := st.LoadCard(cardId); err != nil {
+		return 0, nil, err
+	}
+	changes, err := st.LoadChanges(cardId)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The saved card may lag behind its log, so check access against the latest revision.
+	current, err := replay(changes, len(changes))
+	if err != nil {
+		return 0, nil, err
+	}
+	if principals != nil && auth.ACLOf(current).RoleOf(principals) < auth.Viewer {
+		return 0, nil, ErrorForbidden
+	}
+	if !t.IsZero() {
+		rev = revAt(changes, t)
+	}
+	props, err := replay(changes, rev)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rev, props, nil
+}
+
+// Restores a card to its state as of a past revision (or time, if t is non-zero), as requested by the given
+// subscription. Its goroutine will broadcast the resulting changes to all subscribers.
+func (card *Card) Restore(connId, userId string, subId int, rev int, t time.Time) {
+	card.restores <- restoreReq{connId: connId, userId: userId, subId: subId, rev: rev, time: t}
+}
+
+// Applies a restore request, replacing each prop that differs from its past state. The ACL is left as it is.
+func (card *Card) restore(req restoreReq) error {
+	if _, err := card.authorize(req.connId, req.subId, auth.Editor); err != nil {
+		return err
+	}
+	rev := req.rev
+	if !req.time.IsZero() {
+		rev = revAt(card.history, req.time)
+	}
+	past, err := replay(card.history, rev)
+	if err != nil {
+		return err
+	}
+
+	// Props that didn't exist at rev are emptied.
+	for name := range card.props {
+		if _, exists := past[name]; !exists {
+			past[name] = ""
+		}
+	}
+	names := make([]string, 0, len(past))
+	for name := range past {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if reserved(name) {
+			continue
+		}
+		entry, err := card.replaceProp(name, past[name], req.connId, req.userId)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			card.recordUndo(req.userId, entry.Rev)
+		}
+	}
+
+	if sub, exists := card.subscriptions[subKey(req.connId, req.subId)]; exists {
+		api.RestoreCardRsp{CardId: card.id, SubId: req.subId, FromRev: rev, Rev: card.Rev()}.Send(sub.sock)
+	}
+	return nil
+}
+
+// Replaces a prop's value with a new revision, returning its history entry, or nil if the value is unchanged.
+func (card *Card) replaceProp(name, value, connId, userId string) (*store.Change, error) {
+	cur := card.prop(name).String()
+	if cur == value {
+		return nil, nil
+	}
+	update := cardUpdate{userId: userId, rev: card.Rev(), change: api.Change{Prop: name, Ops: ot.Diff(cur, value)}}
+	entry, err := card.Recv(update.rev, update.change, connId, userId)
+	if err != nil {
+		return nil, err
+	}
+	card.broadcast(update, api.Change{Prop: entry.Prop, Ops: entry.Ops}, ot.Doc(cur))
+	return entry, nil
+}
+
+// Replays changes up to and including revision rev, returning the resulting props.
+func replay(changes []*store.Change, rev int) (map[string]string, error) {
+	if rev < 0 || rev > len(changes) {
+		return nil, fmt.Errorf("revision %d not in history", rev)
+	}
+
+	docs := make(map[string]*ot.Doc)
+	for _, change := range changes[:rev] {
+		doc, exists := docs[change.Prop]
+		if !exists {
+			doc = ot.NewDoc("")
+			docs[change.Prop] = doc
+		}
+		if err := doc.Apply(change.Ops); err != nil {
+			return nil, fmt.Errorf("failed to replay rev %d: %s", change.Rev, err)
+		}
+	}
+
+	props := make(map[string]string)
+	for name, doc := range docs {
+		props[name] = doc.String()
+	}
+	return props, nil
+}
+
+// Finds the last revision made at or before t.
+func revAt(changes []*store.Change, t time.Time) int {
+	rev := 0
+	for _, change := range changes {
+		if change.Time.After(t) {
+			break
+		}
+		rev = change.Rev
+	}
+	return rev
+}
@@ -0,0 +1,83 @@
+package card
+
+import (
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"testing"
+	"time"
+)
+
+func TestPropsAt(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	before := time.Now()
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	sock := newSock("a")
+	c, sub := subscribe(t, cardId, "joel", 1, sock)
+	defer c.Unsubscribe(sock.ID(), 1)
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "buy "}, {N: 4}}})
+	sock.next(t, api.MsgRevise)
+
+	rev, props, err := PropsAt(store.DefaultOrg, cardId, sub.Rev, time.Time{}, auth.Principals("joel", nil))
+	if err != nil || rev != sub.Rev || props["title"] != "milk" {
+		t.Errorf("expected milk at rev %d, got %v at rev %d, %v", sub.Rev, props, rev, err)
+	}
+	if _, _, err := PropsAt(store.DefaultOrg, cardId, sub.Rev, time.Time{}, auth.Principals("bob", nil)); err != ErrorForbidden {
+		t.Errorf("expected bob to be forbidden, got %v", err)
+	}
+	if _, _, err := PropsAt(store.DefaultOrg, cardId, sub.Rev+2, time.Time{}, nil); err == nil {
+		t.Error("expected a revision past the card's last to fail")
+	}
+
+	// Times select the last revision made by then.
+	if rev, props, err = PropsAt(store.DefaultOrg, cardId, 0, time.Now(), nil); err != nil || rev != sub.Rev+1 || props["title"] != "buy milk" {
+		t.Errorf("expected buy milk at rev %d, got %v at rev %d, %v", sub.Rev+1, props, rev, err)
+	}
+	if rev, props, err = PropsAt(store.DefaultOrg, cardId, 0, before, nil); err != nil || rev != 0 || len(props) != 0 {
+		t.Errorf("expected nothing before the card was created, got %v at rev %d, %v", props, rev, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	alice, bob := newSock("alice"), newSock("bob")
+	c, sub := subscribe(t, cardId, "joel", 1, alice)
+	defer c.Unsubscribe(alice.ID(), 1)
+	c.Revise(alice.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "buy "}, {N: 4}}})
+	alice.next(t, api.MsgRevise)
+	c.Revise(alice.ID(), "joel", 1, sub.Rev+1, api.Change{Prop: "note", Ops: ot.Ops{{S: "2%"}}})
+	alice.next(t, api.MsgRevise)
+	c.Share(alice.ID(), "joel", 1, "bob", auth.Viewer)
+	alice.next(t, api.MsgShareCard)
+
+	// Viewers can't restore.
+	subscribe(t, cardId, "bob", 1, bob)
+	defer c.Unsubscribe(bob.ID(), 1)
+	c.Restore(bob.ID(), "bob", 1, sub.Rev, time.Time{})
+	bob.nextError(t)
+
+	// Props are put back as they were, and those that didn't exist are emptied, but the card stays shared.
+	c.Restore(alice.ID(), "joel", 1, sub.Rev, time.Time{})
+	rsp := alice.next(t, api.MsgRestoreCard).RestoreCard
+	if rsp.FromRev != sub.Rev {
+		t.Errorf("expected rev %d restored, got %+v", sub.Rev, rsp)
+	}
+	_, props, err := PropsAt(store.DefaultOrg, cardId, rsp.Rev, time.Time{}, auth.Principals("bob", nil))
+	if err != nil || props["title"] != "milk" || props["note"] != "" {
+		t.Errorf("expected the card restored, got %v, %v", props, err)
+	}
+
+	// A restore is undone like any other change.
+	c.Undo(alice.ID(), "joel", 1)
+	alice.next(t, api.MsgUndo)
+	_, props, err = PropsAt(store.DefaultOrg, cardId, 0, time.Now(), nil)
+	if err != nil || props["title"] != "buy milk" {
+		t.Errorf("expected undo to put back the last change restored, got %v, %v", props, err)
+	}
+}
@@ -0,0 +1,188 @@
+package card
+
+import (
+	"fmt"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"log"
+	"sort"
+	"unicode/utf8"
+)
+
+type cursorReq struct {
+	connId string
+	subId  int
+	cursor *api.Cursor // nil to clear
+}
+
+// Publishes a subscription's cursor, or clears it if cursor is nil. The card's goroutine maps the cursor through
+// any revisions made since cursor.Rev, and relays it to the card's other subscribers.
+func (card *Card) SetCursor(connId string, subId int, cursor *api.Cursor) {
+	card.cursors <- cursorReq{connId: connId, subId: subId, cursor: cursor}
+}
+
+// Applies a cursor request. Cursors are kept in bytes against the current revision, and moved along with each
+// revision by moveCursors.
+func (card *Card) setCursor(req cursorReq) error {
+	sub, err := card.authorize(req.connId, req.subId, auth.Viewer)
+	if err != nil {
+		return err
+	}
+	if req.cursor == nil {
+		sub.cursor = nil
+		card.announce(sub, api.PresenceCursor)
+		return nil
+	}
+
+	cursor := *req.cursor
+	if _, exists := card.props[cursor.Prop]; !exists {
+		return fmt.Errorf("no such prop: %s", cursor.Prop)
+	}
+	if cursor.Start < 0 || cursor.End < cursor.Start {
+		return fmt.Errorf("invalid cursor range %d-%d", cursor.Start, cursor.End)
+	}
+	doc, err := card.propAt(cursor.Prop, cursor.Rev)
+	if err != nil {
+		return err
+	}
+	if cursor.Start, err = toBytes(doc, cursor.Start, sub.units); err != nil {
+		return err
+	}
+	if cursor.End, err = toBytes(doc, cursor.End, sub.units); err != nil {
+		return err
+	}
+	for _, change := range card.history[cursor.Rev:] {
+		if change.Prop == cursor.Prop {
+			if err = moveCursor(&cursor, change.Ops); err != nil {
+				return err
+			}
+		}
+	}
+	cursor.Rev = card.Rev()
+	sub.cursor = &cursor
+	card.announce(sub, api.PresenceCursor)
+	return nil
+}
+
+// Moves the cursors in a prop along with a change to it, counted in bytes. Subscribers are expected to do the same
+// with the revisions they receive, so nothing is sent.
+func (card *Card) moveCursors(prop string, ops ot.Ops) {
+	for _, sub := range card.subscriptions {
+		if sub.cursor == nil || sub.cursor.Prop != prop {
+			continue
+		}
+		if err := moveCursor(sub.cursor, ops); err != nil {
+			log.Printf("error moving cursor on card %s: %s", card.id, err)
+			sub.cursor = nil
+		}
+	}
+}
+
+// Maps a cursor, counted in bytes, through ops applied to its prop. Text inserted at either end of a selection is
+// kept out of it, while a plain cursor moves past text inserted at it.
+func moveCursor(cursor *api.Cursor, ops ot.Ops) error {
+	r, err := ot.TransformRange(ot.Range{Start: cursor.Start, End: cursor.End}, ops, ot.After, ot.Before)
+	if err != nil {
+		return err
+	}
+	cursor.Start, cursor.End = r.Start, r.End
+	return nil
+}
+
+// Tells the card's other subscribers about an event concerning sub, giving each its cursor in their own units.
+func (card *Card) announce(sub *subscription, event string) {
+	socks := make(map[sockjs.Session][]int)
+	units := make(map[sockjs.Session]ot.Unit)
+	for _, s := range card.subscriptions {
+		if s == sub || s.revoked {
+			continue
+		}
+		socks[s.sock] = append(socks[s.sock], s.subId)
+		units[s.sock] = s.units
+	}
+	for sock, subIds := range socks {
+		presence := api.Presence{ConnId: sub.connId, SubId: sub.subId, UserId: sub.userId}
+		if event != api.PresenceLeave {
+			presence.Cursor = card.cursorIn(sub.cursor, units[sock])
+		}
+		api.PresenceRsp{CardId: card.id, SubIds: subIds, Event: event, Presence: presence}.Send(sock)
+	}
+}
+
+// Lists the card's subscribers other than sub, with their cursors in sub's units.
+func (card *Card) presence(sub *subscription) []api.Presence {
+	var present []api.Presence
+	for _, s := range card.subscriptions {
+		if s == sub || s.revoked {
+			continue
+		}
+		present = append(present, api.Presence{
+			ConnId: s.connId,
+			SubId:  s.subId,
+			UserId: s.userId,
+			Cursor: card.cursorIn(s.cursor, sub.units),
+		})
+	}
+	sort.Slice(present, func(i, j int) bool {
+		if present[i].ConnId != present[j].ConnId {
+			return present[i].ConnId < present[j].ConnId
+		}
+		return present[i].SubId < present[j].SubId
+	})
+	return present
+}
+
+// Converts a stored cursor to the given units, against the current revision.
+func (card *Card) cursorIn(cursor *api.Cursor, units ot.Unit) *api.Cursor {
+	if cursor == nil {
+		return nil
+	}
+	start, end, err := rangeFromBytes(*card.prop(cursor.Prop), cursor.Start, cursor.End, units)
+	if err != nil {
+		log.Printf("error converting cursor on card %s: %s", card.id, err)
+		return nil
+	}
+	return &api.Cursor{Prop: cursor.Prop, Rev: card.Rev(), Start: start, End: end}
+}
+
+// Converts an offset into doc, counted in units, to bytes.
+func toBytes(doc ot.Doc, i int, units ot.Unit) (int, error) {
+	if i > 0 {
+		ops, err := doc.ToBytes(ot.Ops{{N: i}}, units)
+		if err != nil {
+			return 0, err
+		}
+		i = ops[0].N
+	}
+	if i > len(doc) {
+		return 0, fmt.Errorf("offset %d past end of document", i)
+	}
+	if i < len(doc) && !utf8.RuneStart(doc[i]) {
+		return 0, fmt.Errorf("offset %d splits a character", i)
+	}
+	return i, nil
+}
+
+// Converts a range of doc, counted in bytes, to units.
+func rangeFromBytes(doc ot.Doc, start, end int, units ot.Unit) (int, int, error) {
+	start, err := fromBytes(doc, start, units)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = fromBytes(doc, end, units)
+	return start, end, err
+}
+
+// Converts an offset into doc, counted in bytes, to units.
+func fromBytes(doc ot.Doc, i int, units ot.Unit) (int, error) {
+	if i == 0 {
+		return 0, nil
+	}
+	ops, err := doc.FromBytes(ot.Ops{{N: i}}, units)
+	if err != nil {
+		return 0, err
+	}
+	return ops[0].N, nil
+}
@@ -0,0 +1,46 @@
+package card
+
+import (
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "héllo world"})
+	alice, bob := newSock("alice"), newSock("bob")
+	c, sub := subscribe(t, cardId, "joel", 1, alice)
+	defer c.Unsubscribe(alice.ID(), 1)
+	if len(sub.Present) != 0 {
+		t.Errorf("expected nobody else present, got %+v", sub.Present)
+	}
+
+	// Each side learns of the other.
+	_, bobSub := subscribeAs(t, cardId, "joel", auth.Principals("joel", nil), ot.Runes, 2, bob)
+	if p := bobSub.Present; len(p) != 1 || p[0].ConnId != alice.ID() || p[0].SubId != 1 || p[0].UserId != "joel" {
+		t.Errorf("expected alice to be present, got %+v", p)
+	}
+	if rsp := alice.next(t, api.MsgPresence).Presence; rsp.Event != api.PresenceJoin || rsp.Presence.ConnId != bob.ID() || rsp.Presence.SubId != 2 {
+		t.Errorf("expected bob to join, got %+v", rsp)
+	}
+
+	// A cursor set against a stale revision is moved through later ones, and relayed in the receiver's units.
+	c.Revise(bob.ID(), "joel", 2, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "Oh "}, {N: 11}}})
+	bob.next(t, api.MsgRevise)
+	c.SetCursor(alice.ID(), 1, &api.Cursor{Prop: "title", Rev: sub.Rev, Start: 7, End: 12})
+	rsp := bob.next(t, api.MsgPresence).Presence
+	if cur := rsp.Presence.Cursor; rsp.Event != api.PresenceCursor || cur == nil || cur.Rev != sub.Rev+1 || cur.Start != 9 || cur.End != 14 {
+		t.Errorf("unexpected cursor event %+v, cursor %+v", rsp, cur)
+	}
+	c.SetCursor(alice.ID(), 1, &api.Cursor{Prop: "title", Rev: sub.Rev, Start: 2, End: 2})
+	alice.nextError(t)
+
+	c.Unsubscribe(bob.ID(), 2)
+	if rsp := alice.next(t, api.MsgPresence).Presence; rsp.Event != api.PresenceLeave || rsp.Presence.ConnId != bob.ID() {
+		t.Errorf("expected bob to leave, got %+v", rsp)
+	}
+}
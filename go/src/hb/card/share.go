@@ -0,0 +1,85 @@
+package card
+
+import (
+	"fmt"
+	"hb/api"
+	"hb/auth"
+	"sort"
+)
+
+type shareReq struct {
+	connId    string
+	userId    string
+	subId     int
+	principal string
+	role      auth.Role // NoRole to unshare
+}
+
+// Shares the card with a principal, granting it a role, as requested by the given subscription. Only the card's
+// owner can share it. Its goroutine will broadcast the resulting ACL changes to all subscribers.
+func (card *Card) Share(connId, userId string, subId int, principal string, role auth.Role) {
+	card.shares <- shareReq{connId: connId, userId: userId, subId: subId, principal: principal, role: role}
+}
+
+// Revokes whatever role a principal was granted, as requested by the given subscription.
+func (card *Card) Unshare(connId, userId string, subId int, principal string) {
+	card.shares <- shareReq{connId: connId, userId: userId, subId: subId, principal: principal}
+}
+
+// Applies a share or unshare request, then revokes subscribers who can no longer view the card.
+func (card *Card) share(req shareReq) error {
+	// Cards from before ACLs are open to everyone, so any of their editors can claim them by sharing them.
+	acl, need := card.acl(), auth.Owner
+	if acl.Owner == "" {
+		acl.Owner, need = req.userId, auth.Editor
+	}
+	sub, err := card.authorize(req.connId, req.subId, need)
+	if err != nil {
+		return err
+	}
+	if req.role == auth.NoRole {
+		acl.Unshare(req.principal)
+	} else if err = acl.Share(req.principal, req.role); err != nil {
+		return err
+	}
+
+	props := acl.Props()
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err = card.replaceProp(name, props[name], req.connId, req.userId); err != nil {
+			// Some props may have been written, so go by the ACL the card was left with.
+			card.revokeViewers()
+			return err
+		}
+	}
+	card.revokeViewers()
+
+	if req.role == auth.NoRole {
+		api.UnshareCardRsp{CardId: card.id, SubId: req.subId, Principal: req.principal, Rev: card.Rev()}.Send(sub.sock)
+	} else {
+		api.ShareCardRsp{
+			CardId:    card.id,
+			SubId:     req.subId,
+			Principal: req.principal,
+			Role:      req.role.String(),
+			Rev:       card.Rev(),
+		}.Send(sub.sock)
+	}
+	return nil
+}
+
+// Revokes subscribers whom the card's ACL no longer lets view it.
+func (card *Card) revokeViewers() {
+	acl := card.acl()
+	for _, s := range card.subscriptions {
+		if !s.revoked && acl.RoleOf(s.principals) < auth.Viewer {
+			s.revoked = true
+			api.ErrorRsp{Msg: fmt.Sprintf("access to card %s revoked", card.id)}.Send(s.sock)
+			card.announce(s, api.PresenceLeave)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package card
+
+import (
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"testing"
+)
+
+func TestShare(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "sharetest"})
+	alice, bob := newSock("alice"), newSock("bob")
+	c, sub := subscribe(t, cardId, "joel", 1, alice)
+	defer c.Unsubscribe(alice.ID(), 1)
+	if sub.Props[auth.OwnerProp] != "joel" {
+		t.Errorf("expected joel to own the card, got %v", sub.Props)
+	}
+	c.Revise(alice.ID(), "joel", 1, sub.Rev, api.Change{Prop: auth.OwnerProp, Ops: ot.Ops{{S: "bob"}, {N: 4}}})
+	alice.nextError(t)
+
+	// Until it's shared, bob can't see the card.
+	principals := auth.Principals("bob", map[string]string{auth.GroupsProp: `["eng"]`})
+	if _, _, err := Subscribe(store.DefaultOrg, cardId, bob.ID(), "bob", 1, ot.Bytes, principals, bob); err != ErrorForbidden {
+		t.Errorf("expected bob's subscribe to be forbidden, got %v", err)
+	}
+
+	// Sharing with bob's group lets him view it, but not edit it.
+	c.Share(alice.ID(), "joel", 1, auth.GroupPrefix+"eng", auth.Viewer)
+	if rsp := alice.next(t, api.MsgRevise).Revise; rsp.Change.Prop != auth.ViewersProp {
+		t.Errorf("expected a change to viewers, got %+v", rsp)
+	}
+	_, sub = subscribeAs(t, cardId, "bob", principals, ot.Bytes, 1, bob)
+	defer c.Unsubscribe(bob.ID(), 1)
+	c.Revise(bob.ID(), "bob", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{N: 9}, {S: "!"}}})
+	bob.nextError(t)
+	c.Share(bob.ID(), "bob", 1, "bob", auth.Editor)
+	bob.nextError(t)
+
+	// Unsharing revokes bob's subscription.
+	c.Unshare(alice.ID(), "joel", 1, auth.GroupPrefix+"eng")
+	bob.nextError(t)
+	c.Revise(bob.ID(), "bob", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{N: 9}, {S: "!"}}})
+	bob.nextError(t)
+	alice.next(t, api.MsgUnshareCard)
+}
@@ -0,0 +1,118 @@
+package card
+
+import (
+	"fmt"
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+)
+
+// The most revisions kept on each user's undo stack.
+const maxUndo = 100
+
+// A user's undo and redo stacks for a card, as revisions. They're kept in memory only: when a card is loaded,
+// each user's undo stack is rebuilt from their most recent changes in its history, and their redo stack starts
+// out empty.
+type undoState struct {
+	undo []int // revisions that can be undone, most recent last
+	redo []int // undo revisions that can be redone, most recent last
+}
+
+type undoReq struct {
+	connId string
+	userId string
+	subId  int
+	redo   bool
+}
+
+// Undoes the user's last change to the card, as requested by the given subscription. Its goroutine will broadcast
+// the resulting change to all subscribers.
+func (card *Card) Undo(connId, userId string, subId int) {
+	card.undos <- undoReq{connId: connId, userId: userId, subId: subId}
+}
+
+// Redoes the user's last undo, as requested by the given subscription.
+func (card *Card) Redo(connId, userId string, subId int) {
+	card.undos <- undoReq{connId: connId, userId: userId, subId: subId, redo: true}
+}
+
+// Gets a user's undo state, building it from the card's history the first time the user's seen.
+func (card *Card) userUndos(userId string) *undoState {
+	state, exists := card.undoStates[userId]
+	if !exists {
+		state = &undoState{}
+		for _, change := range card.history {
+			// Changes to reserved props, such as sharing, can't be undone.
+			if change.UserId == userId && !reserved(change.Prop) {
+				state.undo = append(state.undo, change.Rev)
+			}
+		}
+		state.undo = trimUndo(state.undo)
+		card.undoStates[userId] = state
+	}
+	return state
+}
+
+// Records a change made by a user, which can then be undone. The user's undos can no longer be redone.
+func (card *Card) recordUndo(userId string, rev int) {
+	if userId == "" {
+		return
+	}
+	state := card.userUndos(userId)
+	if n := len(state.undo); n == 0 || state.undo[n-1] != rev {
+		state.undo = trimUndo(append(state.undo, rev))
+	}
+	state.redo = nil
+}
+
+func trimUndo(revs []int) []int {
+	if len(revs) > maxUndo {
+		return append([]int(nil), revs[len(revs)-maxUndo:]...)
+	}
+	return revs
+}
+
+// Applies an undo or redo request, inverting the revision on top of the user's undo (or redo) stack.
+func (card *Card) undo(req undoReq) error {
+	if _, err := card.authorize(req.connId, req.subId, auth.Editor); err != nil {
+		return err
+	}
+	state := card.userUndos(req.userId)
+	from, to, what := &state.undo, &state.redo, "undo"
+	if req.redo {
+		from, to, what = &state.redo, &state.undo, "redo"
+	}
+	if len(*from) == 0 {
+		return fmt.Errorf("nothing to %s", what)
+	}
+	rev := (*from)[len(*from)-1]
+
+	// Invert the change against the prop as it was just before, then let Recv transform it over everything since.
+	change := card.history[rev-1]
+	base, err := card.propAt(change.Prop, rev-1)
+	if err != nil {
+		return err
+	}
+	inv, err := ot.Invert(change.Ops, base)
+	if err != nil {
+		return err
+	}
+	update := cardUpdate{userId: req.userId, rev: card.Rev(), change: api.Change{Prop: change.Prop, Ops: inv}}
+	prev := append(ot.Doc(nil), *card.prop(change.Prop)...)
+	entry, err := card.Recv(rev, update.change, req.connId, req.userId)
+	if err != nil {
+		return err
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, entry.Rev)
+	card.broadcast(update, api.Change{Prop: entry.Prop, Ops: entry.Ops}, prev)
+
+	if sub, exists := card.subscriptions[subKey(req.connId, req.subId)]; exists {
+		if req.redo {
+			api.RedoRsp{CardId: card.id, SubId: req.subId, RedoneRev: rev, Rev: entry.Rev}.Send(sub.sock)
+		} else {
+			api.UndoRsp{CardId: card.id, SubId: req.subId, UndoneRev: rev, Rev: entry.Rev}.Send(sub.sock)
+		}
+	}
+	return nil
+}
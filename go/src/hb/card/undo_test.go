@@ -0,0 +1,84 @@
+package card
+
+import (
+	"hb/api"
+	"hb/auth"
+	"hb/ot"
+	"hb/store"
+	"testing"
+	"time"
+)
+
+func TestUndo(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	alice, bob := newSock("alice"), newSock("bob")
+	c, _ := subscribe(t, cardId, "joel", 1, alice)
+	defer c.Unsubscribe(alice.ID(), 1)
+	c.Share(alice.ID(), "joel", 1, "bob", auth.Editor)
+	alice.next(t, api.MsgShareCard)
+
+	// Track the title as bob sees it.
+	_, sub := subscribe(t, cardId, "bob", 1, bob)
+	defer c.Unsubscribe(bob.ID(), 1)
+	title := ot.NewDoc(sub.Props["title"])
+	expect := func(what, expected string) {
+		t.Helper()
+		rsp := bob.next(t, api.MsgRevise).Revise
+		if err := title.Apply(rsp.Change.Ops); err != nil {
+			t.Fatalf("%s: %s", what, err)
+		}
+		if title.String() != expected {
+			t.Errorf("%s: expected %q got %q", what, expected, title.String())
+		}
+	}
+
+	c.Revise(alice.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "buy "}, {N: 4}}})
+	expect("alice's edit", "buy milk")
+	c.Revise(bob.ID(), "bob", 1, sub.Rev+1, api.Change{Prop: "title", Ops: ot.Ops{{N: 8}, {S: "!"}}})
+	expect("bob's edit", "buy milk!")
+
+	// Alice's undo leaves bob's later change alone.
+	c.Undo(alice.ID(), "joel", 1)
+	expect("undo", "milk!")
+	c.Redo(alice.ID(), "joel", 1)
+	expect("redo", "buy milk!")
+	c.Undo(alice.ID(), "joel", 1)
+	expect("undo", "milk!")
+
+	// Undoing her creation empties the title, after which there's nothing left to undo: sharing can't be undone.
+	c.Undo(alice.ID(), "joel", 1)
+	expect("undo creation", "!")
+	c.Undo(alice.ID(), "joel", 1)
+	alice.nextError(t)
+}
+
+// Undo stacks are rebuilt from the card's history when it's loaded again.
+func TestUndoAfterReload(t *testing.T) {
+	_, cleanup := startCards(t)
+	defer cleanup()
+
+	cardId := createCard(t, "joel", map[string]string{"title": "milk"})
+	sock := newSock("a")
+	c, sub := subscribe(t, cardId, "joel", 1, sock)
+	c.Revise(sock.ID(), "joel", 1, sub.Rev, api.Change{Prop: "title", Ops: ot.Ops{{S: "buy "}, {N: 4}}})
+	sock.next(t, api.MsgRevise)
+	c.Unsubscribe(sock.ID(), 1)
+	<-c.stopped
+
+	c, sub = subscribe(t, cardId, "joel", 1, sock)
+	defer c.Unsubscribe(sock.ID(), 1)
+	if sub.Props["title"] != "buy milk" {
+		t.Fatalf("expected the edit to be saved, got %v", sub.Props)
+	}
+	c.Undo(sock.ID(), "joel", 1)
+	title := ot.NewDoc(sub.Props["title"])
+	if err := title.Apply(sock.next(t, api.MsgRevise).Revise.Change.Ops); err != nil || title.String() != "milk" {
+		t.Errorf("expected undo to restore milk, got %q, %v", title.String(), err)
+	}
+	if _, props, err := PropsAt(store.DefaultOrg, cardId, sub.Rev, time.Time{}, nil); err != nil || props["title"] != "buy milk" {
+		t.Errorf("expected the undone edit to stay in history, got %v, %v", props, err)
+	}
+}
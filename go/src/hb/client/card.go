@@ -0,0 +1,158 @@
+package client
+
+import (
+	"errors"
+	. "hb/api"
+	"hb/ot"
+	"sync"
+)
+
+// Card is a subscribed card kept in sync with the server, the way the TypeScript Card keeps it. Edits apply to it
+// at once, and are sent to the server one revision at a time per prop, rebased over revisions made by others as
+// they arrive, using ot.MultiClient. Ops count bytes.
+type Card struct {
+	Sub *CardSubscription
+
+	lock       sync.Mutex
+	client     *ot.MultiClient // nil until the card's state arrives
+	err        error           // the first error syncing the card
+	subscribed chan struct{}   // closed once the card's state first arrives
+	onChange   func(prop string, ops ot.Ops)
+}
+
+var ErrorNotBytes = errors.New("cards can only be opened on connections whose ops count bytes")
+
+// Subscribes to a card and keeps it in sync. onChange, if not nil, receives revisions made by others, with their
+// ops transformed to apply to the card as it is here. It's called on the connection's read goroutine, and mustn't
+// call the card's methods.
+// The connection's ops must count bytes. See CardSubscription for the other things that can be done with the card.
+func (conn *Connection) OpenCard(cardId string, onChange func(prop string, ops ot.Ops)) (*Card, error) {
+	if conn.Units() != ot.Bytes {
+		return nil, ErrorNotBytes
+	}
+	card := &Card{subscribed: make(chan struct{}), onChange: onChange}
+	var err error
+	card.Sub, err = conn.SubscribeCard(cardId, card.handleSubscribe, card.handleRevision, card.handleAck)
+	return card, err
+}
+
+// Waits for the card's state to arrive from the server, returning an error if the connection closes first.
+func (card *Card) Wait() error {
+	card.Sub.conn.lock.Lock()
+	done := card.Sub.conn.done
+	card.Sub.conn.lock.Unlock()
+	select {
+	case <-card.subscribed:
+		return nil
+	case <-done:
+		return ErrorClosed
+	}
+}
+
+// Applies ops, counted in bytes, to one of the card's props, and sends them to the server once it's acknowledged
+// the prop's previous edit. Returns an error if the card's state hasn't arrived yet, if the ops don't apply, or if
+// syncing the card has failed.
+func (card *Card) Edit(prop string, ops ot.Ops) error {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	if card.err != nil {
+		return card.err
+	}
+	if card.client == nil {
+		return errors.New("card not subscribed yet")
+	}
+	if err := card.client.Apply(prop, ops); err != nil {
+		return err
+	}
+	return card.err
+}
+
+// Gets the card's props, with any edits not yet acknowledged by the server.
+func (card *Card) Props() map[string]string {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	props := make(map[string]string)
+	if card.client != nil {
+		for name, doc := range card.client.Docs {
+			props[name] = doc.String()
+		}
+	}
+	return props
+}
+
+// Gets the last revision of the card known to have been made on the server.
+func (card *Card) Rev() int {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	if card.client == nil {
+		return 0
+	}
+	return card.client.Rev
+}
+
+// Reports whether all edits have been acknowledged by the server.
+func (card *Card) Synced() bool {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	return card.client != nil && len(card.client.Wait) == 0
+}
+
+// Starts over from the card's state on the server. This happens on reconnecting, too, when any edits that weren't
+// acknowledged are dropped.
+func (card *Card) handleSubscribe(rsp *SubscribeCardRsp) {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	first := card.client == nil
+	card.client = ot.NewMultiClient(rsp.Rev, rsp.Props, card.send)
+	card.err = nil
+	if first {
+		close(card.subscribed)
+	}
+}
+
+func (card *Card) handleRevision(rsp *ReviseRsp) {
+	card.lock.Lock()
+	if card.client == nil || card.err != nil {
+		card.lock.Unlock()
+		return
+	}
+	ops := rsp.Change.Ops
+	var err error
+	if wait := card.client.Wait[rsp.Change.Prop]; len(ops) > 0 && len(wait) > 0 {
+		// MultiClient.Recv transforms the pending ops too; the caller wants the ops as they apply here.
+		if ops, _, err = ot.Transform(ops, wait); err == nil {
+			if buf := card.client.Buf[rsp.Change.Prop]; len(ops) > 0 && len(buf) > 0 {
+				ops, _, err = ot.Transform(ops, buf)
+			}
+		}
+	}
+	if err == nil {
+		err = card.client.Recv(rsp.Change.Prop, rsp.Change.Ops)
+	}
+	if err != nil {
+		card.err = err
+	}
+	onChange := card.onChange
+	card.lock.Unlock()
+	if err == nil && onChange != nil {
+		onChange(rsp.Change.Prop, ops)
+	}
+}
+
+func (card *Card) handleAck(rsp *ReviseRsp) {
+	card.lock.Lock()
+	defer card.lock.Unlock()
+	if card.client == nil || card.err != nil {
+		return
+	}
+	if err := card.client.Ack(rsp.Change.Prop); err != nil {
+		card.err = err
+	}
+}
+
+// Sends a prop's pending ops. Called by the MultiClient, with card.lock held.
+func (card *Card) send(rev int, prop string, ops ot.Ops) {
+	if err := card.Sub.Revise(rev, Change{Prop: prop, Ops: ops}); err != nil && card.err == nil {
+		card.err = err
+	}
+}
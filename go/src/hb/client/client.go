@@ -0,0 +1,766 @@
+// Package client speaks the hb sockjs protocol from Go, for scripting card automation and load tests.
+//
+// It mirrors the TypeScript Connection in ts/connection.ts: requests and responses are the api structs, and
+// responses are delivered to callbacks. Callbacks run on the connection's read goroutine, one at a time, so they
+// must not block on further responses.
+//
+// SubscribeCard and CardSubscription.Revise are the raw protocol: revisions must be made against the card's latest
+// revision, and rebased over others' by the caller. OpenCard does that rebasing, as the TypeScript Card does.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	. "hb/api"
+	"hb/ot"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorClosed = errors.New("connection closed")
+
+type Connection struct {
+	origin string
+	ws     *websocket.Conn
+	orgId  string
+	connId string
+	userId string
+	units  ot.Unit
+
+	lock        sync.Mutex // guards everything below, and writes to ws
+	closed      bool
+	done        chan struct{} // closed when the read loop exits
+	token       string
+	expires     time.Time
+	onLogout    chan struct{}
+	cardSubs    map[int]*CardSubscription
+	searchSubs  map[int]*SearchSubscription
+	searchPages map[int]*SearchResultsRsp // subId -> the page of results last received
+	onCreates   map[int]func(*CreateCardRsp)
+	onError     func(msg string)
+	onClose     func(err error)
+	curSubId    int
+	curCreateId int
+}
+
+type CardSubscription struct {
+	conn   *Connection
+	CardId string
+	SubId  int
+
+	onSubscribe func(*SubscribeCardRsp)
+	onRevision  func(*ReviseRsp)
+	onAck       func(*ReviseRsp)
+	onPresence  func(*PresenceRsp) // guarded by conn.lock
+	onComment   func(*CommentRsp)  // guarded by conn.lock
+}
+
+type SearchSubscription struct {
+	conn  *Connection
+	Query string
+	SubId int
+
+	onSearchResults func(*SearchResultsRsp)
+}
+
+// Dials an hb server and logs in. origin is the server's base url, e.g. "http://localhost:8080".
+// Ops sent and received count bytes.
+func Dial(origin, userId, password string) (*Connection, error) {
+	return DialUnits(origin, userId, password, ot.Bytes)
+}
+
+// Like Dial, but ops sent and received count the given units.
+func DialUnits(origin, userId, password string, units ot.Unit) (*Connection, error) {
+	return DialOrg(origin, "", userId, password, units)
+}
+
+// Like DialUnits, but logs in to the given org rather than the server's default one.
+func DialOrg(origin, orgId, userId, password string, units ot.Unit) (*Connection, error) {
+	ws, err := dial(origin)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConnection(origin, ws)
+	conn.userId = userId
+	conn.units = units
+	if err := conn.login(orgId, userId, password); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	go conn.run()
+	return conn, nil
+}
+
+// Dials an hb server and resumes a login by its session token, e.g. one saved from another process's Token().
+// The connection starts with no subscriptions of its own: any the login had are re-established on the server, but
+// have no callbacks here.
+func Resume(origin, token string) (*Connection, error) {
+	ws, err := dial(origin)
+	if err != nil {
+		return nil, err
+	}
+	conn := newConnection(origin, ws)
+	if _, err := conn.resume(token); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	go conn.run()
+	return conn, nil
+}
+
+func newConnection(origin string, ws *websocket.Conn) *Connection {
+	return &Connection{
+		origin:      origin,
+		ws:          ws,
+		done:        make(chan struct{}),
+		cardSubs:    make(map[int]*CardSubscription),
+		searchSubs:  make(map[int]*SearchSubscription),
+		searchPages: make(map[int]*SearchResultsRsp),
+		onCreates:   make(map[int]func(*CreateCardRsp)),
+	}
+}
+
+func dial(origin string) (*websocket.Conn, error) {
+	sockUrl, err := socketUrl(origin)
+	if err != nil {
+		return nil, err
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(sockUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %s", sockUrl, err)
+	}
+	return ws, nil
+}
+
+// Builds the url of the raw websocket transport: /sock/<server>/<session>/websocket.
+func socketUrl(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", fmt.Errorf("bad origin %s: %s", origin, err)
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("bad origin %s: unsupported scheme", origin)
+	}
+	u.Path = fmt.Sprintf("%s/sock/%03d/%s/websocket", strings.TrimSuffix(u.Path, "/"), rand.Intn(1000), randomId())
+	return u.String(), nil
+}
+
+func randomId() string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	buf := make([]byte, 8)
+	for i := range buf {
+		buf[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(buf)
+}
+
+// Logs in synchronously, before the read loop starts.
+func (conn *Connection) login(orgId, userId, password string) error {
+	login := &LoginReq{OrgId: orgId, UserId: userId, Password: password, Units: conn.units.String()}
+	rsp, err := conn.handshake(&Req{Type: MsgLogin, Login: login})
+	if err != nil {
+		return err
+	}
+	conn.orgId = rsp.Login.OrgId
+	conn.connId = rsp.Login.ConnId
+	conn.token = rsp.Login.Token
+	conn.expires = rsp.Login.Expires
+	return nil
+}
+
+// Resumes a login synchronously, before the read loop starts.
+func (conn *Connection) resume(token string) (*ResumeRsp, error) {
+	rsp, err := conn.handshake(&Req{Type: MsgResume, Resume: &ResumeReq{Token: token}})
+	if err != nil {
+		return nil, err
+	}
+	units, err := ot.ParseUnit(rsp.Resume.Units)
+	if err != nil {
+		return nil, err
+	}
+	conn.lock.Lock()
+	conn.orgId = rsp.Resume.OrgId
+	conn.connId = rsp.Resume.ConnId
+	conn.userId = rsp.Resume.UserId
+	conn.units = units
+	conn.token = rsp.Resume.Token
+	conn.expires = rsp.Resume.Expires
+	conn.lock.Unlock()
+	return rsp.Resume, nil
+}
+
+// Sends a request and waits for its response of the same type, or an error.
+func (conn *Connection) handshake(req *Req) (*Rsp, error) {
+	if err := conn.send(req); err != nil {
+		return nil, err
+	}
+	for {
+		rsps, err := conn.recv()
+		if err != nil {
+			return nil, err
+		}
+		for _, rsp := range rsps {
+			switch rsp.Type {
+			case req.Type:
+				return rsp, nil
+			case MsgError:
+				return nil, errors.New(rsp.Error.Msg)
+			}
+		}
+	}
+}
+
+// Reconnects after the connection has closed, e.g. when the socket dropped, by resuming its login. The server
+// re-subscribes to the connection's cards and searches: each card subscription's onSubscribe is called again with
+// the card's current state, and search results follow as usual. Changes sent but not yet acked may have been lost,
+// so callers should resend them against the new state.
+func (conn *Connection) Reconnect() error {
+	conn.lock.Lock()
+	closed, token := conn.closed, conn.token
+	conn.lock.Unlock()
+	if !closed {
+		return errors.New("connection still open")
+	}
+	if token == "" {
+		return errors.New("not logged in")
+	}
+	<-conn.done
+
+	ws, err := dial(conn.origin)
+	if err != nil {
+		return err
+	}
+	conn.lock.Lock()
+	conn.ws = ws
+	conn.closed = false
+	conn.done = make(chan struct{})
+	conn.lock.Unlock()
+
+	if _, err := conn.resume(token); err != nil {
+		conn.lock.Lock()
+		conn.closed = true
+		close(conn.done)
+		conn.lock.Unlock()
+		ws.Close()
+		return err
+	}
+	go conn.run()
+	return nil
+}
+
+// Ends this connection's login, revoking its session token, and waits for the server to confirm. The connection
+// stays open, but can no longer be used or reconnected.
+func (conn *Connection) Logout() error {
+	conn.lock.Lock()
+	onLogout, done := make(chan struct{}), conn.done
+	conn.onLogout = onLogout
+	conn.lock.Unlock()
+
+	if err := conn.send(&Req{Type: MsgLogout, Logout: &LogoutReq{}}); err != nil {
+		return err
+	}
+	select {
+	case <-onLogout:
+		return nil
+	case <-done:
+		return ErrorClosed
+	}
+}
+
+// The session token of this connection's login, which Resume accepts until it expires or is revoked.
+func (conn *Connection) Token() string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.token
+}
+
+// When the session token expires.
+func (conn *Connection) Expires() time.Time {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.expires
+}
+
+// The connection id assigned by the server. Revisions sent by this connection carry it as OrigConnId.
+func (conn *Connection) ConnId() string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.connId
+}
+
+// The org this connection is logged in to.
+func (conn *Connection) OrgId() string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.orgId
+}
+
+func (conn *Connection) UserId() string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.userId
+}
+
+// What Op.N counts in this connection's ops.
+func (conn *Connection) Units() ot.Unit {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.units
+}
+
+// Sets a function to receive the message of each ErrorRsp received.
+func (conn *Connection) OnError(onError func(msg string)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.onError = onError
+}
+
+// Sets a function to be called once when the connection closes, with the reason if it wasn't closed by Close().
+func (conn *Connection) OnClose(onClose func(err error)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.onClose = onClose
+}
+
+// Closes the connection. The function set with OnClose is called with a nil error.
+func (conn *Connection) Close() error {
+	conn.lock.Lock()
+	conn.closed = true
+	ws := conn.ws
+	conn.lock.Unlock()
+	return ws.Close()
+}
+
+// Subscribes to a card. onSubscribe receives the card's current state, onRevision receives revisions made by
+// others, and onAck receives this subscription's own revisions once they're accepted. Any of them may be nil.
+func (conn *Connection) SubscribeCard(cardId string, onSubscribe func(*SubscribeCardRsp), onRevision, onAck func(*ReviseRsp)) (*CardSubscription, error) {
+	conn.lock.Lock()
+	conn.curSubId++
+	sub := &CardSubscription{
+		conn:        conn,
+		CardId:      cardId,
+		SubId:       conn.curSubId,
+		onSubscribe: onSubscribe,
+		onRevision:  onRevision,
+		onAck:       onAck,
+	}
+	conn.cardSubs[sub.SubId] = sub
+	conn.lock.Unlock()
+
+	return sub, conn.send(&Req{
+		Type:          MsgSubscribeCard,
+		SubscribeCard: &SubscribeCardReq{CardId: cardId, SubId: sub.SubId},
+	})
+}
+
+// Sends a change to one of the card's properties, made against revision rev.
+func (sub *CardSubscription) Revise(rev int, change Change) error {
+	return sub.conn.send(&Req{
+		Type: MsgRevise,
+		Revise: &ReviseReq{
+			SubId:  sub.SubId,
+			CardId: sub.CardId,
+			Rev:    rev,
+			Change: change,
+		},
+	})
+}
+
+// Undoes this user's last change to the card. The undo arrives as a revision from the server, via onRevision.
+func (sub *CardSubscription) Undo() error {
+	return sub.conn.send(&Req{Type: MsgUndo, Undo: &UndoReq{SubId: sub.SubId}})
+}
+
+// Redoes this user's last undo. The redo arrives as a revision from the server, via onRevision.
+func (sub *CardSubscription) Redo() error {
+	return sub.conn.send(&Req{Type: MsgRedo, Redo: &RedoReq{SubId: sub.SubId}})
+}
+
+// Shares the card, which this user must own, with a principal: a user id, or "group:<name>". role is "viewer" or
+// "editor". The change to the card's ACL arrives as a revision from the server, via onRevision.
+func (sub *CardSubscription) Share(principal, role string) error {
+	return sub.conn.send(&Req{Type: MsgShareCard, ShareCard: &ShareCardReq{SubId: sub.SubId, Principal: principal, Role: role}})
+}
+
+// Revokes whatever role a principal was granted on the card.
+func (sub *CardSubscription) Unshare(principal string) error {
+	return sub.conn.send(&Req{Type: MsgUnshareCard, UnshareCard: &UnshareCardReq{SubId: sub.SubId, Principal: principal}})
+}
+
+// Sets a function to receive the card's other subscribers' presence events: joins, leaves and cursor moves.
+// Those already present when subscribing are listed in the SubscribeCardRsp.
+func (sub *CardSubscription) OnPresence(onPresence func(*PresenceRsp)) {
+	sub.conn.lock.Lock()
+	defer sub.conn.lock.Unlock()
+	sub.onPresence = onPresence
+}
+
+// Publishes this subscription's cursor or selection, counted in the connection's units against cursor.Rev, or
+// clears it if cursor is nil.
+func (sub *CardSubscription) SetCursor(cursor *Cursor) error {
+	return sub.conn.send(&Req{Type: MsgCursor, Cursor: &CursorReq{SubId: sub.SubId, Cursor: cursor}})
+}
+
+// Comments on the card's text, from start to end of prop, counted in the connection's units against revision rev.
+// The comment's id arrives via the function set with OnComment.
+func (sub *CardSubscription) Comment(prop string, rev, start, end int, body string) error {
+	return sub.conn.send(&Req{
+		Type:    MsgComment,
+		Comment: &CommentReq{SubId: sub.SubId, Prop: prop, Rev: rev, Start: start, End: end, Body: body},
+	})
+}
+
+// Sets a function to receive the responses to this subscription's comments.
+func (sub *CardSubscription) OnComment(onComment func(*CommentRsp)) {
+	sub.conn.lock.Lock()
+	defer sub.conn.lock.Unlock()
+	sub.onComment = onComment
+}
+
+// Resolves or reopens a comment on the card.
+func (sub *CardSubscription) ResolveComment(commentId string, resolved bool) error {
+	return sub.conn.send(&Req{
+		Type:           MsgResolveComment,
+		ResolveComment: &ResolveCommentReq{SubId: sub.SubId, CommentId: commentId, Resolved: resolved},
+	})
+}
+
+func (sub *CardSubscription) Unsubscribe() error {
+	sub.conn.lock.Lock()
+	delete(sub.conn.cardSubs, sub.SubId)
+	sub.conn.lock.Unlock()
+
+	return sub.conn.send(&Req{
+		Type:            MsgUnsubscribeCard,
+		UnsubscribeCard: &UnsubscribeCardReq{SubId: sub.SubId},
+	})
+}
+
+// Subscribes to a search. onSearchResults receives the page of results whenever it changes, with its Results
+// holding the whole page, and its Facets the latest ones, once any changes sent have been applied. Each
+// subscription has its own page, even if others are to the same query.
+func (conn *Connection) SubscribeSearch(query string, onSearchResults func(*SearchResultsRsp)) (*SearchSubscription, error) {
+	return conn.SubscribeSearchFields(query, nil, nil, onSearchResults)
+}
+
+// Like SubscribeSearch, but results hold the given props, and snippets of others, rather than the server's default
+// ones.
+func (conn *Connection) SubscribeSearchFields(query string, fields, snippets []string,
+	onSearchResults func(*SearchResultsRsp)) (*SearchSubscription, error) {
+	return conn.SubscribeSearchWith(SubscribeSearchReq{Query: query, Fields: fields, Snippets: snippets}, onSearchResults)
+}
+
+// Like SubscribeSearch, with the filters, sort, page and fields of req. Its SubId is picked for it.
+func (conn *Connection) SubscribeSearchWith(req SubscribeSearchReq,
+	onSearchResults func(*SearchResultsRsp)) (*SearchSubscription, error) {
+	conn.lock.Lock()
+	conn.curSubId++
+	req.SubId = conn.curSubId
+	sub := &SearchSubscription{conn: conn, Query: req.Query, SubId: req.SubId, onSearchResults: onSearchResults}
+	conn.searchSubs[sub.SubId] = sub
+	conn.lock.Unlock()
+
+	return sub, conn.send(&Req{
+		Type:            MsgSubscribeSearch,
+		SubscribeSearch: &req,
+	})
+}
+
+func (sub *SearchSubscription) Unsubscribe() error {
+	conn := sub.conn
+	conn.lock.Lock()
+	delete(conn.searchSubs, sub.SubId)
+	delete(conn.searchPages, sub.SubId)
+	conn.lock.Unlock()
+
+	return conn.send(&Req{
+		Type:              MsgUnsubscribeSearch,
+		UnsubscribeSearch: &UnsubscribeSearchReq{SubId: sub.SubId},
+	})
+}
+
+// Moves the subscription to another page of results: rows of them (or the server's default number, if 0), skipping
+// the first start. The new page is sent in full.
+func (sub *SearchSubscription) Page(start, rows int) error {
+	return sub.conn.send(&Req{
+		Type:       MsgPageSearch,
+		PageSearch: &PageSearchReq{SubId: sub.SubId, Start: start, Rows: rows},
+	})
+}
+
+// Applies results to the page last received for their subscription, filling in their Results with the whole page, and their
+// Facets with the latest ones.
+// Returns false if they can't be applied, as when they're changes to a page the subscription has since left.
+// Must be called with conn.lock held.
+func (conn *Connection) applyResults(rsp *SearchResultsRsp) bool {
+	if rsp.Reset {
+		conn.searchPages[rsp.SubId] = rsp
+		return true
+	}
+	page := conn.searchPages[rsp.SubId]
+	if page == nil || page.Start != rsp.Start || page.Rows != rsp.Rows {
+		return false
+	}
+
+	n := len(page.Results) - len(rsp.Removed) + len(rsp.Added)
+	if n < 0 {
+		return false
+	}
+	results := make([]SearchResult, n)
+	placed := make([]bool, n)
+	skip := make(map[string]bool)
+	for _, cardId := range rsp.Removed {
+		skip[cardId] = true
+	}
+	for _, r := range rsp.Added {
+		if r.Index < 0 || r.Index >= n || placed[r.Index] {
+			return false
+		}
+		results[r.Index], placed[r.Index] = r.SearchResult, true
+	}
+	byId := make(map[string]SearchResult, len(page.Results))
+	for _, r := range page.Results {
+		byId[r.CardId] = r
+	}
+	for _, r := range rsp.Moved {
+		if r.Index < 0 || r.Index >= n || placed[r.Index] {
+			return false
+		}
+		results[r.Index], placed[r.Index] = byId[r.CardId], true
+		skip[r.CardId] = true
+	}
+	i := 0
+	for _, r := range page.Results {
+		if skip[r.CardId] {
+			continue
+		}
+		for i < n && placed[i] {
+			i++
+		}
+		if i == n {
+			return false
+		}
+		results[i], placed[i] = r, true
+	}
+	updated := make(map[string]SearchResult, len(rsp.Updated))
+	for _, r := range rsp.Updated {
+		updated[r.CardId] = r
+	}
+	for i, r := range results {
+		if u, exists := updated[r.CardId]; exists {
+			results[i] = u
+		}
+	}
+
+	rsp.Results = results
+	if rsp.Facets == nil {
+		rsp.Facets = page.Facets
+	}
+	conn.searchPages[rsp.SubId] = rsp
+	return true
+}
+
+// Creates a card with the given props. onCreated, if not nil, receives the new card's id.
+func (conn *Connection) CreateCard(props map[string]string, onCreated func(*CreateCardRsp)) error {
+	conn.lock.Lock()
+	conn.curCreateId++
+	id := conn.curCreateId
+	if onCreated != nil {
+		conn.onCreates[id] = onCreated
+	}
+	conn.lock.Unlock()
+
+	return conn.send(&Req{
+		Type:       MsgCreateCard,
+		CreateCard: &CreateCardReq{CreateId: id, Props: props},
+	})
+}
+
+// Sends a request as a sockjs message: a JSON array of JSON-encoded strings.
+func (conn *Connection) send(req *Req) error {
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	frame, err := json.Marshal([]string{string(msg)})
+	if err != nil {
+		return err
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.closed {
+		return ErrorClosed
+	}
+	return conn.ws.WriteMessage(websocket.TextMessage, frame)
+}
+
+// Reads the next sockjs frame and returns the responses it carries. Open and heartbeat frames carry none.
+func (conn *Connection) recv() ([]*Rsp, error) {
+	_, buf, err := conn.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	switch buf[0] {
+	case 'o', 'h':
+		return nil, nil
+
+	case 'c':
+		var reason []interface{}
+		json.Unmarshal(buf[1:], &reason)
+		return nil, fmt.Errorf("closed by server: %v", reason)
+
+	case 'a':
+		var msgs []string
+		if err := json.Unmarshal(buf[1:], &msgs); err != nil {
+			return nil, fmt.Errorf("bad frame %q: %s", buf, err)
+		}
+		rsps := make([]*Rsp, 0, len(msgs))
+		for _, msg := range msgs {
+			var rsp Rsp
+			if err := json.Unmarshal([]byte(msg), &rsp); err != nil {
+				return nil, fmt.Errorf("bad response %q: %s", msg, err)
+			}
+			rsps = append(rsps, &rsp)
+		}
+		return rsps, nil
+	}
+	return nil, fmt.Errorf("unknown frame %q", buf)
+}
+
+// Dispatches responses to callbacks until the connection closes.
+func (conn *Connection) run() {
+	var err error
+	for {
+		var rsps []*Rsp
+		if rsps, err = conn.recv(); err != nil {
+			break
+		}
+		for _, rsp := range rsps {
+			conn.dispatch(rsp)
+		}
+	}
+
+	conn.lock.Lock()
+	if conn.closed {
+		err = nil
+	}
+	conn.closed = true
+	ws, done, onClose := conn.ws, conn.done, conn.onClose
+	conn.lock.Unlock()
+	ws.Close()
+	close(done)
+
+	if onClose != nil {
+		onClose(err)
+	}
+}
+
+func (conn *Connection) dispatch(rsp *Rsp) {
+	switch rsp.Type {
+	case MsgSubscribeCard:
+		if sub := conn.cardSub(rsp.SubscribeCard.SubId); sub != nil && sub.onSubscribe != nil {
+			sub.onSubscribe(rsp.SubscribeCard)
+		}
+
+	case MsgRevise:
+		conn.handleRevise(rsp.Revise)
+
+	case MsgPresence:
+		for _, subId := range rsp.Presence.SubIds {
+			conn.lock.Lock()
+			sub := conn.cardSubs[subId]
+			var onPresence func(*PresenceRsp)
+			if sub != nil && sub.CardId == rsp.Presence.CardId {
+				onPresence = sub.onPresence
+			}
+			conn.lock.Unlock()
+			if onPresence != nil {
+				onPresence(rsp.Presence)
+			}
+		}
+
+	case MsgComment:
+		conn.lock.Lock()
+		var onComment func(*CommentRsp)
+		if sub := conn.cardSubs[rsp.Comment.SubId]; sub != nil {
+			onComment = sub.onComment
+		}
+		conn.lock.Unlock()
+		if onComment != nil {
+			onComment(rsp.Comment)
+		}
+
+	case MsgSearchResults:
+		conn.lock.Lock()
+		sub := conn.searchSubs[rsp.SearchResults.SubId]
+		applied := sub != nil && conn.applyResults(rsp.SearchResults)
+		conn.lock.Unlock()
+		if applied && sub.onSearchResults != nil {
+			sub.onSearchResults(rsp.SearchResults)
+		}
+
+	case MsgCreateCard:
+		conn.lock.Lock()
+		onCreated := conn.onCreates[rsp.CreateCard.CreateId]
+		delete(conn.onCreates, rsp.CreateCard.CreateId)
+		conn.lock.Unlock()
+		if onCreated != nil {
+			onCreated(rsp.CreateCard)
+		}
+
+	case MsgLogout:
+		conn.lock.Lock()
+		onLogout := conn.onLogout
+		conn.onLogout = nil
+		conn.token = ""
+		conn.lock.Unlock()
+		if onLogout != nil {
+			close(onLogout)
+		}
+
+	case MsgError:
+		conn.lock.Lock()
+		onError := conn.onError
+		conn.lock.Unlock()
+		if onError != nil {
+			onError(rsp.Error.Msg)
+		}
+	}
+}
+
+func (conn *Connection) handleRevise(rsp *ReviseRsp) {
+	for _, subId := range rsp.SubIds {
+		sub := conn.cardSub(subId)
+		if sub == nil || sub.CardId != rsp.CardId {
+			continue
+		}
+		if rsp.OrigConnId == conn.connId && rsp.OrigSubId == sub.SubId {
+			if sub.onAck != nil {
+				sub.onAck(rsp)
+			}
+		} else if sub.onRevision != nil {
+			sub.onRevision(rsp)
+		}
+	}
+}
+
+func (conn *Connection) cardSub(subId int) *CardSubscription {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.cardSubs[subId]
+}
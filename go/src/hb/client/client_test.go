@@ -0,0 +1,743 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"hb"
+	. "hb/api"
+	"hb/auth"
+	"hb/card"
+	"hb/ot"
+	"hb/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests check the client against a real server, end to end. What the server does with cards and searches
+// is tested in the card and search packages.
+
+func startServer(t *testing.T) (*httptest.Server, store.Store, func()) {
+	dir, err := ioutil.TempDir("", "hbclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.NewDiskStore(filepath.Join(dir, "hb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgs, err := store.NewOrgs(func(orgId string) (store.Store, error) {
+		if orgId == store.DefaultOrg {
+			return st, nil
+		}
+		return store.Open("disk", dir, orgId)
+	}, store.DefaultOrg, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb.Init(orgs)
+	auth.Iterations = 1000
+	if err := hb.NewUser(store.DefaultOrg, "joel", "wut"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.DefaultServeMux)
+	return srv, st, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+const timeout = 5 * time.Second
+
+// A connection whose errors are collected, with helpers that wait for the server's responses.
+type testConn struct {
+	*Connection
+	t      *testing.T
+	errors chan string
+}
+
+// Logs in to an org (or the default one, if orgId is empty), counting the given units.
+func connect(t *testing.T, srv *httptest.Server, orgId, userId, password string, units ot.Unit) *testConn {
+	t.Helper()
+	conn, err := DialOrg(srv.URL, orgId, userId, password, units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConn{Connection: conn, t: t, errors: make(chan string, 10)}
+	conn.OnError(func(msg string) { c.errors <- msg })
+	return c
+}
+
+// Waits for the server to refuse a request.
+func (c *testConn) expectError(what string) {
+	c.t.Helper()
+	select {
+	case <-c.errors:
+	case <-time.After(timeout):
+		c.t.Fatalf("timed out waiting for %s to fail", what)
+	}
+}
+
+func (c *testConn) createCard(props map[string]string) string {
+	c.t.Helper()
+	created := make(chan string, 1)
+	c.CreateCard(props, func(rsp *CreateCardRsp) { created <- rsp.CardId })
+	select {
+	case cardId := <-created:
+		return cardId
+	case msg := <-c.errors:
+		c.t.Fatal(msg)
+	case <-time.After(timeout):
+		c.t.Fatal("timed out waiting for create")
+	}
+	return ""
+}
+
+// Subscribes to a card, waiting for its state.
+func (c *testConn) subscribeCard(cardId string, onRevision, onAck func(*ReviseRsp)) (*CardSubscription, *SubscribeCardRsp) {
+	c.t.Helper()
+	subscribed := make(chan *SubscribeCardRsp, 1)
+	sub, err := c.SubscribeCard(cardId, func(rsp *SubscribeCardRsp) { subscribed <- rsp }, onRevision, onAck)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return sub, c.nextSubscribe(subscribed)
+}
+
+func (c *testConn) nextSubscribe(subscribed chan *SubscribeCardRsp) *SubscribeCardRsp {
+	c.t.Helper()
+	select {
+	case rsp := <-subscribed:
+		return rsp
+	case msg := <-c.errors:
+		c.t.Fatal(msg)
+	case <-time.After(timeout):
+		c.t.Fatal("timed out waiting for subscribe")
+	}
+	return nil
+}
+
+func (c *testConn) nextRevise(revisions chan *ReviseRsp, what string) *ReviseRsp {
+	c.t.Helper()
+	select {
+	case rsp := <-revisions:
+		return rsp
+	case msg := <-c.errors:
+		c.t.Fatalf("%s: %s", what, msg)
+	case <-time.After(timeout):
+		c.t.Fatalf("timed out waiting for %s", what)
+	}
+	return nil
+}
+
+// Subscribes to a search, returning the channel its pages arrive on.
+func (c *testConn) subscribeSearch(req SubscribeSearchReq) (*SearchSubscription, chan *SearchResultsRsp) {
+	c.t.Helper()
+	results := make(chan *SearchResultsRsp, 10)
+	sub, err := c.SubscribeSearchWith(req, func(rsp *SearchResultsRsp) { results <- rsp })
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return sub, results
+}
+
+func (c *testConn) nextResults(results chan *SearchResultsRsp, what string) *SearchResultsRsp {
+	c.t.Helper()
+	select {
+	case rsp := <-results:
+		return rsp
+	case msg := <-c.errors:
+		c.t.Fatalf("%s: %s", what, msg)
+	case <-time.After(timeout):
+		c.t.Fatalf("timed out waiting for results %s", what)
+	}
+	return nil
+}
+
+func TestClient(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+
+	if _, err := Dial(srv.URL, "joel", "nope"); err == nil {
+		t.Error("expected login to fail with the wrong password")
+	}
+	alice := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer alice.Close()
+	bob := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer bob.Close()
+
+	cardId := alice.createCard(map[string]string{"type": "card", "title": "Buy milk"})
+	_, results := bob.subscribeSearch(SubscribeSearchReq{Query: "milk"})
+	if rsp := bob.nextResults(results, "on subscribing"); rsp.Total < 1 || rsp.Results[0].CardId != cardId {
+		t.Errorf("expected card %s in results, got %+v", cardId, rsp)
+	}
+
+	revisions := make(chan *ReviseRsp, 10)
+	acks := make(chan *ReviseRsp, 10)
+	aliceSub, sub := alice.subscribeCard(cardId, nil, func(rsp *ReviseRsp) { acks <- rsp })
+	if _, sub = bob.subscribeCard(cardId, func(rsp *ReviseRsp) { revisions <- rsp }, nil); sub.Props["title"] != "Buy milk" {
+		t.Errorf("expected title Buy milk, got %q", sub.Props["title"])
+	}
+
+	change := Change{Prop: "title", Ops: ot.Ops{{N: 8}, {S: " and eggs"}}}
+	if err := aliceSub.Revise(sub.Rev, change); err != nil {
+		t.Fatal(err)
+	}
+	if rsp := alice.nextRevise(acks, "ack"); rsp.OrigConnId != alice.ConnId() || !rsp.Change.Ops.Equal(change.Ops) {
+		t.Errorf("unexpected ack %+v", rsp)
+	}
+	rsp := bob.nextRevise(revisions, "revision")
+	if rsp.OrigConnId != alice.ConnId() || rsp.AuthorId != "joel" || !rsp.Change.Ops.Equal(change.Ops) {
+		t.Errorf("unexpected revision %+v", rsp)
+	}
+
+	// A revision naming another card than its subscription's is refused.
+	alice.send(&Req{Type: MsgRevise, Revise: &ReviseReq{SubId: aliceSub.SubId, CardId: "nope", Rev: sub.Rev + 1, Change: change}})
+	alice.expectError("a revision with the wrong card id")
+	select {
+	case rsp := <-acks:
+		t.Errorf("expected a revision with the wrong card id to be refused, got %+v", rsp)
+	default:
+	}
+
+	closed := make(chan error, 1)
+	bob.OnClose(func(err error) { closed <- err })
+	bob.Close()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("expected clean close, got %s", err)
+		}
+	case <-time.After(timeout):
+		t.Error("timed out waiting for close")
+	}
+	if _, err := bob.SubscribeSearch("eggs", nil); err != ErrorClosed {
+		t.Errorf("expected ErrorClosed, got %v", err)
+	}
+}
+
+func TestClientOpenCard(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+
+	alice := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer alice.Close()
+	bob := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer bob.Close()
+	cardId := alice.createCard(map[string]string{"title": "milk"})
+
+	changed := make(chan string, 100)
+	onChange := func(prop string, ops ot.Ops) { changed <- prop }
+	aliceCard, err := alice.OpenCard(cardId, onChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobCard, err := bob.OpenCard(cardId, onChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aliceCard.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bobCard.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits made at once on both ends, without waiting for acks, are rebased and converge.
+	for i := 0; i < 5; i++ {
+		if err := aliceCard.Edit("title", ot.Ops{{S: "a"}, {N: 4 + i}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bobCard.Edit("title", ot.Ops{{N: 4 + i}, {S: "b"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "aaaaamilkbbbbb"
+	deadline := time.After(timeout)
+	for !(aliceCard.Synced() && bobCard.Synced() && aliceCard.Props()["title"] == expected &&
+		bobCard.Props()["title"] == expected) {
+		select {
+		case <-changed:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("expected both cards to converge on %q, got %q and %q", expected, aliceCard.Props()["title"],
+				bobCard.Props()["title"])
+		}
+	}
+	if aliceCard.Rev() != bobCard.Rev() {
+		t.Errorf("expected both cards at the same rev, got %d and %d", aliceCard.Rev(), bobCard.Rev())
+	}
+
+	runes, err := DialUnits(srv.URL, "joel", "wut", ot.Runes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runes.Close()
+	if _, err := runes.OpenCard(cardId, nil); err != ErrorNotBytes {
+		t.Errorf("expected ErrorNotBytes opening a card counting runes, got %v", err)
+	}
+}
+
+// Card requests reach the card, and its responses reach the subscription that made them.
+func TestClientCardRequests(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+	if err := hb.NewUser(store.DefaultOrg, "bob", "wut"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer alice.Close()
+	bob := connect(t, srv, "", "bob", "wut", ot.Runes)
+	defer bob.Close()
+	cardId := alice.createCard(map[string]string{"body": "héllo world"})
+	alice.CreateCard(map[string]string{"type": "card", "kind": "chore"}, nil)
+	alice.expectError("creating a card of an unknown kind")
+
+	revisions := make(chan *ReviseRsp, 10)
+	acks := make(chan *ReviseRsp, 10)
+	aliceSub, _ := alice.subscribeCard(cardId, func(rsp *ReviseRsp) { revisions <- rsp }, nil)
+	presence := make(chan *PresenceRsp, 10)
+	aliceSub.OnPresence(func(rsp *PresenceRsp) { presence <- rsp })
+	bob.SubscribeCard(cardId, nil, nil, nil)
+	bob.expectError("subscribing before sharing")
+	aliceSub.Share("bob", "editor")
+	alice.nextRevise(revisions, "share")
+
+	// Revisions, presence and comments are relayed in each subscriber's units.
+	bobSub, state := bob.subscribeCard(cardId, nil, func(rsp *ReviseRsp) { acks <- rsp })
+	select {
+	case rsp := <-presence:
+		if rsp.Event != PresenceJoin || rsp.Presence.ConnId != bob.ConnId() || rsp.Presence.SubId != bobSub.SubId {
+			t.Errorf("expected bob to join, got %+v", rsp)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for join")
+	}
+	bobSub.Revise(state.Rev, Change{Prop: "body", Ops: ot.Ops{{N: 1}, {N: -1}, {S: "e"}, {N: 9}}})
+	bob.nextRevise(acks, "ack")
+	if rsp := alice.nextRevise(revisions, "revision"); !rsp.Change.Ops.Equal(ot.Ops{{N: 1}, {N: -2}, {S: "e"}, {N: 9}}) {
+		t.Errorf("expected the revision counted in bytes, got %v", rsp.Change.Ops)
+	}
+	comments := make(chan *CommentRsp, 1)
+	bobSub.OnComment(func(rsp *CommentRsp) { comments <- rsp })
+	bobSub.Comment("body", state.Rev+1, 6, 11, "who?")
+	select {
+	case rsp := <-comments:
+		if rsp.CardId != cardId || rsp.CommentId == "" {
+			t.Errorf("unexpected comment %+v", rsp)
+		}
+	case msg := <-bob.errors:
+		t.Fatal(msg)
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for comment")
+	}
+	if rsp := alice.nextRevise(revisions, "comment"); rsp.Change.Prop != card.CommentsProp {
+		t.Errorf("expected the comment anchored, got %+v", rsp)
+	}
+
+	// Undo is the subscriber's own.
+	bobSub.Undo()
+	if rsp := alice.nextRevise(revisions, "undo"); rsp.Change.Prop != "body" || rsp.AuthorId != "bob" {
+		t.Errorf("expected bob's revision to be undone, got %+v", rsp)
+	}
+}
+
+func TestClientLegacyPassword(t *testing.T) {
+	srv, st, cleanup := startServer(t)
+	defer cleanup()
+	if err := st.CreateUser(&store.User{Id: "old", Props: map[string]string{"pass": "wut"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Dial(srv.URL, "old", "nope"); err == nil {
+		t.Error("expected login to fail with the wrong password")
+	}
+	conn, err := Dial(srv.URL, "old", "wut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The plaintext password is replaced by a hash on login.
+	user, err := st.FindUser("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := user.Props["pass"]; exists || user.PassHash == "" {
+		t.Errorf("expected password to be migrated, got %+v", user)
+	}
+	conn, err = Dial(srv.URL, "old", "wut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Users who haven't logged in have theirs hashed on startup.
+	if err := st.CreateUser(&store.User{Id: "older", Props: map[string]string{"pass": "wut"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hb.MigratePasswords(); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = st.FindUser("older"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := user.Props["pass"]; exists || user.PassHash == "" {
+		t.Errorf("expected password to be migrated on startup, got %+v", user)
+	}
+	conn, err = Dial(srv.URL, "older", "wut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Users without any password can't log in.
+	if err := st.CreateUser(&store.User{Id: "nopass", Props: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Dial(srv.URL, "nopass", "anything"); err == nil {
+		t.Error("expected login without a password to fail")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+
+	conn := connect(t, srv, "", "joel", "wut", ot.Runes)
+	defer conn.Close()
+	if conn.Token() == "" || !conn.Expires().After(time.Now()) {
+		t.Fatalf("expected a session token, got %q expiring %v", conn.Token(), conn.Expires())
+	}
+	cardId := conn.createCard(map[string]string{"title": "reconnect"})
+
+	subscribed := make(chan *SubscribeCardRsp, 2)
+	acks := make(chan *ReviseRsp, 2)
+	sub, _ := conn.SubscribeCard(cardId, func(rsp *SubscribeCardRsp) { subscribed <- rsp }, nil, func(rsp *ReviseRsp) { acks <- rsp })
+	conn.nextSubscribe(subscribed)
+	_, results := conn.subscribeSearch(SubscribeSearchReq{Query: "reconnect"})
+	conn.nextResults(results, "on subscribing")
+
+	closed := make(chan error, 1)
+	conn.OnClose(func(err error) { closed <- err })
+	connId := conn.ConnId()
+	conn.Close()
+	<-closed
+	if err := conn.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.ConnId() == connId || conn.Units() != ot.Runes || conn.UserId() != "joel" {
+		t.Errorf("unexpected connection after reconnect: %s %s %s", conn.ConnId(), conn.Units(), conn.UserId())
+	}
+
+	// The card and search subscriptions are back without being re-requested.
+	rsp := conn.nextSubscribe(subscribed)
+	if rsp.CardId != cardId || rsp.Props["title"] != "reconnect" {
+		t.Errorf("unexpected resubscribe %+v", rsp)
+	}
+	conn.nextResults(results, "after reconnecting")
+	sub.Revise(rsp.Rev, Change{Prop: "title", Ops: ot.Ops{{N: 9}, {S: "ed"}}})
+	if ack := conn.nextRevise(acks, "ack"); ack.OrigConnId != conn.ConnId() {
+		t.Errorf("expected ack for %s, got %+v", conn.ConnId(), ack)
+	}
+
+	// Once logged out, the token can't be resumed.
+	token := conn.Token()
+	if err := conn.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resume(srv.URL, token); err == nil {
+		t.Error("expected resume to fail after logout")
+	}
+	if _, err := Resume(srv.URL, token+"x"); err == nil {
+		t.Error("expected resume to fail with a bad token")
+	}
+	conn.Close()
+	<-closed
+	if err := conn.Reconnect(); err == nil {
+		t.Error("expected reconnect to fail after logout")
+	}
+}
+
+func TestClientOrgs(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+	if err := hb.NewUser("acme", "joel", "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same user id is a different user in each org.
+	if _, err := DialOrg(srv.URL, "acme", "joel", "wut", ot.Bytes); err == nil {
+		t.Error("expected login with another org's password to fail")
+	}
+	if _, err := DialOrg(srv.URL, "nope", "joel", "wut", ot.Bytes); err == nil {
+		t.Error("expected login to an unknown org to fail")
+	}
+	hbConn := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer hbConn.Close()
+	acmeConn := connect(t, srv, "acme", "joel", "acme", ot.Bytes)
+	defer acmeConn.Close()
+	if hbConn.OrgId() != store.DefaultOrg || acmeConn.OrgId() != "acme" {
+		t.Errorf("unexpected orgs %s and %s", hbConn.OrgId(), acmeConn.OrgId())
+	}
+
+	// Another org can't see the card, even though it's the same user id.
+	cardId := hbConn.createCard(map[string]string{"title": "orgtest"})
+	acmeConn.SubscribeCard(cardId, nil, nil, nil)
+	acmeConn.expectError("subscribing to another org's card")
+	_, results := acmeConn.subscribeSearch(SubscribeSearchReq{Query: "orgtest"})
+	if rsp := acmeConn.nextResults(results, "in another org"); rsp.Total != 0 {
+		t.Errorf("expected no results from another org, got %+v", rsp)
+	}
+	_, results = hbConn.subscribeSearch(SubscribeSearchReq{Query: "orgtest"})
+	if rsp := hbConn.nextResults(results, "in the card's org"); rsp.Total != 1 {
+		t.Errorf("expected the card in its own org, got %+v", rsp)
+	}
+
+	// Resumed logins stay in their org.
+	acmeConn.Close()
+	if err := acmeConn.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if acmeConn.OrgId() != "acme" {
+		t.Errorf("expected to resume in acme, got %s", acmeConn.OrgId())
+	}
+}
+
+// The client keeps each search's page up to date by applying the changes the server sends.
+func TestClientSearch(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+	flushInterval := card.FlushInterval
+	card.FlushInterval = 50 * time.Millisecond
+	defer func() { card.FlushInterval = flushInterval }()
+
+	conn := connect(t, srv, "", "joel", "wut", ot.Bytes)
+	defer conn.Close()
+	var ids []string
+	for _, title := range []string{"pagetest 1", "pagetest 2", "pagetest 3"} {
+		ids = append(ids, conn.createCard(map[string]string{"title": title}))
+	}
+
+	sub, results := conn.subscribeSearch(SubscribeSearchReq{Query: "pagetest"})
+	awaitPage := func(what string, total int, cardIds ...string) *SearchResultsRsp {
+		t.Helper()
+		rsp := conn.nextResults(results, what)
+		page := make([]string, len(rsp.Results))
+		for i, r := range rsp.Results {
+			page[i] = r.CardId
+		}
+		if rsp.Total != total || strings.Join(page, ",") != strings.Join(cardIds, ",") {
+			t.Fatalf("expected %v of %d %s, got %v of %d", cardIds, total, what, page, rsp.Total)
+		}
+		return rsp
+	}
+	if rsp := awaitPage("on subscribing", 3, ids[2], ids[1], ids[0]); !rsp.Reset || rsp.Start != 0 || rsp.Rows == 0 {
+		t.Errorf("expected the whole default page, got %+v", rsp)
+	}
+	// Another subscription to the same query gets a page of its own, and leaves the first one be.
+	other, otherResults := conn.subscribeSearch(SubscribeSearchReq{Query: "pagetest", Rows: 1, Fields: []string{}})
+	if rsp := conn.nextResults(otherResults, "on subscribing again"); rsp.SubId != other.SubId || rsp.SubId == sub.SubId ||
+		len(rsp.Results) != 1 || len(rsp.Results[0].Props) != 0 {
+		t.Errorf("expected a page of one result without props, got %+v", rsp)
+	}
+	if err := other.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	sub.Page(0, 2)
+	if rsp := awaitPage("on paging", 3, ids[2], ids[1]); !rsp.Reset || rsp.Rows != 2 {
+		t.Errorf("expected the whole page, got %+v", rsp)
+	}
+
+	// A new card pushes the last one off the page.
+	ids = append(ids, conn.createCard(map[string]string{"title": "pagetest 4"}))
+	if rsp := awaitPage("after creating", 4, ids[3], ids[2]); rsp.Reset {
+		t.Errorf("expected changes to the page, got %+v", rsp)
+	}
+
+	// Revising a card moves it to the top, and updates its title.
+	cardSub, state := conn.subscribeCard(ids[2], nil, nil)
+	cardSub.Revise(state.Rev, Change{Prop: "title", Ops: ot.Ops{{N: 10}, {S: "!"}}})
+	if rsp := awaitPage("after revising", 4, ids[2], ids[3]); rsp.Results[0].Props["title"] != "pagetest 3!" {
+		t.Errorf("expected %s to change, got %+v", ids[2], rsp)
+	}
+
+	sub.Page(2, 2)
+	awaitPage("on the second page", 4, ids[1], ids[0])
+	sub.Page(0, 1000)
+	conn.expectError("an oversized page")
+}
+
+func TestAdminAPI(t *testing.T) {
+	srv, _, cleanup := startServer(t)
+	defer cleanup()
+	if err := hb.BootstrapAdmin("root", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, userId, pass, body string, v interface{}) int {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userId != "" {
+			req.SetBasicAuth(userId, pass)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if v != nil && rsp.StatusCode < 300 {
+			if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rsp.StatusCode
+	}
+
+	if status := do("GET", "/admin/users", "", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", status)
+	}
+	if status := do("GET", "/admin/users", "root", "nope", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the wrong password, got %d", status)
+	}
+	if status := do("GET", "/admin/users", "joel", "wut", "", nil); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", status)
+	}
+	if status := do("GET", "/admin/users?org=nope", "root", "secret", "", nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown org, got %d", status)
+	}
+
+	var user hb.AdminUser
+	body := `{"Id": "bob", "Password": "pw", "Groups": ["eng"]}`
+	if status := do("POST", "/admin/users", "root", "secret", body, &user); status != http.StatusCreated {
+		t.Fatalf("expected 201 creating bob, got %d", status)
+	}
+	if user.Id != "bob" || len(user.Groups) != 1 || user.Groups[0] != "eng" || user.Disabled {
+		t.Errorf("unexpected new user %+v", user)
+	}
+	if status := do("POST", "/admin/users", "root", "secret", body, nil); status != http.StatusConflict {
+		t.Errorf("expected 409 creating bob again, got %d", status)
+	}
+	if status := do("POST", "/admin/users", "root", "secret", `{"Id": "eve", "Password": "pw", "Roles": ["god"]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown role, got %d", status)
+	}
+	for _, id := range []string{"group:eng", "a|b", "a/b", "a b"} {
+		body := fmt.Sprintf(`{"Id": %q, "Password": "pw"}`, id)
+		if status := do("POST", "/admin/users", "root", "secret", body, nil); status != http.StatusBadRequest {
+			t.Errorf("expected 400 for user id %q, got %d", id, status)
+		}
+	}
+
+	var users []hb.AdminUser
+	if status := do("GET", "/admin/users", "root", "secret", "", &users); status != http.StatusOK {
+		t.Fatalf("expected 200 listing users, got %d", status)
+	}
+	if len(users) != 3 || users[0].Id != "bob" || users[1].Id != "joel" || users[2].Id != "root" {
+		t.Errorf("unexpected users %+v", users)
+	}
+
+	if status := do("PATCH", "/admin/users/root", "root", "secret", `{"Disabled": true}`, nil); status != http.StatusConflict {
+		t.Errorf("expected 409 disabling oneself, got %d", status)
+	}
+	if status := do("PATCH", "/admin/users/bob", "root", "secret", `{"Roles": ["god"]}`, nil); status != http.StatusBadRequest {
+		t.Errorf("expected 400 giving bob an unknown role, got %d", status)
+	}
+
+	// Of several creates of the same user at once, only one succeeds.
+	created := make(chan int)
+	for i := 0; i < 5; i++ {
+		go func() {
+			created <- do("POST", "/admin/users", "root", "secret", `{"Id": "carol", "Password": "pw"}`, nil)
+		}()
+	}
+	successes := 0
+	for i := 0; i < 5; i++ {
+		if status := <-created; status == http.StatusCreated {
+			successes++
+		} else if status != http.StatusConflict {
+			t.Errorf("expected 201 or 409 creating carol, got %d", status)
+		}
+	}
+	if successes != 1 {
+		t.Errorf("expected carol to be created once, got %d", successes)
+	}
+	if status := do("DELETE", "/admin/users/carol", "root", "secret", "", nil); status != http.StatusNoContent {
+		t.Errorf("expected 204 deleting carol, got %d", status)
+	}
+
+	// Changing a user's groups ends their sessions, which act with the groups they had.
+	bob, err := Dial(srv.URL, "bob", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := do("PATCH", "/admin/users/bob", "root", "secret", `{"Groups": ["ops"]}`, &user); status != http.StatusOK {
+		t.Fatalf("expected 200 changing bob's groups, got %d", status)
+	}
+	select {
+	case <-bob.done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for bob's connection to close")
+	}
+	if _, err := Resume(srv.URL, bob.Token()); err == nil {
+		t.Error("expected bob's session to be revoked when their groups changed")
+	}
+
+	// Disabling a user closes their connections, and stops them logging in.
+	bob, err = Dial(srv.URL, "bob", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if status := do("PATCH", "/admin/users/bob", "root", "secret", `{"Disabled": true}`, &user); status != http.StatusOK {
+		t.Fatalf("expected 200 disabling bob, got %d", status)
+	}
+	if !user.Disabled {
+		t.Errorf("expected bob to be disabled, got %+v", user)
+	}
+	select {
+	case <-bob.done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for bob's connection to close")
+	}
+	if _, err := Dial(srv.URL, "bob", "pw"); err == nil {
+		t.Error("expected a disabled user's login to fail")
+	}
+	if _, err := Resume(srv.URL, bob.Token()); err == nil {
+		t.Error("expected a disabled user's session to be revoked")
+	}
+
+	// Cards' past revisions are only for admins, since they ignore who the cards are shared with.
+	cardId, err := card.Create(store.DefaultOrg, "admin", "joel", map[string]string{"title": "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardAt := "/admin/card-at?rev=1&id=" + cardId
+	if status := do("GET", cardAt, "", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 getting a card without credentials, got %d", status)
+	}
+	if status := do("GET", cardAt, "joel", "wut", "", nil); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin getting a card, got %d", status)
+	}
+	var past GetCardAtRsp
+	if status := do("GET", cardAt, "root", "secret", "", &past); status != http.StatusOK || past.Rev != 1 {
+		t.Errorf("expected 200 getting rev 1 of a card, got %d: %+v", status, past)
+	}
+
+	if status := do("DELETE", "/admin/users/root", "root", "secret", "", nil); status != http.StatusConflict {
+		t.Errorf("expected 409 deleting oneself, got %d", status)
+	}
+	if status := do("DELETE", "/admin/users/bob", "root", "secret", "", nil); status != http.StatusNoContent {
+		t.Errorf("expected 204 deleting bob, got %d", status)
+	}
+	if status := do("GET", "/admin/users/bob", "root", "secret", "", nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted user, got %d", status)
+	}
+}
@@ -4,23 +4,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
-	"log"
 	. "hb/api"
+	"hb/auth"
 	"hb/card"
+	"hb/ot"
 	"hb/search"
+	"hb/store"
+	"log"
 	"strings"
-	"hb/solr"
 )
 
 type Connection struct {
-	user       solr.JsonObject
+	orgId      string
+	user       *store.User
+	login      *login
+	units      ot.Unit
+	principals []string // who the user acts as, for access control
 	sock       sockjs.Session
-	cardSubs    map[int]*card.Card // subId -> Card
-	searchSubs map[string]*search.Search  // query -> Search
+	cardSubs   map[int]*card.Card     // subId -> Card
+	searchSubs map[int]*search.Search // subId -> Search
 }
 
 func sockHandler(sock sockjs.Session) {
 	log.Printf("new connection: %s", sock.ID())
+	if !addSession(sock) {
+		sock.Close(closeGoingAway, "server shutting down")
+		return
+	}
+	defer removeSession(sock)
 
 	var conn *Connection
 	var err error
@@ -36,20 +47,61 @@ func sockHandler(sock sockjs.Session) {
 
 			switch req.Type {
 			case MsgLogin:
-				userId := req.Login.UserId
-				user, err := FindUser(userId)
+				orgId, userId := req.Login.OrgId, req.Login.UserId
+				if orgId == "" {
+					orgId = store.DefaultOrg
+				}
+				units, err := ot.ParseUnit(req.Login.Units)
 				if err != nil {
-					ErrorRsp{Msg: fmt.Sprintf("Invalid user id: %s", userId)}.Send(sock)
+					ErrorRsp{Msg: err.Error()}.Send(sock)
+					continue
+				}
+				user, err := Authenticate(orgId, userId, req.Login.Password)
+				if err == store.ErrorNoOrg {
+					ErrorRsp{Msg: fmt.Sprintf("Invalid org id: %s", orgId)}.Send(sock)
 					continue
 				}
-				pass := user.GetString("prop_pass")
-				log.Printf("pass: %v", pass)
-				if pass != nil && req.Login.Password != *pass {
+				if err == ErrorDisabled {
+					ErrorRsp{Msg: fmt.Sprintf("User is disabled: %s", userId)}.Send(sock)
+					continue
+				}
+				if err == ErrorBadPassword {
 					ErrorRsp{Msg: fmt.Sprintf("Incorrect password for user: %s", userId)}.Send(sock)
 					continue
 				}
-				conn = newConnection(user, sock)
-				LoginRsp{UserId: req.Login.UserId, ConnId: conn.Id()}.Send(sock)
+				if err != nil {
+					ErrorRsp{Msg: fmt.Sprintf("Invalid user id: %s", userId)}.Send(sock)
+					continue
+				}
+				l, err := newLogin(orgId, user.Id, units)
+				if err != nil {
+					ErrorRsp{Msg: fmt.Sprintf("error logging in user %s: %s", userId, err)}.Send(sock)
+					continue
+				}
+				if conn != nil {
+					conn.cleanupSubs()
+				}
+				conn = newConnection(user, l, sock)
+				LoginRsp{
+					OrgId:   orgId,
+					UserId:  req.Login.UserId,
+					ConnId:  conn.Id(),
+					Units:   units.String(),
+					Token:   l.token,
+					Expires: l.expires,
+				}.Send(sock)
+
+			case MsgResume:
+				if conn != nil {
+					conn.cleanupSubs()
+				}
+				conn = resume(req.Resume, sock)
+
+			case MsgLogout:
+				if conn.validate(sock) {
+					conn.logout()
+					conn = nil
+				}
 
 			case MsgSubscribeCard:
 				if conn.validate(sock) {
@@ -76,10 +128,60 @@ func sockHandler(sock sockjs.Session) {
 					conn.handleUnsubscribeSearch(req.UnsubscribeSearch)
 				}
 
+			case MsgPageSearch:
+				if conn.validate(sock) {
+					conn.handlePageSearch(req.PageSearch)
+				}
+
 			case MsgCreateCard:
 				if conn.validate(sock) {
 					conn.handleCreateCard(req.CreateCard)
 				}
+
+			case MsgGetCardAt:
+				if conn.validate(sock) {
+					conn.handleGetCardAt(req.GetCardAt)
+				}
+
+			case MsgRestoreCard:
+				if conn.validate(sock) {
+					conn.handleRestoreCard(req.RestoreCard)
+				}
+
+			case MsgUndo:
+				if conn.validate(sock) {
+					conn.handleUndo(req.Undo)
+				}
+
+			case MsgRedo:
+				if conn.validate(sock) {
+					conn.handleRedo(req.Redo)
+				}
+
+			case MsgShareCard:
+				if conn.validate(sock) {
+					conn.handleShareCard(req.ShareCard)
+				}
+
+			case MsgUnshareCard:
+				if conn.validate(sock) {
+					conn.handleUnshareCard(req.UnshareCard)
+				}
+
+			case MsgCursor:
+				if conn.validate(sock) {
+					conn.handleCursor(req.Cursor)
+				}
+
+			case MsgComment:
+				if conn.validate(sock) {
+					conn.handleComment(req.Comment)
+				}
+
+			case MsgResolveComment:
+				if conn.validate(sock) {
+					conn.handleResolveComment(req.ResolveComment)
+				}
 			}
 
 			continue
@@ -112,19 +214,19 @@ func (conn *Connection) handleSubscribeCard(req *SubscribeCardReq) {
 		return
 	}
 
-	card, err := card.Subscribe(req.CardId, conn.Id(), req.SubId, conn.sock)
+	c, rsp, err := card.Subscribe(conn.orgId, req.CardId, conn.Id(), conn.user.Id, req.SubId, conn.units, conn.principals, conn.sock)
+	if err == card.ErrorForbidden {
+		ErrorRsp{Msg: fmt.Sprintf("access denied to card: %s", req.CardId)}.Send(conn.sock)
+		return
+	}
 	if err != nil {
 		ErrorRsp{Msg: fmt.Sprintf("no such card: %s", req.CardId)}.Send(conn.sock)
 		return
 	}
-	conn.cardSubs[req.SubId] = card
+	conn.cardSubs[req.SubId] = c
+	conn.login.addCard(req.SubId, req.CardId)
 
-	SubscribeCardRsp{
-		CardId: req.CardId,
-		SubId: req.SubId,
-		Rev:   card.Rev(),
-		Props: card.Props(),
-	}.Send(conn.sock)
+	rsp.Send(conn.sock)
 }
 
 func (conn *Connection) handleUnsubscribeCard(req *UnsubscribeCardReq) {
@@ -135,6 +237,7 @@ func (conn *Connection) handleUnsubscribeCard(req *UnsubscribeCardReq) {
 	}
 
 	delete(conn.cardSubs, req.SubId)
+	conn.login.removeCard(req.SubId)
 	card.Unsubscribe(conn.Id(), req.SubId)
 	UnsubscribeCardRsp{SubId: req.SubId}.Send(conn.sock)
 }
@@ -145,41 +248,70 @@ func (conn *Connection) handleRevise(req *ReviseReq) {
 		ErrorRsp{Msg: fmt.Sprintf("error revising card %s - not subscribed", req.CardId)}.Send(conn.sock)
 		return
 	}
-	card.Revise(req.ConnId, req.SubId, req.Rev, req.Change)
+	if req.CardId != card.Id() {
+		ErrorRsp{Msg: fmt.Sprintf("error revising card %s - subscription %d is to card %s", req.CardId, req.SubId, card.Id())}.Send(conn.sock)
+		return
+	}
+	card.Revise(conn.Id(), conn.user.Id, req.SubId, req.Rev, req.Change)
 }
 
 func (conn *Connection) handleSubscribeSearch(req *SubscribeSearchReq) {
-	if _, exists := conn.searchSubs[req.Query]; exists {
-		ErrorRsp{Msg: fmt.Sprintf("double subscribe: %s", req.Query)}.Send(conn.sock)
+	if _, exists := conn.searchSubs[req.SubId]; exists {
+		ErrorRsp{Msg: fmt.Sprintf("double subscribe: search %d", req.SubId)}.Send(conn.sock)
 		return
 	}
 
-	search, err := search.Subscribe(req.Query, conn.Id(), conn.sock)
+	search, err := search.Subscribe(conn.orgId, *req, conn.Id(), conn.principals, conn.sock)
 	if err != nil {
-		ErrorRsp{Msg: fmt.Sprintf("unable to subscribe to search: %s", req.Query)}.Send(conn.sock)
+		ErrorRsp{Msg: fmt.Sprintf("unable to subscribe to search %s: %s", req.Query, err)}.Send(conn.sock)
 		return
 	}
 
-	conn.searchSubs[req.Query] = search
+	conn.searchSubs[req.SubId] = search
+	conn.login.addSearch(*req)
 	SubscribeSearchRsp{
+		SubId: req.SubId,
 		Query: req.Query,
 	}.Send(conn.sock)
 }
 
 func (conn *Connection) handleUnsubscribeSearch(req *UnsubscribeSearchReq) {
-	s, exists := conn.searchSubs[req.Query]
+	s, exists := conn.searchSubs[req.SubId]
 	if !exists {
-		ErrorRsp{Msg: fmt.Sprintf("error unsubscribing search %s: no subscription found", req.Query)}.Send(conn.sock)
+		ErrorRsp{Msg: fmt.Sprintf("error unsubscribing search %d: no subscription found", req.SubId)}.Send(conn.sock)
 		return
 	}
 
-	delete(conn.searchSubs, req.Query)
-	s.Unsubscribe(conn.Id())
-	UnsubscribeSearchRsp{Query: req.Query}.Send(conn.sock)
+	delete(conn.searchSubs, req.SubId)
+	conn.login.removeSearch(req.SubId)
+	s.Unsubscribe(conn.Id(), req.SubId)
+	UnsubscribeSearchRsp{SubId: req.SubId}.Send(conn.sock)
+}
+
+// Moves a search subscription to another page of results. Asking for the page it's on just sends that again.
+func (conn *Connection) handlePageSearch(req *PageSearchReq) {
+	old, exists := conn.searchSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error paging search %d: no subscription found", req.SubId)}.Send(conn.sock)
+		return
+	}
+
+	page := conn.login.search(req.SubId)
+	page.Start, page.Rows = req.Start, req.Rows
+	s, err := search.Subscribe(conn.orgId, page, conn.Id(), conn.principals, conn.sock)
+	if err != nil {
+		ErrorRsp{Msg: fmt.Sprintf("error paging search %d: %s", req.SubId, err)}.Send(conn.sock)
+		return
+	}
+	if s != old {
+		old.Unsubscribe(conn.Id(), req.SubId)
+	}
+	conn.searchSubs[req.SubId] = s
+	conn.login.addSearch(page)
 }
 
 func (conn *Connection) handleCreateCard(req *CreateCardReq) {
-	cardId, err := card.Create(conn.Id(), req.Props)
+	cardId, err := card.Create(conn.orgId, conn.Id(), conn.user.Id, req.Props)
 	if err != nil {
 		ErrorRsp{Msg: fmt.Sprintf("error creating card: %s", err)}.Send(conn.sock)
 		return
@@ -187,23 +319,119 @@ func (conn *Connection) handleCreateCard(req *CreateCardReq) {
 	CreateCardRsp{CreateId: req.CreateId, CardId: cardId}.Send(conn.sock)
 }
 
+func (conn *Connection) handleGetCardAt(req *GetCardAtReq) {
+	rev, props, err := card.PropsAt(conn.orgId, req.CardId, req.Rev, req.Time, conn.principals)
+	if err != nil {
+		ErrorRsp{Msg: fmt.Sprintf("error getting card %s at rev %d: %s", req.CardId, req.Rev, err)}.Send(conn.sock)
+		return
+	}
+	GetCardAtRsp{CardId: req.CardId, Rev: rev, Props: props}.Send(conn.sock)
+}
+
+func (conn *Connection) handleRestoreCard(req *RestoreCardReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error restoring subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Restore(conn.Id(), conn.user.Id, req.SubId, req.Rev, req.Time)
+}
+
+func (conn *Connection) handleUndo(req *UndoReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error undoing subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Undo(conn.Id(), conn.user.Id, req.SubId)
+}
+
+func (conn *Connection) handleRedo(req *RedoReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error redoing subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Redo(conn.Id(), conn.user.Id, req.SubId)
+}
+
+func (conn *Connection) handleShareCard(req *ShareCardReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error sharing subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	role, err := auth.ParseRole(req.Role)
+	if err != nil {
+		ErrorRsp{Msg: fmt.Sprintf("error sharing card %s: %s", card.Id(), err)}.Send(conn.sock)
+		return
+	}
+	card.Share(conn.Id(), conn.user.Id, req.SubId, req.Principal, role)
+}
+
+func (conn *Connection) handleUnshareCard(req *UnshareCardReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error unsharing subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Unshare(conn.Id(), conn.user.Id, req.SubId, req.Principal)
+}
+
+func (conn *Connection) handleCursor(req *CursorReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error setting cursor for subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.SetCursor(conn.Id(), req.SubId, req.Cursor)
+}
+
+func (conn *Connection) handleComment(req *CommentReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error commenting on subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Comment(conn.Id(), conn.user.Id, *req)
+}
+
+func (conn *Connection) handleResolveComment(req *ResolveCommentReq) {
+	card, exists := conn.cardSubs[req.SubId]
+	if !exists {
+		ErrorRsp{Msg: fmt.Sprintf("error resolving comment on subid %d - not subscribed", req.SubId)}.Send(conn.sock)
+		return
+	}
+	card.Resolve(conn.Id(), conn.user.Id, req.SubId, req.CommentId, req.Resolved)
+}
+
+// Ends the connection's login. Its subscriptions are dropped, and can't be resumed.
+func (conn *Connection) logout() {
+	conn.login.revoke()
+	conn.cleanupSubs()
+	LogoutRsp{UserId: conn.user.Id}.Send(conn.sock)
+}
+
 func (conn *Connection) cleanupSubs() {
 	// Remove this connection's subscriptions from their cards.
 	// Don't bother clearing conn.*Subs, because it won't be reused
 	for subId, card := range conn.cardSubs {
 		card.Unsubscribe(conn.Id(), subId)
 	}
-	for _, s := range conn.searchSubs {
-		s.Unsubscribe(conn.Id())
+	for subId, s := range conn.searchSubs {
+		s.Unsubscribe(conn.Id(), subId)
 	}
 }
 
-func newConnection(user solr.JsonObject, sock sockjs.Session) *Connection {
+func newConnection(user *store.User, l *login, sock sockjs.Session) *Connection {
 	return &Connection{
+		orgId:      l.orgId,
 		user:       user,
+		login:      l,
+		units:      l.attach(sock),
+		principals: auth.Principals(user.Id, user.Props),
 		sock:       sock,
-		cardSubs:    make(map[int]*card.Card),
-		searchSubs: make(map[string]*search.Search),
+		cardSubs:   make(map[int]*card.Card),
+		searchSubs: make(map[int]*search.Search),
 	}
 }
-
@@ -1,14 +1,27 @@
 package hb
 
 import (
-	"hb/solr"
-	"net/http"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
+	"hb/card"
+	"hb/search"
+	"hb/store"
+	"net/http"
 )
 
-func init() {
-	solr.EnsureCore("hb")
+// Each org's store, which its users are loaded from. Set by Init().
+var orgs *store.Orgs
 
+func init() {
 	http.Handle("/sock/", sockjs.NewHandler("/sock", sockjs.DefaultOptions, sockHandler))
-	http.Handle("/admin/new-user", http.HandlerFunc(newUserHandler))
+	http.Handle("/admin/users", requireAdmin(usersHandler))
+	http.Handle("/admin/users/", requireAdmin(userHandler))
+	http.Handle("/admin/new-user", requireAdmin(newUserHandler))
+	http.Handle("/admin/card-at", requireAdmin(cardAtHandler))
+}
+
+// Wires up all subsystems to the given org stores. Must be called before serving any requests.
+func Init(o *store.Orgs) {
+	orgs = o
+	card.Init(o)
+	search.Init(o)
 }
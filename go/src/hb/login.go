@@ -0,0 +1,234 @@
+package hb
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+	. "hb/api"
+	"hb/auth"
+	"hb/card"
+	"hb/ot"
+	"hb/search"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a login's session token stays valid.
+var SessionTTL = 24 * time.Hour
+
+var ErrorRevoked = errors.New("session revoked")
+
+// Logins that can be resumed with their session tokens, along with the subscriptions their connections had.
+// They're kept in memory only, so session tokens don't survive a restart.
+var logins struct {
+	sync.Mutex
+	tokens *auth.Tokens
+	byId   map[string]*login
+}
+
+type login struct {
+	id       string
+	orgId    string
+	userId   string
+	units    ot.Unit
+	token    string
+	expires  time.Time
+	cards    map[int]string             // subId -> cardId
+	searches map[int]SubscribeSearchReq // subId -> the page subscribed to
+	sock     sockjs.Session             // the login's current connection
+}
+
+func init() {
+	var err error
+	if logins.tokens, err = auth.NewTokens(nil); err != nil {
+		panic(err)
+	}
+	logins.byId = make(map[string]*login)
+}
+
+// Starts a new login for an org's user, issuing its session token.
+func newLogin(orgId, userId string, units ot.Unit) (*login, error) {
+	id, err := auth.NewId()
+	if err != nil {
+		return nil, err
+	}
+	l := &login{
+		id:       id,
+		orgId:    orgId,
+		userId:   userId,
+		units:    units,
+		expires:  time.Now().Add(SessionTTL),
+		cards:    make(map[int]string),
+		searches: make(map[int]SubscribeSearchReq),
+	}
+	l.token = logins.tokens.Sign(id, l.expires)
+
+	logins.Lock()
+	defer logins.Unlock()
+	now := time.Now()
+	for id, other := range logins.byId {
+		if !now.Before(other.expires) {
+			delete(logins.byId, id)
+		}
+	}
+	logins.byId[id] = l
+	return l, nil
+}
+
+// Finds the login a session token was issued for.
+func findLogin(token string) (*login, error) {
+	id, err := logins.tokens.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logins.Lock()
+	defer logins.Unlock()
+	l, exists := logins.byId[id]
+	if !exists {
+		return nil, ErrorRevoked
+	}
+	return l, nil
+}
+
+// Makes sock the login's current connection, returning the login's units.
+func (l *login) attach(sock sockjs.Session) ot.Unit {
+	logins.Lock()
+	defer logins.Unlock()
+	l.sock = sock
+	return l.units
+}
+
+// Revokes a login's session token.
+func (l *login) revoke() {
+	logins.Lock()
+	defer logins.Unlock()
+	delete(logins.byId, l.id)
+}
+
+// Revokes all of an org's user's session tokens, and closes their connections.
+func RevokeLogins(orgId, userId string) {
+	var socks []sockjs.Session
+	logins.Lock()
+	for id, l := range logins.byId {
+		if l.orgId == orgId && l.userId == userId {
+			delete(logins.byId, id)
+			if l.sock != nil {
+				socks = append(socks, l.sock)
+			}
+		}
+	}
+	logins.Unlock()
+
+	for _, sock := range socks {
+		sock.Close(closeRevoked, "session revoked")
+	}
+}
+
+func (l *login) addCard(subId int, cardId string) {
+	logins.Lock()
+	defer logins.Unlock()
+	l.cards[subId] = cardId
+}
+
+func (l *login) removeCard(subId int) {
+	logins.Lock()
+	defer logins.Unlock()
+	delete(l.cards, subId)
+}
+
+func (l *login) addSearch(req SubscribeSearchReq) {
+	logins.Lock()
+	defer logins.Unlock()
+	l.searches[req.SubId] = req
+}
+
+// Gets the page of a search subscription last subscribed to.
+func (l *login) search(subId int) SubscribeSearchReq {
+	logins.Lock()
+	defer logins.Unlock()
+	return l.searches[subId]
+}
+
+func (l *login) removeSearch(subId int) {
+	logins.Lock()
+	defer logins.Unlock()
+	delete(l.searches, subId)
+}
+
+// Gets the login's subscriptions: card subIds in order, their cardIds, and searches in subId order.
+func (l *login) subscriptions() ([]int, map[int]string, []SubscribeSearchReq) {
+	logins.Lock()
+	defer logins.Unlock()
+
+	subIds := make([]int, 0, len(l.cards))
+	cards := make(map[int]string, len(l.cards))
+	for subId, cardId := range l.cards {
+		subIds = append(subIds, subId)
+		cards[subId] = cardId
+	}
+	sort.Ints(subIds)
+	searches := make([]SubscribeSearchReq, 0, len(l.searches))
+	for _, req := range l.searches {
+		searches = append(searches, req)
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].SubId < searches[j].SubId })
+	return subIds, cards, searches
+}
+
+// Resumes a login on a new socket, re-subscribing to its cards and searches. Returns nil if it can't be resumed.
+func resume(req *ResumeReq, sock sockjs.Session) *Connection {
+	l, err := findLogin(req.Token)
+	if err != nil {
+		ErrorRsp{Msg: fmt.Sprintf("unable to resume session: %s", err)}.Send(sock)
+		return nil
+	}
+	user, err := FindUser(l.orgId, l.userId)
+	if err == nil && isDisabled(user) {
+		err = ErrorDisabled
+	}
+	if err != nil {
+		ErrorRsp{Msg: fmt.Sprintf("unable to resume session: %s", err)}.Send(sock)
+		return nil
+	}
+	conn := newConnection(user, l, sock)
+
+	rsp := ResumeRsp{
+		OrgId:   l.orgId,
+		UserId:  user.Id,
+		ConnId:  conn.Id(),
+		Units:   l.units.String(),
+		Token:   l.token,
+		Expires: l.expires,
+	}
+	subIds, cards, searches := l.subscriptions()
+	rsp.Cards = subIds
+	for _, req := range searches {
+		rsp.Searches = append(rsp.Searches, req.SubId)
+	}
+	rsp.Send(sock)
+
+	// Cards and searches send their state as soon as they're subscribed to, so they have to follow the response.
+	for _, subId := range subIds {
+		c, subRsp, err := card.Subscribe(conn.orgId, cards[subId], conn.Id(), conn.user.Id, subId, conn.units, conn.principals, sock)
+		if err != nil {
+			log.Printf("error resubscribing to card %s: %s", cards[subId], err)
+			l.removeCard(subId)
+			ErrorRsp{Msg: fmt.Sprintf("unable to subscribe to card %s: %s", cards[subId], err)}.Send(sock)
+			continue
+		}
+		conn.cardSubs[subId] = c
+		subRsp.Send(sock)
+	}
+	for _, req := range searches {
+		s, err := search.Subscribe(conn.orgId, req, conn.Id(), conn.principals, sock)
+		if err != nil {
+			l.removeSearch(req.SubId)
+			ErrorRsp{Msg: fmt.Sprintf("unable to subscribe to search: %s", req.Query)}.Send(sock)
+			continue
+		}
+		conn.searchSubs[req.SubId] = s
+	}
+	return conn
+}
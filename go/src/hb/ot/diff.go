@@ -0,0 +1,42 @@
+package ot
+
+import (
+	"unicode/utf8"
+)
+
+// Diff returns an operation sequence that turns a into b. It retains their common prefix and suffix, and replaces
+// whatever lies between them. The result is not minimal, but it never splits a UTF-8 sequence.
+func Diff(a, b string) Ops {
+	// Find the common prefix, backing up to the start of a rune.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	for pre > 0 && pre < len(a) && !utf8.RuneStart(a[pre]) {
+		pre--
+	}
+
+	// Find the common suffix, not overlapping the prefix, and ending at the start of a rune.
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	for suf > 0 && !utf8.RuneStart(a[len(a)-suf]) {
+		suf--
+	}
+
+	var ops Ops
+	if pre > 0 {
+		ops = append(ops, Op{N: pre})
+	}
+	if del := len(a) - pre - suf; del > 0 {
+		ops = append(ops, Op{N: -del})
+	}
+	if ins := b[pre : len(b)-suf]; ins != "" {
+		ops = append(ops, Op{S: ins})
+	}
+	if suf > 0 {
+		ops = append(ops, Op{N: suf})
+	}
+	return ops
+}
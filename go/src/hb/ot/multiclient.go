@@ -0,0 +1,106 @@
+package ot
+
+import (
+	"fmt"
+)
+
+// MultiClient is a client document made of named properties that share a single revision number, such as a card.
+// It runs the same state machine as Client, but separately for each property, so that edits to one property never
+// wait on the acknowledgement of another's.
+//
+// This mirrors the bookkeeping done by the TypeScript Card.
+type MultiClient struct {
+	Docs map[string]*Doc // the properties' documents
+	Rev  int             // last known revision, across all properties
+	Wait map[string]Ops  // pending ops per property; present while awaiting an ack, even if empty
+	Buf  map[string]Ops  // buffered ops per property; present while ops are buffered, even if empty
+	// Send is called when a new revision of a property can be sent to the server.
+	Send func(rev int, prop string, ops Ops)
+}
+
+// NewMultiClient creates a MultiClient for properties with the given values as of revision rev.
+func NewMultiClient(rev int, props map[string]string, send func(rev int, prop string, ops Ops)) *MultiClient {
+	c := &MultiClient{
+		Docs: make(map[string]*Doc),
+		Rev:  rev,
+		Wait: make(map[string]Ops),
+		Buf:  make(map[string]Ops),
+		Send: send,
+	}
+	for prop, value := range props {
+		c.Docs[prop] = NewDoc(value)
+	}
+	return c
+}
+
+// Doc returns a property's document, creating an empty one if absent.
+func (c *MultiClient) Doc(prop string) *Doc {
+	doc, exists := c.Docs[prop]
+	if !exists {
+		doc = NewDoc("")
+		c.Docs[prop] = doc
+	}
+	return doc
+}
+
+// Apply applies ops to a property and buffers or sends the server update.
+// An error is returned if the ops could not be applied.
+func (c *MultiClient) Apply(prop string, ops Ops) error {
+	var err error
+	if err = c.Doc(prop).Apply(ops); err != nil {
+		return err
+	}
+	_, waiting := c.Wait[prop]
+	buf, buffered := c.Buf[prop]
+	switch {
+	case buffered && len(buf) > 0:
+		if c.Buf[prop], err = Compose(buf, ops); err != nil {
+			return err
+		}
+	case waiting:
+		c.Buf[prop] = ops
+	default:
+		c.Wait[prop] = ops
+		c.Send(c.Rev, prop, ops)
+	}
+	return nil
+}
+
+// Ack acknowledges a property's pending server update and sends its buffered updates if any.
+// An error is returned if no update is pending for the property.
+func (c *MultiClient) Ack(prop string) error {
+	if _, waiting := c.Wait[prop]; !waiting {
+		return fmt.Errorf("no pending operation for %s", prop)
+	}
+	c.Rev++
+	if buf, buffered := c.Buf[prop]; buffered {
+		c.Wait[prop] = buf
+		delete(c.Buf, prop)
+		c.Send(c.Rev, prop, buf)
+	} else {
+		delete(c.Wait, prop)
+	}
+	return nil
+}
+
+// Recv receives a server update to a property, originating from another participant.
+// An error is returned if the server update could not be applied.
+func (c *MultiClient) Recv(prop string, ops Ops) error {
+	var err error
+	// Transform returns nothing if either side is empty, so skip empty pending ops.
+	if wait := c.Wait[prop]; len(ops) > 0 && len(wait) > 0 {
+		if ops, c.Wait[prop], err = Transform(ops, wait); err != nil {
+			return err
+		}
+	}
+	if buf := c.Buf[prop]; len(ops) > 0 && len(buf) > 0 {
+		if ops, c.Buf[prop], err = Transform(ops, buf); err != nil {
+			return err
+		}
+	}
+	if err = c.Doc(prop).Apply(ops); err != nil {
+		return err
+	}
+	c.Rev++
+	return nil
+}
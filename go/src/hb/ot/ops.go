@@ -322,3 +322,99 @@ func Transform(a, b Ops) (a1, b1 Ops, err error) {
 	a1, b1 = Merge(a1), Merge(b1)
 	return
 }
+
+// Invert returns an operation sequence that undoes ops, given the document they were applied to.
+// An error is returned if ops don't fit the document.
+func Invert(ops Ops, doc Doc) (Ops, error) {
+	ret, del, _ := ops.Count()
+	if ret+del != len(doc) {
+		return nil, fmt.Errorf("Invert requires the document ops were applied to %d != %d", ret+del, len(doc))
+	}
+	inv := make(Ops, 0, len(ops))
+	i := 0
+	for _, op := range ops {
+		switch {
+		case op.N > 0:
+			inv = append(inv, Op{N: op.N})
+			i += op.N
+		case op.N < 0:
+			inv = append(inv, Op{S: string(doc[i : i-op.N])})
+			i -= op.N
+		case op.S != "":
+			inv = append(inv, Op{N: -len(op.S)})
+		}
+	}
+	return Merge(inv), nil
+}
+
+// Bias decides where a position goes when text is inserted exactly at it.
+type Bias int
+
+const (
+	After  Bias = iota // The position moves to after the inserted text, as a cursor does while typing.
+	Before             // The position stays before the inserted text.
+)
+
+// TransformIndex maps a byte position in a document through ops applied to it. Text inserted at the position ends
+// up before it, and a position inside deleted text moves to where the deletion was.
+// An error is returned if the position is outside the document.
+func TransformIndex(pos int, ops Ops) (int, error) {
+	return TransformIndexBias(pos, ops, After)
+}
+
+// TransformIndexBias is like TransformIndex, with bias deciding where the position goes relative to text inserted
+// at it.
+func TransformIndexBias(pos int, ops Ops, bias Bias) (int, error) {
+	ret, del, _ := ops.Count()
+	if pos < 0 || (len(ops) > 0 && pos > ret+del) {
+		return 0, fmt.Errorf("TransformIndex requires a position in the document %d > %d", pos, ret+del)
+	}
+	i, out := 0, pos // i is the offset into the original document
+	for _, op := range ops {
+		switch {
+		case op.N > 0:
+			i += op.N
+		case op.N < 0:
+			if i < pos {
+				out -= min(-op.N, pos-i)
+			}
+			i -= op.N
+		case op.S != "":
+			if i < pos || i == pos && bias == After {
+				out += len(op.S)
+			}
+		}
+		if i > pos {
+			break
+		}
+	}
+	return out, nil
+}
+
+// Range is a span of a document, from byte Start up to byte End.
+type Range struct {
+	Start int
+	End   int
+}
+
+// TransformRange maps a range through ops applied to its document, with start and end deciding where each end goes
+// relative to text inserted at it: (Before, After) takes text inserted at either end into the range, (After, Before)
+// keeps it out. A range that would be inverted, as when text is inserted into an empty range that keeps it out, is
+// collapsed to its start. A range whose text is all deleted collapses to where the deletion was.
+func TransformRange(r Range, ops Ops, start, end Bias) (Range, error) {
+	if r.End < r.Start {
+		return r, fmt.Errorf("TransformRange requires a range that isn't inverted %d > %d", r.Start, r.End)
+	}
+	var out Range
+	var err error
+	if out.Start, err = TransformIndexBias(r.Start, ops, start); err != nil {
+		return r, err
+	}
+	if out.End, err = TransformIndexBias(r.End, ops, end); err != nil {
+		return r, err
+	}
+	if out.End < out.Start {
+		out.End = out.Start
+	}
+	return out, nil
+}
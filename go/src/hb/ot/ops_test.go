@@ -153,3 +153,130 @@ func TestOpsTransform(t *testing.T) {
 		}
 	}
 }
+
+var diffTests = []struct {
+	a, b string
+	ops  Ops
+}{
+	{a: "", b: "", ops: nil},
+	{a: "abc", b: "abc", ops: Ops{{N: 3}}},
+	{a: "", b: "abc", ops: Ops{{S: "abc"}}},
+	{a: "abc", b: "", ops: Ops{{N: -3}}},
+	{a: "abcd", b: "aXd", ops: Ops{{N: 1}, {N: -2}, {S: "X"}, {N: 1}}},
+	{a: "aaa", b: "aaaa", ops: Ops{{N: 3}, {S: "a"}}},
+	{a: "héllo", b: "hèllo", ops: Ops{{N: 1}, {N: -2}, {S: "è"}, {N: 3}}},
+}
+
+func TestDiff(t *testing.T) {
+	for _, c := range diffTests {
+		ops := Diff(c.a, c.b)
+		if !ops.Equal(c.ops) {
+			t.Errorf("%q -> %q: expected %v got %v", c.a, c.b, c.ops, ops)
+		}
+		doc := Doc(c.a)
+		if err := doc.Apply(ops); err != nil || string(doc) != c.b {
+			t.Errorf("%q -> %q: applying %v gave %q (%v)", c.a, c.b, ops, doc, err)
+		}
+	}
+}
+
+var invertTests = []struct {
+	doc string
+	ops Ops
+}{
+	{doc: "abc", ops: Ops{{N: 3}}},
+	{doc: "", ops: Ops{{S: "abc"}}},
+	{doc: "abc", ops: Ops{{N: -3}}},
+	{doc: "abcd", ops: Ops{{N: 1}, {N: -2}, {S: "X"}, {N: 1}}},
+	{doc: "héllo", ops: Ops{{S: "oh "}, {N: 1}, {N: -2}, {S: "è"}, {N: 3}}},
+}
+
+func TestInvert(t *testing.T) {
+	for _, c := range invertTests {
+		inv, err := Invert(c.ops, Doc(c.doc))
+		if err != nil {
+			t.Errorf("%q %v: %s", c.doc, c.ops, err)
+			continue
+		}
+		doc := Doc(c.doc)
+		if err := doc.Apply(c.ops); err != nil {
+			t.Error(err)
+		}
+		if err := doc.Apply(inv); err != nil || string(doc) != c.doc {
+			t.Errorf("%q %v: applying inverse %v gave %q (%v)", c.doc, c.ops, inv, doc, err)
+		}
+	}
+	if _, err := Invert(Ops{{N: 2}}, Doc("abc")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+var transformIndexTests = []struct {
+	pos    int
+	ops    Ops
+	before int // with Before bias
+	after  int // with After bias
+}{
+	{pos: 2, ops: nil, before: 2, after: 2},
+	{pos: 2, ops: Ops{{N: 5}}, before: 2, after: 2},
+	{pos: 2, ops: Ops{{S: "ab"}, {N: 5}}, before: 4, after: 4},
+	{pos: 2, ops: Ops{{N: 2}, {S: "ab"}, {N: 3}}, before: 2, after: 4},
+	{pos: 2, ops: Ops{{N: 3}, {S: "ab"}, {N: 2}}, before: 2, after: 2},
+	{pos: 0, ops: Ops{{S: "ab"}, {N: 5}}, before: 0, after: 2},
+	{pos: 5, ops: Ops{{N: 5}, {S: "ab"}}, before: 5, after: 7},
+	{pos: 4, ops: Ops{{N: -2}, {N: 3}}, before: 2, after: 2},
+	{pos: 2, ops: Ops{{N: 1}, {N: -3}, {N: 1}}, before: 1, after: 1},
+	{pos: 2, ops: Ops{{N: 1}, {N: -3}, {S: "xy"}, {N: 1}}, before: 1, after: 1},
+	{pos: 2, ops: Ops{{N: -2}, {S: "xy"}, {N: 3}}, before: 0, after: 2},
+}
+
+func TestTransformIndex(t *testing.T) {
+	for _, c := range transformIndexTests {
+		if pos, err := TransformIndexBias(c.pos, c.ops, Before); err != nil || pos != c.before {
+			t.Errorf("%d %v before: expected %d got %d (%v)", c.pos, c.ops, c.before, pos, err)
+		}
+		if pos, err := TransformIndexBias(c.pos, c.ops, After); err != nil || pos != c.after {
+			t.Errorf("%d %v after: expected %d got %d (%v)", c.pos, c.ops, c.after, pos, err)
+		}
+		if pos, err := TransformIndex(c.pos, c.ops); err != nil || pos != c.after {
+			t.Errorf("%d %v: expected %d got %d (%v)", c.pos, c.ops, c.after, pos, err)
+		}
+	}
+	if _, err := TransformIndex(6, Ops{{N: 5}}); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := TransformIndex(-1, Ops{{N: 5}}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+var transformRangeTests = []struct {
+	r          Range
+	ops        Ops
+	start, end Bias
+	out        Range
+}{
+	// Text inserted at the ends is kept out, or taken in.
+	{r: Range{2, 4}, ops: Ops{{N: 2}, {S: "x"}, {N: 2}, {S: "y"}, {N: 1}}, start: After, end: Before, out: Range{3, 5}},
+	{r: Range{2, 4}, ops: Ops{{N: 2}, {S: "x"}, {N: 2}, {S: "y"}, {N: 1}}, start: Before, end: After, out: Range{2, 6}},
+	// Text inserted inside always grows it.
+	{r: Range{2, 4}, ops: Ops{{N: 3}, {S: "xyz"}, {N: 2}}, start: After, end: Before, out: Range{2, 7}},
+	// Deleting part of it shrinks it, and deleting all of it collapses it.
+	{r: Range{2, 4}, ops: Ops{{N: 3}, {N: -2}}, start: After, end: Before, out: Range{2, 3}},
+	{r: Range{2, 4}, ops: Ops{{N: 1}, {N: -4}}, start: After, end: Before, out: Range{1, 1}},
+	// An empty range that keeps inserted text out collapses to its start.
+	{r: Range{2, 2}, ops: Ops{{N: 2}, {S: "x"}, {N: 3}}, start: After, end: Before, out: Range{3, 3}},
+	{r: Range{2, 2}, ops: Ops{{N: 2}, {S: "x"}, {N: 3}}, start: Before, end: After, out: Range{2, 3}},
+}
+
+func TestTransformRange(t *testing.T) {
+	for _, c := range transformRangeTests {
+		out, err := TransformRange(c.r, c.ops, c.start, c.end)
+		if err != nil || out != c.out {
+			t.Errorf("%v %v: expected %v got %v (%v)", c.r, c.ops, c.out, out, err)
+		}
+	}
+	if _, err := TransformRange(Range{3, 2}, Ops{{N: 5}}, After, Before); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -112,3 +112,73 @@ func TestClient(t *testing.T) {
 		t.Error("expected flushed")
 	}
 }
+
+func TestMultiClient(t *testing.T) {
+	type sent struct {
+		rev  int
+		prop string
+		ops  Ops
+	}
+	var sends []sent
+	c := NewMultiClient(3, map[string]string{"title": "old!", "body": "abc"}, func(rev int, prop string, ops Ops) {
+		sends = append(sends, sent{rev, prop, ops})
+	})
+
+	// Edits to different props are sent independently.
+	a := Ops{{S: "g"}, {N: 4}}
+	if err := c.Apply("title", a); err != nil {
+		t.Error(err)
+	}
+	b := Ops{{N: 3}, {S: "d"}}
+	if err := c.Apply("body", b); err != nil {
+		t.Error(err)
+	}
+	if len(sends) != 2 || sends[0].rev != 3 || sends[1].rev != 3 || sends[1].prop != "body" || !b.Equal(sends[1].ops) {
+		t.Errorf("expected both props sent at rev 3, got %v", sends)
+	}
+
+	// Further edits to a waiting prop are buffered.
+	if err := c.Apply("title", Ops{{N: 2}, {N: -2}, {N: 1}}); err != nil {
+		t.Error(err)
+	}
+	if len(sends) != 2 || !c.Buf["title"].Equal(Ops{{N: 2}, {N: -2}, {N: 1}}) {
+		t.Error("expected buffering")
+	}
+
+	// Remote changes transform pending and buffered ops.
+	if err := c.Recv("title", Ops{{N: 1}, {S: " is"}, {N: 3}}); err != nil {
+		t.Error(err)
+	}
+	if s := c.Docs["title"].String(); s != "go is!" {
+		t.Errorf(`expected "go is!" got %q`, s)
+	}
+	if c.Rev != 4 {
+		t.Errorf("expected rev 4 got %d", c.Rev)
+	}
+
+	// Acking body leaves title waiting.
+	if err := c.Ack("body"); err != nil {
+		t.Error(err)
+	}
+	if _, waiting := c.Wait["body"]; waiting || c.Wait["title"] == nil || len(sends) != 2 {
+		t.Error("expected body acked and title still waiting")
+	}
+
+	// Acking title sends its buffer at the new revision.
+	if err := c.Ack("title"); err != nil {
+		t.Error(err)
+	}
+	buf := Ops{{N: 5}, {N: -2}, {N: 1}}
+	if len(sends) != 3 || sends[2].rev != 6 || sends[2].prop != "title" || !buf.Equal(sends[2].ops) {
+		t.Errorf("expected buffer sent at rev 6, got %v", sends)
+	}
+	if err := c.Ack("title"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Ack("title"); err == nil {
+		t.Error("expected error acking with nothing pending")
+	}
+	if c.Rev != 7 || c.Docs["title"].String() != "go is!" || c.Docs["body"].String() != "abcd" {
+		t.Errorf("unexpected final state rev %d %q %q", c.Rev, c.Docs["title"], c.Docs["body"])
+	}
+}
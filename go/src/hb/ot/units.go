@@ -0,0 +1,151 @@
+package ot
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Unit is what an Op's N counts. Docs and Ops are always stored in bytes, but clients may count in whatever unit
+// their strings are indexed by, and have their ops converted on the way in and out.
+type Unit int
+
+const (
+	Bytes Unit = iota // UTF-8 bytes
+	Runes             // Unicode code points
+	UTF16             // UTF-16 code units, as JavaScript strings are indexed
+)
+
+// ParseUnit parses a unit name, as negotiated by clients. The empty string means Bytes.
+func ParseUnit(name string) (Unit, error) {
+	switch name {
+	case "", "bytes":
+		return Bytes, nil
+	case "runes", "codepoints":
+		return Runes, nil
+	case "utf16":
+		return UTF16, nil
+	}
+	return Bytes, fmt.Errorf("unknown unit: %s", name)
+}
+
+func (unit Unit) String() string {
+	switch unit {
+	case Runes:
+		return "runes"
+	case UTF16:
+		return "utf16"
+	}
+	return "bytes"
+}
+
+// Returns the number of units needed to encode r.
+func (unit Unit) len(r rune) int {
+	switch unit {
+	case Runes:
+		return 1
+	case UTF16:
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	}
+	return utf8.RuneLen(r)
+}
+
+// ToBytes converts ops counted in unit, to be applied to doc, to ops counted in bytes.
+// An error is returned if the ops don't fit the document, or split one of its characters.
+func (doc Doc) ToBytes(ops Ops, unit Unit) (Ops, error) {
+	if unit == Bytes {
+		return ops, nil
+	}
+	out := make(Ops, len(ops))
+	i := 0
+	for j, op := range ops {
+		if op.N == 0 {
+			out[j] = op
+			continue
+		}
+		n, start := op.N, i
+		if n < 0 {
+			n = -n
+		}
+		for n > 0 {
+			if i >= len(doc) {
+				return nil, fmt.Errorf("operation longer than document at %d", start)
+			}
+			r, size := utf8.DecodeRune(doc[i:])
+			n -= unit.len(r)
+			i += size
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("operation splits a character at %d", i)
+		}
+		if op.N > 0 {
+			out[j] = Op{N: i - start}
+		} else {
+			out[j] = Op{N: start - i}
+		}
+	}
+	return out, nil
+}
+
+// FromBytes converts ops counted in bytes, to be applied to doc, to ops counted in unit.
+// An error is returned if the ops don't fit the document, or split one of its characters.
+func (doc Doc) FromBytes(ops Ops, unit Unit) (Ops, error) {
+	if unit == Bytes {
+		return ops, nil
+	}
+	out := make(Ops, len(ops))
+	i := 0
+	for j, op := range ops {
+		if op.N == 0 {
+			out[j] = op
+			continue
+		}
+		n := op.N
+		if n < 0 {
+			n = -n
+		}
+		if i+n > len(doc) {
+			return nil, fmt.Errorf("operation longer than document at %d", i)
+		}
+		if !doc.boundary(i + n) {
+			return nil, fmt.Errorf("operation splits a character at %d", i+n)
+		}
+		count := 0
+		for _, r := range string(doc[i : i+n]) {
+			count += unit.len(r)
+		}
+		i += n
+		if op.N > 0 {
+			out[j] = Op{N: count}
+		} else {
+			out[j] = Op{N: -count}
+		}
+	}
+	return out, nil
+}
+
+// Reports whether byte offset i falls on a character boundary.
+func (doc Doc) boundary(i int) bool {
+	return i <= 0 || i >= len(doc) || utf8.RuneStart(doc[i])
+}
+
+// Checks that ops, counted in bytes, only retain or delete whole characters of doc and only insert valid UTF-8.
+func (doc Doc) validate(ops Ops) error {
+	i := 0
+	for _, op := range ops {
+		switch {
+		case op.N > 0:
+			i += op.N
+		case op.N < 0:
+			i -= op.N
+		case !utf8.ValidString(op.S):
+			return fmt.Errorf("insert at %d is not valid UTF-8", i)
+		}
+		if !doc.boundary(i) {
+			return fmt.Errorf("operation splits a character at %d", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ot
+
+import (
+	"testing"
+)
+
+func TestDocApplyBoundaries(t *testing.T) {
+	var applyTests = []struct {
+		ops Ops
+		ok  bool
+	}{
+		{Ops{{N: 2}, {S: "é"}, {N: 7}}, true},  // between "h" and "é"
+		{Ops{{N: 3}, {N: -2}, {N: 4}}, false},  // into "é"
+		{Ops{{N: 1}, {N: -3}, {N: 5}}, true},   // delete "hé"
+		{Ops{{N: 5}, {N: -4}}, true},           // delete "😀"
+		{Ops{{N: 7}, {S: "x"}, {N: 2}}, false}, // into "😀"
+		{Ops{{N: 9}, {S: "\xff"}}, false},      // invalid insert
+	}
+	for _, c := range applyTests {
+		doc := Doc("ahé!😀")
+		err := doc.Apply(c.ops)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: expected ok %v, got %v", c.ops, c.ok, err)
+		}
+		if err != nil && string(doc) != "ahé!😀" {
+			t.Errorf("%v: doc modified on error: %q", c.ops, doc)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	for _, name := range []string{"bytes", "runes", "utf16"} {
+		unit, err := ParseUnit(name)
+		if err != nil || unit.String() != name {
+			t.Errorf("expected %s got %s, %v", name, unit, err)
+		}
+	}
+	if unit, err := ParseUnit(""); err != nil || unit != Bytes {
+		t.Errorf("expected bytes by default, got %s, %v", unit, err)
+	}
+	if _, err := ParseUnit("nope"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUnitConversion(t *testing.T) {
+	doc := Doc("ahé!😀z") // a(1) h(1) é(2) !(1) 😀(4) z(1)
+	var convTests = []struct {
+		unit  Unit
+		units Ops
+		bytes Ops
+	}{
+		{Bytes, Ops{{N: 2}, {N: -2}, {N: 6}}, Ops{{N: 2}, {N: -2}, {N: 6}}},
+		{Runes, Ops{{N: 2}, {N: -1}, {S: "e"}, {N: 3}}, Ops{{N: 2}, {N: -2}, {S: "e"}, {N: 6}}},
+		{Runes, Ops{{N: 4}, {N: -1}, {N: 1}}, Ops{{N: 5}, {N: -4}, {N: 1}}},
+		{UTF16, Ops{{N: 4}, {N: -2}, {S: "😀"}, {N: 1}}, Ops{{N: 5}, {N: -4}, {S: "😀"}, {N: 1}}},
+	}
+	for _, c := range convTests {
+		bytes, err := doc.ToBytes(c.units, c.unit)
+		if err != nil || !bytes.Equal(c.bytes) {
+			t.Errorf("%s %v: expected %v got %v, %v", c.unit, c.units, c.bytes, bytes, err)
+		}
+		units, err := doc.FromBytes(c.bytes, c.unit)
+		if err != nil || !units.Equal(c.units) {
+			t.Errorf("%s %v: expected %v got %v, %v", c.unit, c.bytes, c.units, units, err)
+		}
+	}
+
+	if _, err := doc.ToBytes(Ops{{N: 5}, {N: -1}, {N: 1}}, UTF16); err == nil {
+		t.Error("expected error splitting a surrogate pair")
+	}
+	if _, err := doc.ToBytes(Ops{{N: 7}}, Runes); err == nil {
+		t.Error("expected error for ops longer than the doc")
+	}
+	if _, err := doc.FromBytes(Ops{{N: 3}, {N: -1}, {N: 6}}, Runes); err == nil {
+		t.Error("expected error splitting a character")
+	}
+}
@@ -0,0 +1,662 @@
+// Package query parses hb's search query language.
+//
+// Queries are parsed and validated here, into expression trees that each store translates for itself: the Solr
+// store compiles them to Solr syntax, quoting every value, and the disk store evaluates them directly. Clients
+// never send store syntax. The language is:
+//
+//	query = [expr] ["sort" name ["asc" | "desc"]]
+//	expr  = and {"or" and}
+//	and   = not {["and"] not}
+//	not   = ("not" | "-") not | "(" expr ")" | "refs" ref | name op value | name "in" value ".." value | value
+//	op    = ":" | "=" | "!=" | "<" | "<=" | ">" | ">="
+//	value = word | string | ref
+//	ref   = "@" card id
+//
+// A bare value matches cards with a prop that contains its words, in order, ignoring case; name:value does the same
+// for the named prop. name=value matches cards whose named prop has the value, as interpreted by the prop's type
+// (see package schema): text matches as a whole, ignoring case, and lists match if they hold the value. Numbers and
+// dates can also be compared, and matched against a range of values. refs @id matches cards with a card ref prop
+// holding the id. The names "id", "created" and "modified" stand for each card's id, creation time and last
+// modification time.
+//
+// Words are runs of anything but whitespace, quotes, parentheses and the operators above. Strings are
+// double-quoted, and may contain anything, with quotes and backslashes escaped by backslashes; quote values like
+// times, which contain colons. Keywords ignore case; quote them to search for them.
+package query
+
+import (
+	"fmt"
+	"hb/schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names that stand for a card's id, and creation and modification times, rather than its props.
+const (
+	IdName       = "id"
+	CreatedName  = "created"
+	ModifiedName = "modified"
+)
+
+// A parsed query. Sort is nil if the query doesn't ask for an order.
+type Query struct {
+	Where Expr
+	Sort  *Sort
+}
+
+type Sort struct {
+	Prop string
+	Type schema.Type
+	Desc bool
+}
+
+// Expr is one of the types below. Each formats as the query text it's parsed from, in a canonical form.
+type Expr interface {
+	expr()
+	String() string
+}
+
+// Matches every card.
+type All struct{}
+
+type And struct {
+	Exprs []Expr
+}
+
+type Or struct {
+	Exprs []Expr
+}
+
+type Not struct {
+	Expr Expr
+}
+
+// Matches cards whose Prop, or any prop if Prop is empty, contains Words in order. Words are lower-cased.
+type Contains struct {
+	Prop  string
+	Words []string
+}
+
+// Matches cards whose Prop has Value, interpreted as Type. Numbers and dates are in canonical form.
+type Equals struct {
+	Prop  string
+	Type  schema.Type
+	Value string
+}
+
+// Matches cards whose Prop, a Number or Date, falls between Min and Max. Either may be nil, for no bound.
+type Range struct {
+	Prop     string
+	Type     schema.Type
+	Min, Max *Bound
+}
+
+type Bound struct {
+	Value     string
+	Inclusive bool
+}
+
+// Matches cards with a CardRef prop holding CardId.
+type Refs struct {
+	CardId string
+}
+
+func (All) expr()      {}
+func (And) expr()      {}
+func (Or) expr()       {}
+func (Not) expr()      {}
+func (Contains) expr() {}
+func (Equals) expr()   {}
+func (Range) expr()    {}
+func (Refs) expr()     {}
+
+func (q *Query) String() string {
+	if q.Sort == nil {
+		return q.Where.String()
+	}
+	return strings.TrimPrefix(q.Where.String()+" sort "+q.Sort.String(), " ")
+}
+
+func (s *Sort) String() string {
+	if s.Desc {
+		return s.Prop + " desc"
+	}
+	return s.Prop + " asc"
+}
+
+func (All) String() string {
+	return ""
+}
+
+func (e And) String() string {
+	return "(" + joinExprs(e.Exprs, " and ") + ")"
+}
+
+func (e Or) String() string {
+	return "(" + joinExprs(e.Exprs, " or ") + ")"
+}
+
+func (e Not) String() string {
+	return "not " + e.Expr.String()
+}
+
+func (e Contains) String() string {
+	words := quote(strings.Join(e.Words, " "))
+	if e.Prop == "" {
+		return words
+	}
+	return e.Prop + ":" + words
+}
+
+func (e Equals) String() string {
+	return e.Prop + " = " + quote(e.Value)
+}
+
+func (e Range) String() string {
+	switch {
+	case e.Min != nil && e.Max != nil && e.Min.Inclusive && e.Max.Inclusive:
+		return e.Prop + " in " + quote(e.Min.Value) + ".." + quote(e.Max.Value)
+	case e.Min != nil && e.Max != nil:
+		return "(" + Range{Prop: e.Prop, Min: e.Min}.String() + " and " + Range{Prop: e.Prop, Max: e.Max}.String() + ")"
+	case e.Min != nil && e.Min.Inclusive:
+		return e.Prop + " >= " + quote(e.Min.Value)
+	case e.Min != nil:
+		return e.Prop + " > " + quote(e.Min.Value)
+	case e.Max != nil && e.Max.Inclusive:
+		return e.Prop + " <= " + quote(e.Max.Value)
+	case e.Max != nil:
+		return e.Prop + " < " + quote(e.Max.Value)
+	}
+	return ""
+}
+
+func (e Refs) String() string {
+	return "refs @" + e.CardId
+}
+
+func joinExprs(exprs []Expr, op string) string {
+	strs := make([]string, len(exprs))
+	for i, e := range exprs {
+		strs[i] = e.String()
+	}
+	return strings.Join(strs, op)
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Gets the type of a name in a query: that of the prop, or of the card's id or creation or modification time.
+func TypeOf(name string) schema.Type {
+	switch name {
+	case IdName:
+		return schema.CardRef
+	case CreatedName, ModifiedName:
+		return schema.Date
+	}
+	return schema.TypeOf(name)
+}
+
+// Gets the index field that holds a typed prop, as indexed by schema.IndexFields. Text is found whole, and sorted,
+// by its sort field.
+func Field(name string, t schema.Type) string {
+	if name == IdName || name == CreatedName || name == ModifiedName {
+		return name
+	}
+	switch t {
+	case schema.Bool:
+		return schema.BoolPrefix + name
+	case schema.Number:
+		return schema.NumPrefix + name
+	case schema.Date:
+		return schema.DatePrefix + name
+	case schema.Enum, schema.CardRef:
+		return schema.KeyPrefix + name
+	case schema.List:
+		return schema.KeysPrefix + name
+	}
+	return schema.SortPrefix + name
+}
+
+// Splits text into lower-cased words, as Contains matches them.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 0x80)
+	})
+}
+
+// Parses and validates a query.
+func Parse(q string) (*Query, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	query := &Query{Where: All{}}
+	if !p.at(tokEOF) && !p.atKeyword("sort") {
+		if query.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.atKeyword("sort") {
+		p.next()
+		if query.Sort, err = p.sort(); err != nil {
+			return nil, err
+		}
+	}
+	if !p.at(tokEOF) {
+		return nil, p.errorf("unexpected %s", p.peek())
+	}
+	return query, nil
+}
+
+// Parses a sort on its own, as it follows "sort" in a query.
+func ParseSort(s string) (*Sort, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	sort, err := p.sort()
+	if err != nil {
+		return nil, err
+	}
+	if !p.at(tokEOF) {
+		return nil, p.errorf("unexpected %s", p.peek())
+	}
+	return sort, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) at(kind tokenKind) bool {
+	return p.peek().kind == kind
+}
+
+func (p *parser) atKeyword(keyword string) bool {
+	return p.peek().isKeyword(keyword)
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query error at %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) or() (Expr, error) {
+	var exprs []Expr
+	for {
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.atKeyword("or") {
+			break
+		}
+		p.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return Or{exprs}, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	var exprs []Expr
+	for {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if p.atKeyword("and") {
+			p.next()
+		} else if p.at(tokEOF) || p.at(tokRParen) || p.atKeyword("or") || p.atKeyword("sort") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return And{exprs}, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	switch {
+	case p.atKeyword("not") || p.at(tokMinus):
+		p.next()
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return Not{e}, nil
+
+	case p.at(tokLParen):
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.at(tokRParen) {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return e, nil
+
+	case p.atKeyword("refs") && p.peekAt(1).kind == tokRef:
+		p.next()
+		return Refs{p.next().text}, nil
+
+	case p.at(tokWord) && p.peekAt(1).kind == tokOp:
+		return p.compare()
+
+	case p.at(tokWord) && p.peekAt(1).isKeyword("in"):
+		return p.inRange()
+	}
+
+	t := p.peek()
+	switch t.kind {
+	case tokWord, tokString:
+		p.next()
+		return contains("", t.text)
+	case tokRef:
+		return nil, p.errorf("expected refs before @%s", t.text)
+	}
+	return nil, p.errorf("unexpected %s", t)
+}
+
+func contains(name, text string) (Expr, error) {
+	words := Words(text)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("query error: no words to search for in %q", text)
+	}
+	return Contains{Prop: name, Words: words}, nil
+}
+
+func (p *parser) compare() (Expr, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next().text
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if op == ":" {
+		if name == IdName || name == CreatedName || name == ModifiedName {
+			return nil, fmt.Errorf("query error: can't search %s for words", name)
+		}
+		if value.kind == tokRef {
+			return nil, p.errorf("can't search %s for a card ref", name)
+		}
+		return contains(name, value.text)
+	}
+
+	t := TypeOf(name)
+	if op == "=" || op == "!=" {
+		v, err := canonical(name, t, value)
+		if err != nil {
+			return nil, err
+		}
+		var e Expr = Equals{Prop: name, Type: t, Value: v}
+		if op == "!=" {
+			e = Not{e}
+		}
+		return e, nil
+	}
+	bound, err := p.bound(name, t, value, op == "<=" || op == ">=")
+	if err != nil {
+		return nil, err
+	}
+	if op[0] == '<' {
+		return Range{Prop: name, Type: t, Max: bound}, nil
+	}
+	return Range{Prop: name, Type: t, Min: bound}, nil
+}
+
+func (p *parser) inRange() (Expr, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	t := TypeOf(name)
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	min, err := p.bound(name, t, value, true)
+	if err != nil {
+		return nil, err
+	}
+	if !p.at(tokDots) {
+		return nil, p.errorf("expected ..")
+	}
+	p.next()
+	if value, err = p.value(); err != nil {
+		return nil, err
+	}
+	max, err := p.bound(name, t, value, true)
+	if err != nil {
+		return nil, err
+	}
+	return Range{Prop: name, Type: t, Min: min, Max: max}, nil
+}
+
+func (p *parser) bound(name string, t schema.Type, value token, inclusive bool) (*Bound, error) {
+	if t != schema.Number && t != schema.Date {
+		return nil, fmt.Errorf("query error: can't compare %s, which is %s", name, t)
+	}
+	v, err := canonical(name, t, value)
+	if err != nil {
+		return nil, err
+	}
+	return &Bound{Value: v, Inclusive: inclusive}, nil
+}
+
+// Names are made of letters, digits and underscores, so that they're safe to use in index field names.
+func (p *parser) name() (string, error) {
+	name := p.peek().text
+	for _, r := range name {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return "", p.errorf("invalid name %q", name)
+		}
+	}
+	p.next()
+	return name, nil
+}
+
+func (p *parser) value() (token, error) {
+	if p.at(tokMinus) && p.peekAt(1).kind == tokWord {
+		p.next()
+		t := p.next()
+		t.text = "-" + t.text
+		return t, nil
+	}
+	switch p.peek().kind {
+	case tokWord, tokString, tokRef:
+		return p.next(), nil
+	}
+	return token{}, p.errorf("expected a value")
+}
+
+// Checks that a value suits a name's type, putting numbers and dates in canonical form.
+func canonical(name string, t schema.Type, value token) (string, error) {
+	if value.kind == tokRef && t != schema.CardRef {
+		return "", fmt.Errorf("query error: %s isn't a card ref", name)
+	}
+	v := value.text
+	switch t {
+	case schema.Bool:
+		if v != "true" && v != "false" {
+			return "", fmt.Errorf("query error: expected true or false for %s, got %q", name, v)
+		}
+	case schema.Number:
+		n, err := schema.ParseNumber(v)
+		if err != nil {
+			return "", fmt.Errorf("query error: expected a number for %s, got %q", name, v)
+		}
+		v = strconv.FormatFloat(n, 'g', -1, 64)
+	case schema.Date:
+		d, err := schema.ParseDate(v)
+		if err != nil {
+			return "", fmt.Errorf("query error: expected a date for %s, got %q", name, v)
+		}
+		v = d.UTC().Format(time.RFC3339Nano)
+	case schema.CardRef:
+		if !schema.IsCardId(v) {
+			return "", fmt.Errorf("query error: expected a card id for %s, got %q", name, v)
+		}
+	}
+	return v, nil
+}
+
+func (p *parser) sort() (*Sort, error) {
+	if !p.at(tokWord) {
+		return nil, p.errorf("expected a name to sort by")
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	sort := &Sort{Prop: name, Type: TypeOf(name)}
+	if sort.Type == schema.List {
+		return nil, fmt.Errorf("query error: can't sort by %s, which is a list", name)
+	}
+	if p.atKeyword("desc") {
+		p.next()
+		sort.Desc = true
+	} else if p.atKeyword("asc") {
+		p.next()
+	}
+	return sort, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokRef
+	tokOp
+	tokMinus
+	tokDots
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset into the query
+}
+
+func (t token) isKeyword(keyword string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokRef:
+		return "@" + t.text
+	}
+	return t.text
+}
+
+// Characters that end words.
+const special = " \t\r\n\"():=!<>"
+
+func lex(q string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		start := i
+		switch {
+		case strings.IndexByte(" \t\r\n", c) >= 0:
+			i++
+			continue
+		case c == '(':
+			tokens = append(tokens, token{tokLParen, "(", start})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokRParen, ")", start})
+			i++
+		case c == '-':
+			tokens = append(tokens, token{tokMinus, "-", start})
+			i++
+		case strings.HasPrefix(q[i:], ".."):
+			tokens = append(tokens, token{tokDots, "..", start})
+			i += 2
+		case strings.HasPrefix(q[i:], "!=") || strings.HasPrefix(q[i:], "<=") || strings.HasPrefix(q[i:], ">="):
+			tokens = append(tokens, token{tokOp, q[i : i+2], start})
+			i += 2
+		case strings.IndexByte(":=<>", c) >= 0:
+			tokens = append(tokens, token{tokOp, q[i : i+1], start})
+			i++
+		case c == '!':
+			return nil, fmt.Errorf("query error at %d: expected != ", start)
+		case c == '"':
+			var buf strings.Builder
+			for i++; ; i++ {
+				if i >= len(q) {
+					return nil, fmt.Errorf("query error at %d: unterminated string", start)
+				}
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+				} else if q[i] == '"' {
+					break
+				}
+				buf.WriteByte(q[i])
+			}
+			i++
+			tokens = append(tokens, token{tokString, buf.String(), start})
+		default:
+			kind, end := tokWord, special
+			if c == '@' {
+				// Card ids may end in base64 padding.
+				kind, end = tokRef, " \t\r\n\"()"
+				i++
+			}
+			for i < len(q) && strings.IndexByte(end, q[i]) < 0 && !strings.HasPrefix(q[i:], "..") {
+				i++
+			}
+			text := q[start:i]
+			if kind == tokRef {
+				text = text[1:]
+				if !schema.IsCardId(text) {
+					return nil, fmt.Errorf("query error at %d: expected a card id after @", start)
+				}
+			}
+			tokens = append(tokens, token{kind, text, start})
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(q)}), nil
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"hb/schema"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	schema.Declare("querytest",
+		&schema.Prop{Name: "n", Type: schema.Number},
+		&schema.Prop{Name: "tags", Type: schema.List},
+	)
+}
+
+func TestParse(t *testing.T) {
+	var parseTests = []struct {
+		q     string
+		where Expr
+	}{
+		{"", All{}},
+		{"  milk ", Contains{Words: []string{"milk"}}},
+		{`"Whole, milk"`, Contains{Words: []string{"whole", "milk"}}},
+		{"milk eggs", And{[]Expr{Contains{Words: []string{"milk"}}, Contains{Words: []string{"eggs"}}}}},
+		{"milk AND eggs or -bread", Or{[]Expr{
+			And{[]Expr{Contains{Words: []string{"milk"}}, Contains{Words: []string{"eggs"}}}},
+			Not{Contains{Words: []string{"bread"}}},
+		}}},
+		{"not (milk or eggs)", Not{Or{[]Expr{Contains{Words: []string{"milk"}}, Contains{Words: []string{"eggs"}}}}}},
+		{"title:Milk", Contains{Prop: "title", Words: []string{"milk"}}},
+		{"title = Milk", Equals{Prop: "title", Type: schema.Text, Value: "Milk"}},
+		{`title = "a \"b\" \\c"`, Equals{Prop: "title", Type: schema.Text, Value: `a "b" \c`}},
+		{"done != true", Not{Equals{Prop: "done", Type: schema.Bool, Value: "true"}}},
+		{"target = @RonRV3aj-_=", Equals{Prop: "target", Type: schema.CardRef, Value: "RonRV3aj-_="}},
+		{"id = abc", Equals{Prop: "id", Type: schema.CardRef, Value: "abc"}},
+		{"refs @abc", Refs{"abc"}},
+		{"modified >= 2014-03-01", Range{Prop: "modified", Type: schema.Date,
+			Min: &Bound{"2014-03-01T00:00:00Z", true}}},
+		{`modified < "2014-03-01T12:00:00-08:00"`, Range{Prop: "modified", Type: schema.Date,
+			Max: &Bound{"2014-03-01T20:00:00Z", false}}},
+		{"n in -1..1e3", Range{Prop: "n", Type: schema.Number, Min: &Bound{"-1", true}, Max: &Bound{"1000", true}}},
+		{"n>0.50", Range{Prop: "n", Type: schema.Number, Min: &Bound{"0.5", false}}},
+		{"tags = x", Equals{Prop: "tags", Type: schema.List, Value: "x"}},
+		{`"and" "sort"`, And{[]Expr{Contains{Words: []string{"and"}}, Contains{Words: []string{"sort"}}}}},
+	}
+	for _, c := range parseTests {
+		q, err := Parse(c.q)
+		if err != nil {
+			t.Errorf("%s: %s", c.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Where, c.where) {
+			t.Errorf("%s: expected %#v, got %#v", c.q, c.where, q.Where)
+		}
+		if q.Sort != nil {
+			t.Errorf("%s: expected no sort, got %v", c.q, q.Sort)
+		}
+
+		// Queries format canonically, as text that parses the same.
+		if again, err := Parse(q.String()); err != nil || !reflect.DeepEqual(again, q) {
+			t.Errorf("%s: formatted as %s, which parses as %#v, %v", c.q, q, again, err)
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	var sortTests = []struct {
+		q    string
+		sort Sort
+	}{
+		{"sort title", Sort{Prop: "title", Type: schema.Text}},
+		{"milk SORT modified DESC", Sort{Prop: "modified", Type: schema.Date, Desc: true}},
+		{"sort done asc", Sort{Prop: "done", Type: schema.Bool}},
+		{"sort created desc", Sort{Prop: "created", Type: schema.Date, Desc: true}},
+	}
+	for _, c := range sortTests {
+		q, err := Parse(c.q)
+		if err != nil {
+			t.Errorf("%s: %s", c.q, err)
+		} else if q.Sort == nil || *q.Sort != c.sort {
+			t.Errorf("%s: expected %v, got %v", c.q, c.sort, q.Sort)
+		}
+		if sort, err := ParseSort(c.sort.String()); err != nil || *sort != c.sort {
+			t.Errorf("%s: expected %s to parse as %v, got %v, %v", c.q, c.sort.String(), c.sort, sort, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, q := range []string{
+		"(milk",
+		"milk)",
+		`"milk`,
+		"!",
+		"*",
+		"title =",
+		"target = @",
+		`target = "not a card"`,
+		"@abc",
+		"title:@abc",
+		"id:abc",
+		"done = yes",
+		"n = one",
+		"n < @abc",
+		"title > a",
+		"modified in 2014-01-01",
+		"prop_title* = x",
+		"sort",
+		"sort tags",
+		"sort title desc milk",
+	} {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package schema
+
+import (
+	"strings"
+)
+
+// Prefixes of typed index fields. Every property is also indexed as text, as prop_<name>.
+const (
+	BoolPrefix = "bool_" // Bools.
+	NumPrefix  = "num_"  // Numbers.
+	DatePrefix = "date_" // Dates, as time.Time.
+	KeyPrefix  = "key_"  // Enums and card refs, matched exactly.
+	KeysPrefix = "keys_" // Lists, with one value per item.
+	SortPrefix = "sort_" // Text, lower-cased and truncated, for sorting.
+)
+
+// How much of a text property is indexed for sorting.
+const maxSortLen = 64
+
+// Returns the typed index fields for a card's props. Values that aren't valid for their types are left out.
+func IndexFields(props map[string]string) map[string]interface{} {
+	kind := props[KindProp]
+	fields := make(map[string]interface{})
+	for name, value := range props {
+		if value == "" {
+			continue
+		}
+		switch Lookup(kind, name).Type {
+		case Text, RichText:
+			fields[SortPrefix+name] = SortKey(value)
+		case Bool:
+			if value == "true" || value == "false" {
+				fields[BoolPrefix+name] = value == "true"
+			}
+		case Number:
+			if n, err := ParseNumber(value); err == nil {
+				fields[NumPrefix+name] = n
+			}
+		case Date:
+			if t, err := ParseDate(value); err == nil {
+				fields[DatePrefix+name] = t.UTC()
+			}
+		case Enum, CardRef:
+			fields[KeyPrefix+name] = value
+		case List:
+			if list, err := ParseList(value); err == nil {
+				fields[KeysPrefix+name] = list
+			}
+		}
+	}
+	return fields
+}
+
+// Gets the key that a text property is sorted, and matched as a whole, by.
+func SortKey(value string) string {
+	runes := []rune(strings.ToLower(strings.TrimSpace(value)))
+	if len(runes) > maxSortLen {
+		runes = runes[:maxSortLen]
+	}
+	return string(runes)
+}
@@ -0,0 +1,202 @@
+// Package schema declares the types of card properties.
+//
+// Card properties are always stored and edited as strings, but each kind of card (as given by its "type" property)
+// can declare its properties' types. Values are validated against their declared types when they change, and
+// indexed as typed fields so that they can be range-queried and sorted. Properties that aren't declared are text.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The property that determines a card's kind.
+const KindProp = "type"
+
+type Type string
+
+const (
+	Text     Type = "text"
+	RichText Type = "richtext" // Markdown.
+	Bool     Type = "bool"     // "true" or "false".
+	Number   Type = "number"   // A decimal number.
+	Date     Type = "date"     // An RFC 3339 timestamp, or a yyyy-mm-dd date.
+	Enum     Type = "enum"     // One of the property's declared values.
+	CardRef  Type = "cardref"  // The id of another card.
+	List     Type = "list"     // A JSON array of strings.
+)
+
+// Prop declares a single property's type. The empty string is valid for every type, and means the property
+// isn't set.
+type Prop struct {
+	Name   string
+	Type   Type
+	Values []string // The allowed values of an Enum.
+}
+
+var kinds = struct {
+	sync.RWMutex
+	props map[string]map[string]*Prop // kind -> prop name -> Prop
+}{props: make(map[string]map[string]*Prop)}
+
+func init() {
+	Declare("card",
+		&Prop{Name: "title", Type: Text},
+		&Prop{Name: "body", Type: RichText},
+		&Prop{Name: "kind", Type: Enum, Values: []string{"note", "idea", "effort"}},
+		&Prop{Name: "done", Type: Bool},
+	)
+	Declare("comment",
+		&Prop{Name: "target", Type: CardRef},
+		&Prop{Name: "body", Type: RichText},
+	)
+}
+
+// Declares the properties of a kind of card, replacing any earlier declaration.
+func Declare(kind string, props ...*Prop) {
+	kinds.Lock()
+	defer kinds.Unlock()
+
+	byName := make(map[string]*Prop, len(props))
+	for _, prop := range props {
+		byName[prop.Name] = prop
+	}
+	kinds.props[kind] = byName
+}
+
+// Looks up a property of a kind of card. Undeclared properties, and properties of undeclared kinds, are text.
+func Lookup(kind, name string) *Prop {
+	kinds.RLock()
+	defer kinds.RUnlock()
+
+	if prop, exists := kinds.props[kind][name]; exists {
+		return prop
+	}
+	return &Prop{Name: name, Type: Text}
+}
+
+// Gets the type that kinds declare a property with, if they agree. Properties that no kind declares, or that kinds
+// declare with different types, are text.
+func TypeOf(name string) Type {
+	kinds.RLock()
+	defer kinds.RUnlock()
+
+	var t Type
+	for _, props := range kinds.props {
+		if prop, exists := props[name]; exists {
+			if t != "" && t != prop.Type {
+				return Text
+			}
+			t = prop.Type
+		}
+	}
+	if t == "" {
+		return Text
+	}
+	return t
+}
+
+// Lists the names of the properties that any kind declares with the given type, in order.
+func PropsOfType(t Type) []string {
+	kinds.RLock()
+	defer kinds.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, props := range kinds.props {
+		for name, prop := range props {
+			if prop.Type == t && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checks that value is valid for the property's type.
+func (prop *Prop) Validate(value string) error {
+	if value == "" {
+		return nil
+	}
+	var err error
+	switch prop.Type {
+	case Bool:
+		if value != "true" && value != "false" {
+			err = fmt.Errorf("expected true or false")
+		}
+	case Number:
+		_, err = ParseNumber(value)
+	case Date:
+		_, err = ParseDate(value)
+	case Enum:
+		err = fmt.Errorf("expected one of %s", strings.Join(prop.Values, ", "))
+		for _, v := range prop.Values {
+			if value == v {
+				err = nil
+			}
+		}
+	case CardRef:
+		if !IsCardId(value) {
+			err = fmt.Errorf("expected a card id")
+		}
+	case List:
+		_, err = ParseList(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value for %s %q: %s", prop.Type, prop.Name, value, err)
+	}
+	return nil
+}
+
+// Checks that all of a card's props are valid for its kind.
+func ValidateProps(props map[string]string) error {
+	kind := props[KindProp]
+	for name, value := range props {
+		if err := Lookup(kind, name).Validate(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses the value of a Number property.
+func ParseNumber(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err == nil && (math.IsInf(n, 0) || math.IsNaN(n)) {
+		err = fmt.Errorf("expected a finite number")
+	}
+	return n, err
+}
+
+// Parses the value of a Date property.
+func ParseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Parses the value of a List property.
+func ParseList(value string) ([]string, error) {
+	var list []string
+	err := json.Unmarshal([]byte(value), &list)
+	return list, err
+}
+
+// Reports whether s could be a card id, as CardRef properties hold.
+func IsCardId(s string) bool {
+	return s != "" && strings.IndexFunc(s, isNotIdChar) < 0
+}
+
+// Card ids are url-safe base64.
+func isNotIdChar(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '=')
+}
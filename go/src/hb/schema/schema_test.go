@@ -0,0 +1,84 @@
+package schema
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	Declare("test",
+		&Prop{Name: "n", Type: Number},
+		&Prop{Name: "d", Type: Date},
+		&Prop{Name: "e", Type: Enum, Values: []string{"a", "b"}},
+		&Prop{Name: "l", Type: List},
+		&Prop{Name: "b", Type: Bool},
+		&Prop{Name: "r", Type: CardRef},
+	)
+
+	var validateTests = []struct {
+		prop  string
+		value string
+		ok    bool
+	}{
+		{"n", "", true},
+		{"n", "-1.5e3", true},
+		{"n", "one", false},
+		{"n", "NaN", false},
+		{"d", "2014-03-01", true},
+		{"d", "2014-03-01T12:00:00-08:00", true},
+		{"d", "March 1st", false},
+		{"e", "a", true},
+		{"e", "c", false},
+		{"l", `["x", "y"]`, true},
+		{"l", "x, y", false},
+		{"b", "true", true},
+		{"b", "yes", false},
+		{"r", "RonRV3aj-_=", true},
+		{"r", "not a card", false},
+		{"other", "anything", true},
+	}
+	for _, c := range validateTests {
+		err := Lookup("test", c.prop).Validate(c.value)
+		if (err == nil) != c.ok {
+			t.Errorf("%s %q: expected ok %v, got %v", c.prop, c.value, c.ok, err)
+		}
+	}
+
+	if err := ValidateProps(map[string]string{"type": "card", "kind": "effort", "done": "maybe"}); err == nil {
+		t.Error("expected invalid done to fail")
+	}
+	if err := ValidateProps(map[string]string{"type": "other", "done": "maybe"}); err != nil {
+		t.Errorf("expected undeclared kind to be text, got %s", err)
+	}
+}
+
+func TestIndexFields(t *testing.T) {
+	Declare("test",
+		&Prop{Name: "n", Type: Number},
+		&Prop{Name: "d", Type: Date},
+		&Prop{Name: "l", Type: List},
+	)
+	fields := IndexFields(map[string]string{
+		"type":  "test",
+		"title": "  Buy MILK ",
+		"n":     "42",
+		"d":     "2014-03-01T12:00:00-08:00",
+		"l":     `["x","y"]`,
+		"bad":   "",
+	})
+	if fields["sort_title"] != "buy milk" {
+		t.Errorf("expected sort_title buy milk, got %v", fields["sort_title"])
+	}
+	if fields["num_n"] != 42.0 {
+		t.Errorf("expected num_n 42, got %v", fields["num_n"])
+	}
+	if d, _ := fields["date_d"].(time.Time); !d.Equal(time.Date(2014, 3, 1, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected date_d %v", fields["date_d"])
+	}
+	if l, _ := fields["keys_l"].([]string); len(l) != 2 || l[1] != "y" {
+		t.Errorf("unexpected keys_l %v", fields["keys_l"])
+	}
+	if _, exists := fields["sort_bad"]; exists {
+		t.Error("expected empty props to be left out")
+	}
+}
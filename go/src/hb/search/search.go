@@ -1,165 +1,668 @@
 package search
 
 import (
+	"errors"
+	"fmt"
 	"gopkg.in/igm/sockjs-go.v2/sockjs"
-	"log"
-	"net/url"
 	. "hb/api"
-	"hb/solr"
+	"hb/query"
+	"hb/schema"
+	"hb/store"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Pages of results hold DefaultRows results unless asked for another number, up to MaxRows.
+const (
+	DefaultRows = 50
+	MaxRows     = 500
+)
+
+// How results are sorted unless queries say otherwise: most recently modified first.
+var DefaultSort = &query.Sort{Prop: query.ModifiedName, Type: schema.Date, Desc: true}
+
+// The props that results hold, and hold snippets of, unless subscribers ask for others.
+var (
+	DefaultFields   = []string{"title"}
+	DefaultSnippets = []string{"body"}
+)
+
+// A search whose store could only guess that a card change didn't affect it runs its query again this long after.
+var RecheckInterval = time.Minute
+
+// The org stores that searches are run against. Set by Init().
+var orgs *store.Orgs
+
 var master struct {
-	searches map[string]*Search
+	searches map[string]*Search // searchKey -> Search
 	subs     chan subReq
 	unsubs   chan unsubReq
+	changes  chan change    // cards that were created or saved
+	stopped  chan bool      // closed by Shutdown()
+	running  sync.WaitGroup // the master loop and all search goroutines
 }
 
+var ErrorShutdown = errors.New("search is shut down")
+
 type subReq struct {
-	query    string
+	orgId    string
+	req      SubscribeSearchReq
+	spec     *spec
+	readers  []string
 	connId   string
 	sock     sockjs.Session
 	response chan<- *Search
 }
 
+// What a search finds, and in what order: its request's query, filters and sort, parsed.
+type spec struct {
+	where   query.Expr
+	filters []query.Expr
+	sort    *query.Sort
+}
+
+// A card that was created or saved: its props as last saved before, or nil if it's new, and as they are now.
+type change struct {
+	orgId  string
+	cardId string
+	before map[string]string
+	after  map[string]string
+}
+
 type unsubReq struct {
 	search *Search
+	sub    subscriber
+}
+
+// A connection's subscription to a search, by the subId it picked.
+type subscriber struct {
 	connId string
+	subId  int
+}
+
+// Subscribers are told of a search's results by the query they subscribed with, which may be written differently
+// from the search's own.
+type subscription struct {
+	sock  sockjs.Session
+	query string
 }
 
 func init() {
 	master.searches = make(map[string]*Search)
 	master.subs = make(chan subReq)
 	master.unsubs = make(chan unsubReq)
+	master.changes = make(chan change)
+	master.stopped = make(chan bool)
+	master.running.Add(1)
 	go run()
 }
 
+// Sets the org stores that searches are run against. Must be called before any searches are subscribed.
+func Init(o *store.Orgs) {
+	orgs = o
+}
+
+// Stops all searches, returning once their goroutines have exited. Safe to call more than once.
+func Shutdown() {
+	shutdown.Do(func() {
+		close(master.stopped)
+		master.running.Wait()
+	})
+}
+
+var shutdown sync.Once
+
 // Main search subscription loop. Controls access to Search structs via the un[subs] channels.
 func run() {
+	defer master.running.Done()
 	done := make(chan *Search)
 
 	for {
 		select {
 		case req := <-master.subs:
-			s, exists := master.searches[req.query]
-			if !exists {
-				s = newSearch(req.query, done)
-				master.searches[req.query] = s
-			}
-			s.subs <- req
-			req.response <- s
-			log.Printf("%d searches total", len(master.searches))
+			route(req, done)
 
 		case req := <-master.unsubs:
-			req.search.unsubs <- req
+			unsubscribe(req, done)
+
+		case c := <-master.changes:
+			for _, s := range master.searches {
+				if s.orgId != c.orgId {
+					continue
+				}
+				if affected, certain := s.affectedBy(c); affected {
+					s.change()
+				} else if !certain {
+					s.recheck()
+				}
+			}
 
 		case s := <-done:
-			delete(master.searches, s.query)
+			forget(s)
+
+		case <-master.stopped:
+			return
+		}
+	}
+}
+
+// Hands a subscribe request to the search it's for, starting it if need be. A search that drops itself meanwhile is
+// forgotten, and started again.
+func route(req subReq, done chan *Search) {
+	key := searchKey(req.orgId, req.req, req.spec, req.readers)
+	for {
+		s, exists := master.searches[key]
+		if !exists {
+			st, err := orgs.Get(req.orgId)
+			if err != nil {
+				log.Printf("error opening store for org %s: %s", req.orgId, err)
+				req.response <- nil
+				return
+			}
+			s = newSearch(key, req.orgId, st, req.req, req.spec, req.readers, done)
+			master.searches[key] = s
+		}
+		select {
+		case s.subs <- req:
+			req.response <- s
 			log.Printf("%d searches total", len(master.searches))
+			return
+		case dropped := <-done:
+			forget(dropped)
+		case <-master.stopped:
+			req.response <- nil
+			return
+		}
+	}
+}
+
+// Hands an unsubscribe request to its search, unless it's stopped. Searches that drop themselves meanwhile are
+// forgotten.
+func unsubscribe(req unsubReq, done chan *Search) {
+	for {
+		select {
+		case req.search.unsubs <- req:
+			return
+		case <-req.search.stopped:
+			return
+		case dropped := <-done:
+			forget(dropped)
+		case <-master.stopped:
+			return
 		}
 	}
 }
 
-// Subscribes to a search query.
-func Subscribe(query string, connId string, sock sockjs.Session) (*Search, error) {
+func forget(s *Search) {
+	delete(master.searches, s.key)
+	log.Printf("%d searches total", len(master.searches))
+}
+
+// Subscribes to a page of a search query over an org's cards, on behalf of the given principals: only cards that one
+// of them can read are found. Queries and filters are in hb's query language (see package query), and results are
+// sorted by DefaultSort unless the request or its query say otherwise. See SubscribeSearchReq for what the page
+// holds; a Rows of 0 means DefaultRows, and nil Fields and Snippets mean DefaultFields and DefaultSnippets. Facets
+// are counted as Store.Facets counts them.
+// Subscribers in the same org with the same principals share a search if they ask for the same page, in the same
+// order, of the same results; queries that differ only in how they're written are the same.
+func Subscribe(orgId string, req SubscribeSearchReq, connId string, principals []string, sock sockjs.Session) (*Search, error) {
+	if req.Rows == 0 {
+		req.Rows = DefaultRows
+	}
+	if req.Start < 0 || req.Rows < 0 || req.Rows > MaxRows {
+		return nil, fmt.Errorf("invalid page of %d results from %d", req.Rows, req.Start)
+	}
+	if req.Fields == nil {
+		req.Fields = DefaultFields
+	}
+	if req.Snippets == nil {
+		req.Snippets = DefaultSnippets
+	}
+	for _, name := range append(append(append([]string(nil), req.Fields...), req.Snippets...), req.Facets...) {
+		if !validField(name) {
+			return nil, fmt.Errorf("invalid field %q", name)
+		}
+	}
+	for _, name := range req.Facets {
+		if _, err := store.FacetField(name); err != nil {
+			return nil, err
+		}
+	}
+	spec, err := parseSpec(req)
+	if err != nil {
+		return nil, err
+	}
 	rsp := make(chan *Search)
-	master.subs <- subReq{query: query, connId: connId, sock: sock, response: rsp}
-	return <-rsp, nil
+	sub := subReq{
+		orgId:    orgId,
+		req:      req,
+		spec:     spec,
+		readers:  principals,
+		connId:   connId,
+		sock:     sock,
+		response: rsp,
+	}
+	select {
+	case master.subs <- sub:
+	case <-master.stopped:
+		return nil, ErrorShutdown
+	}
+	if s := <-rsp; s != nil {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unable to search org %s", orgId)
+}
+
+// Tells searches that an org's card has changed, as when it's created or saved, passing its props as last saved
+// before (nil for a new card) and as saved now. Searches the card matched before or matches now run their queries
+// again, and send their subscribers how the results differ from the last ones sent, if they do.
+func Changed(orgId, cardId string, before, after map[string]string) {
+	select {
+	case master.changes <- change{orgId: orgId, cardId: cardId, before: before, after: after}:
+	case <-master.stopped:
+	}
+}
+
+func parseSpec(req SubscribeSearchReq) (*spec, error) {
+	q, err := query.Parse(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	spec := &spec{where: q.Where, sort: q.Sort}
+	for _, filter := range req.Filters {
+		f, err := query.Parse(filter)
+		if err != nil {
+			return nil, err
+		}
+		if f.Sort != nil {
+			return nil, fmt.Errorf("filters can't sort: %s", filter)
+		}
+		spec.filters = append(spec.filters, f.Where)
+	}
+	if req.Sort != "" {
+		if spec.sort, err = query.ParseSort(req.Sort); err != nil {
+			return nil, err
+		}
+	}
+	if spec.sort == nil {
+		spec.sort = DefaultSort
+	}
+	return spec, nil
+}
+
+// Keys searches by everything that determines their results, with queries in canonical form, and lists sorted.
+func searchKey(orgId string, req SubscribeSearchReq, spec *spec, readers []string) string {
+	fields := append([]string(nil), req.Fields...)
+	snippets := append([]string(nil), req.Snippets...)
+	facets := append([]string(nil), req.Facets...)
+	filters := make([]string, len(spec.filters))
+	for i, f := range spec.filters {
+		filters[i] = f.String()
+	}
+	sort.Strings(fields)
+	sort.Strings(snippets)
+	sort.Strings(facets)
+	sort.Strings(filters)
+	return fmt.Sprintf("%s\n%s\n%d+%d\n%s\n%s\n%s\n%q\n%s\n%s", orgId, strings.Join(readers, ","), req.Start,
+		req.Rows, strings.Join(fields, ","), strings.Join(snippets, ","), strings.Join(facets, ","), filters, spec.sort,
+		spec.where)
+}
+
+// Field names are restricted to what can safely be named in Solr's field lists.
+func validField(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
 }
 
 // Represents a search query. Get these by calling Subscribe().
 type Search struct {
-	query         string
-	subscriptions map[string]sockjs.Session
+	key           string
+	orgId         string
+	db            store.Store // the org's store
+	req           SubscribeSearchReq
+	spec          *spec
+	readers       []string
+	subscriptions map[subscriber]subscription
 	subs          chan subReq
 	unsubs        chan unsubReq
-	rsp           *SearchResultsRsp
+	changes       chan bool        // holds a pending change, if any
+	rechecks      chan bool        // holds a pending recheck, if any
+	recheckTimer  <-chan time.Time // non-nil while a recheck is scheduled
+	stopped       chan bool        // closed when the search's goroutine exits
+	queried       bool             // whether the query has succeeded yet
+	total         int
+	results       []SearchResult     // the page last sent
+	facets        map[string][]Facet // the facets last sent
 }
 
-func newSearch(query string, done chan<- *Search) *Search {
+func newSearch(key, orgId string, st store.Store, req SubscribeSearchReq, spec *spec, readers []string,
+	done chan<- *Search) *Search {
 	s := &Search{
-		query:         query,
-		subscriptions: make(map[string]sockjs.Session),
+		key:           key,
+		orgId:         orgId,
+		db:            st,
+		req:           req,
+		spec:          spec,
+		readers:       readers,
+		subscriptions: make(map[subscriber]subscription),
 		subs:          make(chan subReq),
 		unsubs:        make(chan unsubReq),
+		changes:       make(chan bool, 1),
+		rechecks:      make(chan bool, 1),
+		stopped:       make(chan bool),
+		results:       []SearchResult{},
 	}
+	master.running.Add(1)
 	go s.run(done)
 	return s
 }
 
 // Main loop for each running search. Maintains access to subscriptions via the subs/unsubs channels.
 func (s *Search) run(done chan<- *Search) {
+	defer master.running.Done()
+	defer close(s.stopped)
 	for {
 		select {
 		case req := <-s.subs:
-			s.subscriptions[req.connId] = req.sock
-			s.update()
-			s.send(req.sock)
-			log.Printf("[%d] sub search %s: %s", len(s.subs), req.query, req.connId)
+			if !s.queried {
+				if diff := s.update(); diff != nil {
+					s.broadcast(diff)
+				}
+			}
+			s.subscriptions[subscriber{req.connId, req.req.SubId}] = subscription{req.sock, req.req.Query}
+			page := s.page()
+			page.SubId, page.Query = req.req.SubId, req.req.Query
+			page.Send(req.sock)
+			log.Printf("[%d] sub search %s: %s", len(s.subs), s.req.Query, req.connId)
 
 		case req := <-s.unsubs:
-			delete(s.subscriptions, req.connId)
+			delete(s.subscriptions, req.sub)
 			if len(s.subscriptions) == 0 {
-				log.Printf("dropping search %s: %s", s.query, req.connId)
-				done <- s
+				log.Printf("dropping search %s: %s", s.req.Query, req.sub.connId)
+				select {
+				case done <- s:
+				case <-master.stopped:
+				}
 				return
 			}
-			log.Printf("[%d] unsub search %s: %s", len(s.subs), s.query, req.connId)
+			log.Printf("[%d] unsub search %s: %s", len(s.subs), s.req.Query, req.sub.connId)
+
+		case <-s.changes:
+			if diff := s.update(); diff != nil {
+				s.broadcast(diff)
+			}
+
+		case <-s.rechecks:
+			if s.recheckTimer == nil {
+				s.recheckTimer = time.After(RecheckInterval)
+			}
+
+		case <-s.recheckTimer:
+			s.recheckTimer = nil
+			if diff := s.update(); diff != nil {
+				s.broadcast(diff)
+			}
+
+		case <-master.stopped:
+			return
+		}
+	}
+}
+
+// Unsubscribe a connection from this Search, by the subId it subscribed with.
+func (s *Search) Unsubscribe(connId string, subId int) {
+	select {
+	case master.unsubs <- unsubReq{search: s, sub: subscriber{connId, subId}}:
+	case <-master.stopped:
+	}
+}
+
+// Reports whether a card change can alter the search's results, as its store judges whether the card matched before
+// or matches now, and whether that's certain. A search that looks at when cards were created or modified always
+// can be, since changes don't carry those times.
+func (s *Search) affectedBy(c change) (affected, certain bool) {
+	if usesTimes(s.spec.where) || usesTimes(query.And{Exprs: s.spec.filters}) {
+		return true, true
+	}
+	q := store.Query{Where: s.spec.where, Filters: s.spec.filters, Readers: s.readers}
+	certain = true
+	for _, props := range []map[string]string{c.before, c.after} {
+		if props == nil {
+			continue
+		}
+		found, sure := s.db.Match(q, &store.Doc{Id: c.cardId, Props: props})
+		if found {
+			return true, sure
+		}
+		certain = certain && sure
+	}
+	return false, certain
+}
 
-		case <-time.After(5 * time.Second):
-			s.update()
-			s.broadcast()
+// Reports whether an expression looks at cards' created or modified times.
+func usesTimes(e query.Expr) bool {
+	switch e := e.(type) {
+	case query.And:
+		for _, sub := range e.Exprs {
+			if usesTimes(sub) {
+				return true
+			}
+		}
+	case query.Or:
+		for _, sub := range e.Exprs {
+			if usesTimes(sub) {
+				return true
+			}
 		}
+	case query.Not:
+		return usesTimes(e.Expr)
+	case query.Equals:
+		return e.Prop == query.CreatedName || e.Prop == query.ModifiedName
+	case query.Range:
+		return e.Prop == query.CreatedName || e.Prop == query.ModifiedName
 	}
+	return false
 }
 
-// Unsubscribe a connection from this Search.
-func (s *Search) Unsubscribe(connId string) {
-	master.unsubs <- unsubReq{search: s, connId: connId}
+// Notes that a change the search's store couldn't judge may have changed its results, so it runs its query again
+// after RecheckInterval. Rechecks that arrive while one is scheduled are folded into it.
+func (s *Search) recheck() {
+	select {
+	case s.rechecks <- true:
+	default:
+	}
+}
+
+// Notes that the search's results may have changed. Changes that arrive while one is pending are folded into it,
+// so the master loop never waits on a busy search.
+func (s *Search) change() {
+	select {
+	case s.changes <- true:
+	default:
+	}
 }
 
-func (s *Search) update() {
-	// TODO: Basic optimization: Don't requery unless *something* has changed.
-	total, results, err := solr.GetDocs("hb", url.Values{
-			"q": []string{s.query},
-			"rows": []string{"500"},
-			"sort": []string{"modified desc"},
-		})
+// Runs the query, returning how its page differs from the one last sent, or nil if it doesn't. Failed queries
+// leave the page as it was.
+func (s *Search) update() *SearchResultsRsp {
+	q := store.Query{
+		Where:    s.spec.where,
+		Filters:  s.spec.filters,
+		Sort:     s.spec.sort,
+		Start:    s.req.Start,
+		Rows:     s.req.Rows,
+		Readers:  s.readers,
+		Fields:   s.req.Fields,
+		Snippets: s.req.Snippets,
+	}
+	total, docs, err := s.db.Query(q)
 	if err != nil {
-		log.Printf("error retrieving docs for search %s : %s", s.query, err)
+		log.Printf("error retrieving docs for search %s : %s", s.req.Query, err)
+		return nil
+	}
+	var facets map[string][]Facet
+	if len(s.req.Facets) > 0 {
+		counts, err := s.db.Facets(q, s.req.Facets)
+		if err != nil {
+			log.Printf("error counting facets for search %s : %s", s.req.Query, err)
+			return nil
+		}
+		facets = makeFacets(counts)
 	}
+	s.queried = true
 
-	s.rsp = &SearchResultsRsp{
-		Query:   s.query,
-		Total:   total,
-		Results: makeResults(results),
+	results := makeResults(docs)
+	diff := diffResults(s.results, results)
+	facetsChanged := !reflect.DeepEqual(facets, s.facets)
+	if total == s.total && len(diff.Removed) == 0 && len(diff.Added) == 0 && len(diff.Moved) == 0 &&
+		len(diff.Updated) == 0 && !facetsChanged {
+		return nil
 	}
+	s.total, s.results, s.facets = total, results, facets
+	diff.Query, diff.Start, diff.Rows, diff.Total = s.req.Query, s.req.Start, s.req.Rows, total
+	if facetsChanged {
+		diff.Facets = facets
+	}
+	return diff
 }
 
-func (s *Search) broadcast() {
-	for _, sock := range s.subscriptions {
-		s.send(sock)
+// The whole page, for new subscribers.
+func (s *Search) page() *SearchResultsRsp {
+	return &SearchResultsRsp{
+		Query:   s.req.Query,
+		Start:   s.req.Start,
+		Rows:    s.req.Rows,
+		Total:   s.total,
+		Reset:   true,
+		Results: s.results,
+		Facets:  s.facets,
 	}
 }
 
-func (s *Search) send(sock sockjs.Session) {
-	s.rsp.Send(sock)
+func (s *Search) broadcast(rsp *SearchResultsRsp) {
+	for sub, subscription := range s.subscriptions {
+		rsp.SubId, rsp.Query = sub.subId, subscription.query
+		rsp.Send(subscription.sock)
+	}
+}
+
+// Works out how to turn one page of results into another. Results that left the page are removed, and those that
+// joined it are added at their index. Of the results on both pages, as many as can keep their order stay where
+// they fall, and the rest are moved to their index. Those whose props, snippets or modification time changed are
+// updated.
+func diffResults(from, to []SearchResult) *SearchResultsRsp {
+	diff := &SearchResultsRsp{}
+	fromIndex := make(map[string]int, len(from))
+	for i, r := range from {
+		fromIndex[r.CardId] = i
+	}
+	onPage := make(map[string]bool, len(to))
+	for _, r := range to {
+		onPage[r.CardId] = true
+	}
+	for _, r := range from {
+		if !onPage[r.CardId] {
+			diff.Removed = append(diff.Removed, r.CardId)
+		}
+	}
+
+	var kept []int  // indexes into to of the results on both pages
+	var order []int // their indexes into from
+	for i, r := range to {
+		j, exists := fromIndex[r.CardId]
+		if !exists {
+			diff.Added = append(diff.Added, AddedSearchResult{Index: i, SearchResult: r})
+			continue
+		}
+		kept = append(kept, i)
+		order = append(order, j)
+		if !sameResult(from[j], r) {
+			diff.Updated = append(diff.Updated, r)
+		}
+	}
+	stay := longestIncreasing(order)
+	for k, i := range kept {
+		if !stay[k] {
+			diff.Moved = append(diff.Moved, MovedSearchResult{CardId: to[i].CardId, Index: i})
+		}
+	}
+	return diff
 }
 
-func makeResults(in []solr.JsonObject) []SearchResult {
+// Finds a longest increasing subsequence of seq, whose elements are distinct. Returns the set of its indexes into
+// seq.
+func longestIncreasing(seq []int) map[int]bool {
+	var tails []int // tails[n] is the index of the smallest element ending an increasing run of n+1
+	prev := make([]int, len(seq))
+	for i, v := range seq {
+		n := sort.Search(len(tails), func(n int) bool { return seq[tails[n]] >= v })
+		prev[i] = -1
+		if n > 0 {
+			prev[i] = tails[n-1]
+		}
+		if n == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[n] = i
+		}
+	}
+	in := make(map[int]bool, len(tails))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			in[i] = true
+		}
+	}
+	return in
+}
+
+func makeResults(in []*store.Doc) []SearchResult {
 	results := make([]SearchResult, len(in))
-	for i, js := range in {
+	for i, doc := range in {
 		results[i] = SearchResult{
-			CardId: *js.GetString("id"),
+			CardId:   doc.Id,
+			Modified: doc.Modified,
+			Props:    doc.Props,
+			Snippets: doc.Snippets,
 		}
-		title := js.GetString("prop_title")
-		if title != nil {
-			results[i].Title = *title
+	}
+	return results
+}
+
+func makeFacets(counts map[string][]store.Facet) map[string][]Facet {
+	facets := make(map[string][]Facet, len(counts))
+	for name, values := range counts {
+		facets[name] = make([]Facet, len(values))
+		for i, f := range values {
+			facets[name][i] = Facet{Value: f.Value, Count: f.Count}
 		}
-		body := js.GetString("prop_body")
-		if body != nil {
-			results[i].Body = *body
+	}
+	return facets
+}
+
+func sameResult(a, b SearchResult) bool {
+	return a.CardId == b.CardId && a.Modified.Equal(b.Modified) && sameProps(a.Props, b.Props) &&
+		sameProps(a.Snippets, b.Snippets)
+}
+
+func sameProps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, exists := b[name]; !exists || other != value {
+			return false
 		}
 	}
-	return results
+	return true
 }
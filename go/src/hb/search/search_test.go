@@ -0,0 +1,546 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	. "hb/api"
+	"hb/auth"
+	"hb/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const timeout = 5 * time.Second
+
+// Sets up searches over a fresh disk store in the default org.
+func startSearches(t *testing.T) (store.Store, func()) {
+	dir, err := ioutil.TempDir("", "hbsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.NewDiskStore(filepath.Join(dir, "hb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgs, err := store.NewOrgs(func(orgId string) (store.Store, error) { return st, nil }, store.DefaultOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Init(orgs)
+	return st, func() { os.RemoveAll(dir) }
+}
+
+var lastCardId int
+
+// Creates a card owned by joel, as the card package would, and tells searches.
+func createCard(t *testing.T, st store.Store, props map[string]string) string {
+	t.Helper()
+	lastCardId++
+	cardId := fmt.Sprintf("card%d", lastCardId)
+	owned := map[string]string{auth.OwnerProp: "joel"}
+	for name, value := range props {
+		owned[name] = value
+	}
+	if err := st.CreateCard(cardId, 1, owned); err != nil {
+		t.Fatal(err)
+	}
+	Changed(store.DefaultOrg, cardId, nil, owned)
+	return cardId
+}
+
+// Saves a change to one of a card's props, and tells searches.
+func saveCard(t *testing.T, st store.Store, cardId, name, value string) {
+	t.Helper()
+	doc, err := st.LoadCard(cardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[string]string)
+	for k, v := range doc.Props {
+		before[k] = v
+	}
+	doc.Props[name] = value
+	if err := st.SaveCard(cardId, doc.Rev+1, doc.Props); err != nil {
+		t.Fatal(err)
+	}
+	Changed(store.DefaultOrg, cardId, before, doc.Props)
+}
+
+// A sockjs session that collects the results sent to it.
+type fakeSock struct {
+	id   string
+	rsps chan *Rsp
+}
+
+func newSock(id string) *fakeSock {
+	return &fakeSock{id: id, rsps: make(chan *Rsp, 100)}
+}
+
+func (s *fakeSock) ID() string                               { return s.id }
+func (s *fakeSock) Recv() (string, error)                    { select {} }
+func (s *fakeSock) Close(status uint32, reason string) error { return nil }
+
+func (s *fakeSock) Send(msg string) error {
+	var rsp Rsp
+	if err := json.Unmarshal([]byte(msg), &rsp); err != nil {
+		return err
+	}
+	s.rsps <- &rsp
+	return nil
+}
+
+// Waits for the next results sent.
+func (s *fakeSock) next(t *testing.T) *SearchResultsRsp {
+	t.Helper()
+	select {
+	case rsp := <-s.rsps:
+		if rsp.SearchResults == nil {
+			t.Fatalf("%s: expected search results, got %s", s.id, rsp.Type)
+		}
+		return rsp.SearchResults
+	case <-time.After(timeout):
+		t.Fatalf("%s: timed out waiting for search results", s.id)
+	}
+	return nil
+}
+
+// Subscribes a sock to a search as joel, returning the search and its first page.
+func subscribe(t *testing.T, sock *fakeSock, req SubscribeSearchReq) (*Search, *SearchResultsRsp) {
+	t.Helper()
+	return subscribeAs(t, sock, req, auth.Principals("joel", nil))
+}
+
+func subscribeAs(t *testing.T, sock *fakeSock, req SubscribeSearchReq, principals []string) (*Search, *SearchResultsRsp) {
+	t.Helper()
+	s, err := Subscribe(store.DefaultOrg, req, sock.ID(), principals, sock)
+	if err != nil {
+		t.Fatalf("error subscribing to %+v: %s", req, err)
+	}
+	return s, sock.next(t)
+}
+
+// Lists the ids of a page's results, or of the results added to it.
+func ids(results []SearchResult) string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.CardId
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestDiffResults(t *testing.T) {
+	page := func(ids string) []SearchResult {
+		var results []SearchResult
+		for _, id := range strings.Split(ids, ",") {
+			results = append(results, SearchResult{CardId: id, Props: map[string]string{"title": id}})
+		}
+		return results
+	}
+	from, to := page("a,b,c,d,e"), page("e,a,c,f,d")
+	to[1].Props = map[string]string{"title": "A"}
+	diff := diffResults(from, to)
+	if !reflect.DeepEqual(diff.Removed, []string{"b"}) {
+		t.Errorf("expected b removed, got %v", diff.Removed)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].CardId != "f" || diff.Added[0].Index != 3 {
+		t.Errorf("expected f added at 3, got %+v", diff.Added)
+	}
+	if len(diff.Moved) != 1 || diff.Moved[0].CardId != "e" || diff.Moved[0].Index != 0 {
+		t.Errorf("expected only e moved, to 0, got %+v", diff.Moved)
+	}
+	if len(diff.Updated) != 1 || diff.Updated[0].Props["title"] != "A" {
+		t.Errorf("expected a updated, got %+v", diff.Updated)
+	}
+
+	if diff := diffResults(from, from); diff.Removed != nil || diff.Added != nil || diff.Moved != nil || diff.Updated != nil {
+		t.Errorf("expected no difference, got %+v", diff)
+	}
+}
+
+func TestLongestIncreasing(t *testing.T) {
+	for _, test := range []struct {
+		seq      []int
+		expected map[int]bool
+	}{
+		{nil, map[int]bool{}},
+		{[]int{0, 1, 2}, map[int]bool{0: true, 1: true, 2: true}},
+		{[]int{2, 1, 0}, map[int]bool{2: true}},
+		{[]int{4, 0, 1, 3, 2}, map[int]bool{1: true, 2: true, 4: true}},
+	} {
+		if in := longestIncreasing(test.seq); !reflect.DeepEqual(in, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.seq, test.expected, in)
+		}
+	}
+}
+
+func TestAffectedBy(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	tests := []struct {
+		req           SubscribeSearchReq
+		readers       []string
+		before, after map[string]string
+		affected      bool
+	}{
+		{SubscribeSearchReq{Query: "milk"}, nil, nil, map[string]string{"title": "milk"}, true},
+		{SubscribeSearchReq{Query: "milk"}, nil, nil, map[string]string{"title": "eggs"}, false},
+		{SubscribeSearchReq{Query: "milk"}, nil, map[string]string{"title": "milk"}, map[string]string{"title": "eggs"}, true},
+		{SubscribeSearchReq{Query: "milk"}, nil, map[string]string{"title": "bread"}, map[string]string{"title": "eggs"}, false},
+		{SubscribeSearchReq{Query: "milk", Filters: []string{"type = card"}}, nil, nil, map[string]string{"title": "milk"}, false},
+		{SubscribeSearchReq{Query: "milk"}, []string{"bob"}, nil, map[string]string{"title": "milk", auth.OwnerProp: "joel"}, false},
+		{SubscribeSearchReq{Query: "modified >= 2014-03-01"}, nil, nil, map[string]string{"title": "eggs"}, true},
+		{SubscribeSearchReq{Query: "eggs", Filters: []string{"not created >= 2014-03-01"}}, nil, nil, map[string]string{"title": "milk"}, true},
+	}
+	for _, test := range tests {
+		spec, err := parseSpec(test.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Search{db: st, spec: spec, readers: test.readers}
+		c := change{cardId: "card", before: test.before, after: test.after}
+		if affected, certain := s.affectedBy(c); affected != test.affected || !certain {
+			t.Errorf("%+v affected by %v -> %v: expected %v, got %v", test.req, test.before, test.after, test.affected, affected)
+		}
+	}
+}
+
+// A store that can only guess which cards queries find, as Solr's can, and always guesses they don't.
+type guessingStore struct {
+	store.Store
+}
+
+func (st guessingStore) Match(q store.Query, doc *store.Doc) (bool, bool) { return false, false }
+
+func TestSearchRecheck(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+	orgs, err := store.NewOrgs(func(orgId string) (store.Store, error) { return guessingStore{st}, nil }, store.DefaultOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Init(orgs)
+	recheckInterval := RecheckInterval
+	RecheckInterval = 50 * time.Millisecond
+	defer func() { RecheckInterval = recheckInterval }()
+
+	// Changes the store guesses don't match are still found, once the search runs again.
+	sock := newSock("a")
+	s, _ := subscribe(t, sock, SubscribeSearchReq{Query: "rechecktest"})
+	defer s.Unsubscribe(sock.ID(), 0)
+	cardId := createCard(t, st, map[string]string{"title": "rechecktest"})
+	if rsp := sock.next(t); len(rsp.Added) != 1 || rsp.Added[0].CardId != cardId {
+		t.Errorf("expected %s added, got %+v", cardId, rsp)
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	_, cleanup := startSearches(t)
+	defer cleanup()
+
+	for _, req := range []SubscribeSearchReq{
+		{Query: "(badquery"},
+		{Query: "badfilter", Filters: []string{"sort title"}},
+		{Query: "badsort", Sort: "title sideways"},
+		{Query: "badfield", Fields: []string{"title,body"}},
+		{Query: "badfacet", Facets: []string{"modified"}},
+		{Query: "badpage", Rows: MaxRows + 1},
+	} {
+		if _, err := Subscribe(store.DefaultOrg, req, "a", nil, newSock("a")); err == nil {
+			t.Errorf("expected %+v to be refused", req)
+		}
+	}
+}
+
+func TestSearchUpdates(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	sock := newSock("a")
+	req := SubscribeSearchReq{Query: "updatetest", Rows: 2}
+	s, rsp := subscribe(t, sock, req)
+	defer s.Unsubscribe(sock.ID(), req.SubId)
+	if !rsp.Reset || rsp.Total != 0 || rsp.Rows != 2 {
+		t.Errorf("expected an empty page, got %+v", rsp)
+	}
+
+	// Creating a matching card sends new results. Creating one that doesn't match sends nothing, so the next
+	// results are those of the card after it.
+	first := createCard(t, st, map[string]string{"title": "updatetest 1"})
+	if rsp = sock.next(t); rsp.Reset || rsp.Total != 1 || len(rsp.Added) != 1 || rsp.Added[0].CardId != first {
+		t.Errorf("expected %s added, got %+v", first, rsp)
+	}
+	other := createCard(t, st, map[string]string{"title": "other"})
+	second := createCard(t, st, map[string]string{"title": "updatetest 2"})
+	if rsp = sock.next(t); rsp.Total != 2 || len(rsp.Added) != 1 || rsp.Added[0].CardId != second || rsp.Added[0].Index != 0 {
+		t.Errorf("expected %s added first, got %+v", second, rsp)
+	}
+
+	// A new card pushes the last one off the page.
+	saveCard(t, st, other, "title", "other updatetest")
+	rsp = sock.next(t)
+	if rsp.Total != 3 || !reflect.DeepEqual(rsp.Removed, []string{first}) || len(rsp.Added) != 1 ||
+		rsp.Added[0].CardId != other || rsp.Added[0].Index != 0 || len(rsp.Moved) != 0 || len(rsp.Updated) != 0 {
+		t.Errorf("expected %s to replace %s, got %+v", other, first, rsp)
+	}
+
+	// Saving a card moves it to the top, and updates its title.
+	saveCard(t, st, second, "title", "updatetest 2!")
+	rsp = sock.next(t)
+	if len(rsp.Removed) != 0 || len(rsp.Added) != 0 || len(rsp.Moved) != 1 || rsp.Moved[0].CardId != second ||
+		len(rsp.Updated) != 1 || rsp.Updated[0].Props["title"] != "updatetest 2!" {
+		t.Errorf("expected %s to move and change, got %+v", second, rsp)
+	}
+
+	// The next page holds the rest.
+	next := SubscribeSearchReq{Query: "updatetest", Start: 2, Rows: 2}
+	s, rsp = subscribe(t, sock, next)
+	defer s.Unsubscribe(sock.ID(), next.SubId)
+	if rsp.Total != 3 || ids(rsp.Results) != first {
+		t.Errorf("expected %s on the second page, got %+v", first, rsp)
+	}
+}
+
+// Subscribing to a search while it drops itself starts it again.
+func TestSubscribeWhileDropping(t *testing.T) {
+	_, cleanup := startSearches(t)
+	defer cleanup()
+
+	sock := newSock("a")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			s, err := Subscribe(store.DefaultOrg, SubscribeSearchReq{Query: "droptest"}, sock.ID(), auth.Principals("joel", nil), sock)
+			if err != nil {
+				t.Errorf("error subscribing: %s", err)
+				break
+			}
+			// The last subscriber to leave drops the search.
+			s.Unsubscribe(sock.ID(), 0)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out subscribing while the search drops itself")
+	}
+}
+
+func TestSearchShared(t *testing.T) {
+	_, cleanup := startSearches(t)
+	defer cleanup()
+
+	// The same search, written differently, is shared, and sent by the query each subscriber wrote.
+	alice, bob := newSock("alice"), newSock("bob")
+	reqs := []SubscribeSearchReq{
+		{SubId: 1, Query: "sharedtest", Sort: "title", Filters: []string{"done = true", "type = card"}},
+		{SubId: 2, Query: `"SharedTest" sort title asc`, Filters: []string{"type = card", "done = true"}},
+	}
+	s1, _ := subscribe(t, alice, reqs[0])
+	defer s1.Unsubscribe(alice.ID(), reqs[0].SubId)
+	s2, rsp := subscribe(t, bob, reqs[1])
+	defer s2.Unsubscribe(bob.ID(), reqs[1].SubId)
+	if s1 != s2 || rsp.SubId != 2 || rsp.Query != reqs[1].Query {
+		t.Errorf("expected a shared search sent as %q to sub 2, got %+v", reqs[1].Query, rsp)
+	}
+
+	// Other pages, and other readers, get searches of their own.
+	if s3, _ := subscribe(t, alice, SubscribeSearchReq{SubId: 3, Query: "sharedtest", Sort: "title", Rows: 2}); s3 == s1 {
+		t.Error("expected another page to be another search")
+	} else {
+		defer s3.Unsubscribe(alice.ID(), 3)
+	}
+	if s4, _ := subscribeAs(t, bob, reqs[0], auth.Principals("bob", nil)); s4 == s1 {
+		t.Error("expected other readers to get another search")
+	} else {
+		defer s4.Unsubscribe(bob.ID(), reqs[0].SubId)
+	}
+}
+
+func TestSearchSameQuery(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	// A connection can subscribe to the same query twice, and each subscription gets the results.
+	sock := newSock("a")
+	s1, _ := subscribe(t, sock, SubscribeSearchReq{SubId: 1, Query: "samequerytest"})
+	s2, rsp := subscribe(t, sock, SubscribeSearchReq{SubId: 2, Query: "samequerytest", Rows: 1, Fields: []string{}})
+	defer s2.Unsubscribe(sock.ID(), 2)
+	if rsp.SubId != 2 {
+		t.Errorf("expected sub 2's page, got %+v", rsp)
+	}
+	cardId := createCard(t, st, map[string]string{"title": "samequerytest"})
+	subIds := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		rsp = sock.next(t)
+		if len(rsp.Added) != 1 || rsp.Added[0].CardId != cardId {
+			t.Errorf("expected %s added, got %+v", cardId, rsp)
+		}
+		subIds[rsp.SubId] = true
+	}
+	if !subIds[1] || !subIds[2] {
+		t.Errorf("expected results for subs 1 and 2, got them for %v", subIds)
+	}
+
+	// Dropping one leaves the other.
+	s1.Unsubscribe(sock.ID(), 1)
+	saveCard(t, st, cardId, "title", "samequerytest!")
+	if rsp = sock.next(t); rsp.SubId != 2 {
+		t.Errorf("expected results for sub 2, got %+v", rsp)
+	}
+	select {
+	case rsp := <-sock.rsps:
+		t.Errorf("expected nothing more, got %+v", rsp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSearchReaders(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	cardId := createCard(t, st, map[string]string{"title": "readertest"})
+	sock := newSock("bob")
+	principals := auth.Principals("bob", map[string]string{auth.GroupsProp: `["eng"]`})
+	s, rsp := subscribeAs(t, sock, SubscribeSearchReq{Query: "readertest"}, principals)
+	defer s.Unsubscribe(sock.ID(), 0)
+	if rsp.Total != 0 {
+		t.Errorf("expected no results before sharing, got %+v", rsp)
+	}
+	saveCard(t, st, cardId, auth.ViewersProp, `["group:eng"]`)
+	if rsp = sock.next(t); rsp.Total != 1 || rsp.Added[0].CardId != cardId {
+		t.Errorf("expected the shared card, got %+v", rsp)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	createCard(t, st, map[string]string{"type": "card", "title": "Querytest one", "done": "true"})
+	two := createCard(t, st, map[string]string{"type": "card", "title": "Querytest two"})
+	sock := newSock("a")
+	for _, test := range []struct {
+		query    string
+		expected string
+	}{
+		{"querytest and done != true", two},
+		// Values can't escape into Solr syntax.
+		{`title = "x\" OR *:*"`, ""},
+	} {
+		s, rsp := subscribe(t, sock, SubscribeSearchReq{Query: test.query})
+		if ids(rsp.Results) != test.expected {
+			t.Errorf("%s: expected %q, got %+v", test.query, test.expected, rsp)
+		}
+		s.Unsubscribe(sock.ID(), 0)
+	}
+}
+
+func TestSearchSortFilters(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	titles := make(map[string]string)
+	for _, title := range []string{"sorttest b", "sorttest a", "sorttest c"} {
+		props := map[string]string{"type": "card", "title": title}
+		if title == "sorttest b" {
+			props["done"] = "true"
+		}
+		titles[createCard(t, st, props)] = title[len(title)-1:]
+	}
+
+	sock := newSock("a")
+	for _, test := range []struct {
+		req      SubscribeSearchReq
+		expected string
+	}{
+		{SubscribeSearchReq{Query: "sorttest"}, "cab"},
+		{SubscribeSearchReq{Query: "sorttest", Sort: "title"}, "abc"},
+		{SubscribeSearchReq{Query: "SORTTEST", Sort: "created desc"}, "cab"},
+		{SubscribeSearchReq{Query: "sorttest sort created", Sort: "title desc"}, "cba"},
+		{SubscribeSearchReq{Query: "sorttest", Filters: []string{"done = true"}}, "b"},
+	} {
+		s, rsp := subscribe(t, sock, test.req)
+		var got string
+		for _, r := range rsp.Results {
+			got += titles[r.CardId]
+		}
+		if got != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.req, test.expected, got)
+		}
+		s.Unsubscribe(sock.ID(), test.req.SubId)
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	body := strings.Repeat("Nothing to see here. ", 20) + "Remember the <fieldtest> & stuff."
+	createCard(t, st, map[string]string{"type": "card", "title": "Fields", "body": body})
+	sock := newSock("a")
+
+	// By default, results hold the title, and a snippet of the body.
+	s, rsp := subscribe(t, sock, SubscribeSearchReq{Query: "fieldtest"})
+	defer s.Unsubscribe(sock.ID(), 0)
+	if len(rsp.Results) != 1 {
+		t.Fatalf("expected a result, got %+v", rsp)
+	}
+	r := rsp.Results[0]
+	if len(r.Props) != 1 || r.Props["title"] != "Fields" || r.Modified.IsZero() ||
+		!strings.HasSuffix(r.Snippets["body"], "Remember the &lt;<em>fieldtest</em>&gt; &amp; stuff.") ||
+		len(r.Snippets["body"]) > 250 {
+		t.Errorf("unexpected default result %+v", r)
+	}
+
+	req := SubscribeSearchReq{Query: "fieldtest", Fields: []string{"type", "done"}, Snippets: []string{}}
+	s, rsp = subscribe(t, sock, req)
+	defer s.Unsubscribe(sock.ID(), req.SubId)
+	if r := rsp.Results[0]; len(r.Props) != 1 || r.Props["type"] != "card" || len(r.Snippets) != 0 {
+		t.Errorf("expected just the type, got %+v", r)
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	st, cleanup := startSearches(t)
+	defer cleanup()
+
+	for _, kind := range []string{"note", "note", "idea"} {
+		createCard(t, st, map[string]string{"type": "card", "title": "facettest", "kind": kind})
+	}
+
+	// Facets count all the results, not just those on the page, and follow changes to them. A subscription to the
+	// same query without facets, as the saved searches and the search box make, gets its own whole page.
+	sock := newSock("a")
+	req := SubscribeSearchReq{SubId: 1, Query: "facettest", Rows: 1, Fields: []string{}, Facets: []string{"kind"}}
+	s, rsp := subscribe(t, sock, req)
+	defer s.Unsubscribe(sock.ID(), req.SubId)
+	expected := map[string][]Facet{"kind": {{Value: "note", Count: 2}, {Value: "idea", Count: 1}}}
+	if !reflect.DeepEqual(rsp.Facets, expected) {
+		t.Errorf("expected %v on subscribing, got %v", expected, rsp.Facets)
+	}
+	plain := SubscribeSearchReq{SubId: 2, Query: "facettest"}
+	s, rsp = subscribe(t, sock, plain)
+	defer s.Unsubscribe(sock.ID(), plain.SubId)
+	if rsp.SubId != 2 || rsp.Total != 3 || len(rsp.Results) != 3 || rsp.Facets != nil {
+		t.Errorf("expected a whole page without facets, got %+v", rsp)
+	}
+
+	createCard(t, st, map[string]string{"type": "card", "title": "facettest", "kind": "idea"})
+	expected = map[string][]Facet{"kind": {{Value: "idea", Count: 2}, {Value: "note", Count: 2}}}
+	for i := 0; i < 2; i++ {
+		rsp = sock.next(t)
+		if rsp.SubId == req.SubId && !reflect.DeepEqual(rsp.Facets, expected) {
+			t.Errorf("expected %v after a change, got %v", expected, rsp.Facets)
+		}
+		if rsp.SubId == plain.SubId && (rsp.Total != 4 || len(rsp.Added) != 1 || rsp.Facets != nil) {
+			t.Errorf("expected a card added without facets, got %+v", rsp)
+		}
+	}
+}
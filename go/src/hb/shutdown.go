@@ -0,0 +1,86 @@
+package hb
+
+import (
+	"context"
+	"gopkg.in/igm/sockjs-go.v2/sockjs"
+	"hb/api"
+	"hb/card"
+	"hb/search"
+	"log"
+	"sync"
+)
+
+// Status code used when closing sessions on shutdown (as in websocket's "going away").
+const closeGoingAway = 1001
+
+// Status code used when closing sessions whose logins were revoked (as in websocket's "policy violation").
+const closeRevoked = 1008
+
+// All live sockjs sessions, so that they can be told about and closed on shutdown.
+var sessions struct {
+	sync.Mutex
+	socks    map[string]sockjs.Session
+	closing  bool
+	handlers sync.WaitGroup // running sockHandler()s
+}
+
+func init() {
+	sessions.socks = make(map[string]sockjs.Session)
+}
+
+// Registers a new session, returning false if the server is shutting down.
+func addSession(sock sockjs.Session) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.closing {
+		return false
+	}
+	sessions.socks[sock.ID()] = sock
+	sessions.handlers.Add(1)
+	return true
+}
+
+func removeSession(sock sockjs.Session) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.socks, sock.ID())
+	sessions.handlers.Done()
+}
+
+// Shuts down hb. Tells connected clients the server is going away and closes their sessions, waits for them to
+// drain (or for ctx to expire), then saves all open cards and stops all searches. On return, all state is safely
+// in the store. Returns ctx.Err() if sessions didn't drain in time, but cards are saved regardless.
+func Shutdown(ctx context.Context) error {
+	sessions.Lock()
+	sessions.closing = true
+	socks := make([]sockjs.Session, 0, len(sessions.socks))
+	for _, sock := range sessions.socks {
+		socks = append(socks, sock)
+	}
+	sessions.Unlock()
+
+	log.Printf("shutting down: closing %d sessions", len(socks))
+	for _, sock := range socks {
+		api.ShutdownRsp{Msg: "server shutting down"}.Send(sock)
+		sock.Close(closeGoingAway, "server shutting down")
+	}
+
+	// Wait for handlers to clean up their subscriptions, which drops (and saves) their cards.
+	drained := make(chan bool)
+	go func() {
+		sessions.handlers.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Printf("shutting down: gave up waiting for sessions: %s", err)
+	}
+
+	card.Shutdown()
+	search.Shutdown()
+	log.Printf("shutting down: all cards saved")
+	return err
+}
@@ -5,23 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hb/cherr"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"hb/cherr"
 	"os"
 	"path"
 	"strings"
 	"time"
-	"hb/ot"
-"hb/cherr"
 )
 
 const (
 	docVersion = 0
 	solrUrl    = "http://localhost:8983/solr"
 
+	// Format of Solr date fields.
+	DateFormat = "2006-01-02T15:04:05Z"
+
 	SolrAdminHandler         = "admin"
 	SolrAdminCoresHandler    = "admin/cores"
 	SolrFieldAnalysisHandler = "analysis/field"
@@ -84,7 +85,7 @@ func CoreExists(orgId string) (bool, error) {
 
 func GetDoc(orgId, key string) (JsonObject, error) {
 	params := url.Values{
-		"q":    []string{fmt.Sprintf("id:%s", key)},
+		"q": []string{fmt.Sprintf("id:%s", key)},
 	}
 	count, docs, err := GetDocs(orgId, params)
 	if err != nil {
@@ -100,15 +101,25 @@ func GetDoc(orgId, key string) (JsonObject, error) {
 
 // Gets one or more documents using the search handler.
 func GetDocs(orgId string, params url.Values) (total int, results []JsonObject, err error) {
+	total, results, _, err = GetHighlightedDocs(orgId, params)
+	return
+}
+
+// Like GetDocs, but also returns the highlighting asked for by params, if any: an object mapping document ids to
+// objects mapping field names to arrays of snippets.
+func GetHighlightedDocs(orgId string, params url.Values) (total int, results []JsonObject, highlighting JsonObject,
+	err error) {
 	var val JsonObject
 	val, err = get(orgId, SolrSelectHandler, params)
 	if err != nil {
 		return
 	}
+	if hl, ok := val["highlighting"].(map[string]interface{}); ok {
+		highlighting = JsonObject(hl)
+	}
 
 	docs := val.GetArray("response.docs")
 	total = int(*val.GetNumber("response.numFound"))
-	_ = val.GetNumber("response.start") // TODO: Use this in paging.
 
 	results = make([]JsonObject, len(docs))
 	for i, doc := range docs {
@@ -120,16 +131,29 @@ func GetDocs(orgId string, params url.Values) (total int, results []JsonObject,
 	return
 }
 
-// TODO: Consider changing 'doc' to just be docId and the prop map.
+// Gets the counts of values of the fields that params facet on, as an object mapping field names to arrays of
+// values, each followed by its count.
+func GetFacetFields(orgId string, params url.Values) (JsonObject, error) {
+	val, err := get(orgId, SolrSelectHandler, params)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := val.get("facet_counts.facet_fields").(map[string]interface{})
+	return JsonObject(fields), nil
+}
 
-func UpdateDoc(orgId, docId string, props map[string]*ot.Doc, forceCommit bool) error {
+// Adds or replaces a document. Props are stored as prop_* fields; fields are stored under their own names.
+func UpdateDoc(orgId, docId string, fields map[string]interface{}, props map[string]string, forceCommit bool) error {
 	// Build the solr document.
 	solrdoc := make(map[string]interface{})
+	for name, value := range fields {
+		solrdoc[name] = value
+	}
 	solrdoc["_version_"] = docVersion
 	solrdoc["id"] = docId
-	solrdoc["modified"] = time.Now().UTC().Format("2006-01-02T15:04:05Z")
-	for name, doc := range props {
-		solrdoc["prop_" + name] = doc.String()
+	solrdoc["modified"] = time.Now().UTC().Format(DateFormat)
+	for name, value := range props {
+		solrdoc["prop_"+name] = value
 	}
 
 	buf := &bytes.Buffer{}
@@ -149,6 +173,33 @@ func UpdateDoc(orgId, docId string, props map[string]*ot.Doc, forceCommit bool)
 	return err
 }
 
+// Deletes a document by id. Deleting a document that doesn't exist isn't an error.
+func DeleteDoc(orgId, docId string, forceCommit bool) error {
+	body, err := json.Marshal(map[string]interface{}{"delete": map[string]string{"id": docId}})
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	if forceCommit {
+		params.Set("commit", "true")
+	}
+
+	_, err = post(orgId, SolrUpdateHandler, params, body, "application/json")
+	return err
+}
+
+// Escapes Solr query syntax characters in s, so that it can be used as a literal term.
+func Escape(s string) string {
+	buf := &bytes.Buffer{}
+	for _, r := range s {
+		if strings.ContainsRune(`\+-!():^[]"{}~*?|&;/ `, r) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
 
 func solrHome() string {
 	varname := "SOLR_HOME"
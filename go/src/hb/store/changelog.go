@@ -0,0 +1,68 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"hb/cherr"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// fileLog keeps each card's change log in its own append-only file of JSON-encoded changes, one per line.
+// It's used by backends that have no natural place of their own for change logs.
+type fileLog struct {
+	dir string
+}
+
+func newFileLog(dir string) (*fileLog, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, cherr.Errorf(err, "failed to create change log directory %s", dir)
+	}
+	return &fileLog{dir: dir}, nil
+}
+
+func (l *fileLog) path(cardId string) string {
+	return filepath.Join(l.dir, url.PathEscape(cardId)+".log")
+}
+
+func (l *fileLog) AppendChange(cardId string, change *Change) error {
+	buf, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path(cardId), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return cherr.Errorf(err, "failed to open change log for card %s", cardId)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(buf, '\n')); err != nil {
+		return cherr.Errorf(err, "failed to append to change log for card %s", cardId)
+	}
+	return nil
+}
+
+func (l *fileLog) LoadChanges(cardId string) ([]*Change, error) {
+	f, err := os.Open(l.path(cardId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, cherr.Errorf(err, "failed to open change log for card %s", cardId)
+	}
+	defer f.Close()
+
+	var changes []*Change
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		change := &Change{}
+		if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+			return nil, cherr.Errorf(err, "corrupt change log for card %s", cardId)
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
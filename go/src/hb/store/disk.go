@@ -0,0 +1,518 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"hb/auth"
+	"hb/cherr"
+	"hb/query"
+	"hb/schema"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskStore is an embedded store that keeps everything in memory, backed by a single append-only file.
+// Each line of the file is a JSON-encoded record; later records for the same key replace earlier ones.
+// It's meant for laptops and tests, not for large data sets.
+type diskStore struct {
+	lock    sync.Mutex
+	file    *os.File
+	cards   map[string]*Doc
+	changes map[string][]*Change // cardId -> change log
+	users   map[string]*User
+}
+
+type diskRecord struct {
+	Card          *Doc    `json:",omitempty"`
+	User          *User   `json:",omitempty"`
+	DeletedUserId string  `json:",omitempty"`
+	CardId        string  `json:",omitempty"` // The card that Change belongs to.
+	Change        *Change `json:",omitempty"`
+}
+
+// Creates a disk-backed store at the given path, loading any existing data from it.
+func NewDiskStore(path string) (Store, error) {
+	st := &diskStore{
+		cards:   make(map[string]*Doc),
+		changes: make(map[string][]*Change),
+		users:   make(map[string]*User),
+	}
+	if err := st.load(path); err != nil {
+		return nil, cherr.Errorf(err, "failed to load store from %s", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, cherr.Errorf(err, "failed to create directory for store %s", path)
+	}
+	var err error
+	st.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, cherr.Errorf(err, "failed to open store %s", path)
+	}
+	return st, nil
+}
+
+func (st *diskStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var rec diskRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return err
+		}
+		if rec.Card != nil {
+			st.cards[rec.Card.Id] = rec.Card
+		}
+		if rec.User != nil {
+			st.users[rec.User.Id] = rec.User
+		}
+		if rec.DeletedUserId != "" {
+			delete(st.users, rec.DeletedUserId)
+		}
+		if rec.Change != nil {
+			st.changes[rec.CardId] = append(st.changes[rec.CardId], rec.Change)
+		}
+	}
+	return scanner.Err()
+}
+
+// Appends a record to the file. Must be called with st.lock held.
+func (st *diskStore) append(rec diskRecord) error {
+	buf, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	_, err = st.file.Write(append(buf, '\n'))
+	return err
+}
+
+func (st *diskStore) LoadCard(cardId string) (*Doc, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	doc, exists := st.cards[cardId]
+	if !exists {
+		return nil, ErrorNotFound
+	}
+	return copyDoc(doc), nil
+}
+
+func (st *diskStore) SaveCard(cardId string, rev int, props map[string]string) error {
+	return st.saveCard(cardId, rev, props, false)
+}
+
+func (st *diskStore) CreateCard(cardId string, rev int, props map[string]string) error {
+	return st.saveCard(cardId, rev, props, true)
+}
+
+// Saves a card, keeping its creation time unless it's being created.
+func (st *diskStore) saveCard(cardId string, rev int, props map[string]string, create bool) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	now := time.Now().UTC()
+	doc := &Doc{Id: cardId, Rev: rev, Created: now, Modified: now, Props: copyProps(props)}
+	if old, exists := st.cards[cardId]; exists && !create {
+		doc.Created = old.Created
+	}
+	if err := st.append(diskRecord{Card: doc}); err != nil {
+		return cherr.Errorf(err, "failed to save card %s", cardId)
+	}
+	st.cards[cardId] = doc
+	return nil
+}
+
+func (st *diskStore) AppendChange(cardId string, change *Change) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if err := st.append(diskRecord{CardId: cardId, Change: change}); err != nil {
+		return cherr.Errorf(err, "failed to append change to card %s", cardId)
+	}
+	st.changes[cardId] = append(st.changes[cardId], change)
+	return nil
+}
+
+func (st *diskStore) LoadChanges(cardId string) ([]*Change, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	changes := make([]*Change, len(st.changes[cardId]))
+	copy(changes, st.changes[cardId])
+	return changes, nil
+}
+
+func (st *diskStore) FindUser(userId string) (*User, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	user, exists := st.users[userId]
+	if !exists {
+		return nil, ErrorNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (st *diskStore) CreateUser(user *User) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	user = copyUser(user)
+	if err := st.append(diskRecord{User: user}); err != nil {
+		return cherr.Errorf(err, "failed to save user %s", user.Id)
+	}
+	st.users[user.Id] = user
+	return nil
+}
+
+func (st *diskStore) ListUsers() ([]*User, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	users := make([]*User, 0, len(st.users))
+	for _, user := range st.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (st *diskStore) DeleteUser(userId string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if _, exists := st.users[userId]; !exists {
+		return ErrorNotFound
+	}
+	if err := st.append(diskRecord{DeletedUserId: userId}); err != nil {
+		return cherr.Errorf(err, "failed to delete user %s", userId)
+	}
+	delete(st.users, userId)
+	return nil
+}
+
+func (st *diskStore) Query(q Query) (int, []*Doc, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	var docs []*Doc
+	for _, doc := range st.cards {
+		if matchQuery(q, doc) {
+			docs = append(docs, copyDoc(doc))
+		}
+	}
+	sortDocs(docs, q.Sort)
+
+	total := len(docs)
+	if q.Start >= len(docs) {
+		docs = nil
+	} else if q.Start > 0 {
+		docs = docs[q.Start:]
+	}
+	if q.Rows > 0 && len(docs) > q.Rows {
+		docs = docs[:q.Rows]
+	}
+	for _, doc := range docs {
+		if q.Snippets != nil {
+			doc.Snippets = make(map[string]string)
+			for _, name := range q.Snippets {
+				if value, exists := doc.Props[name]; exists {
+					doc.Snippets[name] = snippet(value, wordMatcher(q.Where, name))
+				}
+			}
+		}
+		if q.Fields != nil {
+			doc.Props = selectProps(doc.Props, q.Fields)
+		}
+	}
+	return total, docs, nil
+}
+
+func (st *diskStore) Facets(q Query, names []string) (map[string][]Facet, error) {
+	for _, name := range names {
+		if _, err := FacetField(name); err != nil {
+			return nil, err
+		}
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	var docs []*Doc
+	for _, doc := range st.cards {
+		if matchQuery(q, doc) {
+			docs = append(docs, doc)
+		}
+	}
+	facets := make(map[string][]Facet, len(names))
+	for _, name := range names {
+		facets[name] = countFacet(docs, name)
+	}
+	return facets, nil
+}
+
+// Returns a function reporting whether a word of the named prop is one that a query searches it for.
+func wordMatcher(e query.Expr, name string) func(word string) bool {
+	words := make(map[string]bool)
+	var walk func(e query.Expr)
+	walk = func(e query.Expr) {
+		switch e := e.(type) {
+		case query.And:
+			for _, e := range e.Exprs {
+				walk(e)
+			}
+		case query.Or:
+			for _, e := range e.Exprs {
+				walk(e)
+			}
+		case query.Contains:
+			if e.Prop == "" || e.Prop == name {
+				for _, w := range e.Words {
+					words[w] = true
+				}
+			}
+		}
+	}
+	walk(e)
+	return func(word string) bool { return words[strings.ToLower(word)] }
+}
+
+func (st *diskStore) Match(q Query, doc *Doc) (bool, bool) {
+	return matchQuery(q, doc), true
+}
+
+// Reports whether a doc is one that a query finds.
+func matchQuery(q Query, doc *Doc) bool {
+	return matchExpr(q.Where, doc) && matchExpr(query.And{Exprs: q.Filters}, doc) && readable(doc, q.Readers)
+}
+
+// Reports whether any of the given principals can read a doc. A nil list can read everything.
+func readable(doc *Doc, principals []string) bool {
+	return principals == nil || auth.ACLOf(doc.Props).RoleOf(principals) >= auth.Viewer
+}
+
+func matchExpr(e query.Expr, doc *Doc) bool {
+	switch e := e.(type) {
+	case nil, query.All:
+		return true
+	case query.And:
+		for _, e := range e.Exprs {
+			if !matchExpr(e, doc) {
+				return false
+			}
+		}
+		return true
+	case query.Or:
+		for _, e := range e.Exprs {
+			if matchExpr(e, doc) {
+				return true
+			}
+		}
+		return false
+	case query.Not:
+		return !matchExpr(e.Expr, doc)
+	case query.Contains:
+		for name, value := range doc.Props {
+			if (e.Prop == "" || e.Prop == name) && containsWords(value, e.Words) {
+				return true
+			}
+		}
+		return false
+	case query.Equals:
+		return matchEquals(e, doc)
+	case query.Range:
+		return matchRange(e, doc)
+	case query.Refs:
+		kind := doc.Props[schema.KindProp]
+		for name, value := range doc.Props {
+			if value == e.CardId && schema.Lookup(kind, name).Type == schema.CardRef {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Gets the value of a doc's prop, if it's indexed as the given type, as schema.IndexFields would index it. The id
+// and creation and modification times are their own fields.
+func typedValue(doc *Doc, name string, t schema.Type) (string, bool) {
+	switch name {
+	case query.IdName:
+		return doc.Id, true
+	case query.CreatedName:
+		return doc.Created.Format(time.RFC3339Nano), !doc.Created.IsZero()
+	case query.ModifiedName:
+		return doc.Modified.Format(time.RFC3339Nano), true
+	}
+	value := doc.Props[name]
+	if value == "" {
+		return "", false
+	}
+	declared := schema.Lookup(doc.Props[schema.KindProp], name).Type
+	if declared == schema.RichText {
+		declared = schema.Text
+	}
+	if t == schema.RichText {
+		t = schema.Text
+	}
+	if declared != t {
+		return "", false
+	}
+	return value, true
+}
+
+func matchEquals(e query.Equals, doc *Doc) bool {
+	value, ok := typedValue(doc, e.Prop, e.Type)
+	if !ok {
+		return false
+	}
+	switch e.Type {
+	case schema.Text, schema.RichText:
+		return strings.ToLower(strings.TrimSpace(value)) == strings.ToLower(strings.TrimSpace(e.Value))
+	case schema.Number, schema.Date:
+		return compareTyped(e.Type, value, e.Value) == 0
+	case schema.List:
+		list, _ := schema.ParseList(value)
+		for _, item := range list {
+			if item == e.Value {
+				return true
+			}
+		}
+		return false
+	}
+	return value == e.Value
+}
+
+func matchRange(e query.Range, doc *Doc) bool {
+	value, ok := typedValue(doc, e.Prop, e.Type)
+	if !ok {
+		return false
+	}
+	if e.Min != nil {
+		if c := compareTyped(e.Type, value, e.Min.Value); c < 0 || c == 0 && !e.Min.Inclusive {
+			return false
+		}
+	}
+	if e.Max != nil {
+		if c := compareTyped(e.Type, value, e.Max.Value); c > 0 || c == 0 && !e.Max.Inclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares two values of a type, returning -1, 0 or 1. Numbers and dates that don't parse sort first.
+func compareTyped(t schema.Type, a, b string) int {
+	switch t {
+	case schema.Number:
+		x, errX := schema.ParseNumber(a)
+		y, errY := schema.ParseNumber(b)
+		switch {
+		case errX != nil || errY != nil:
+			return compareBools(errX == nil, errY == nil)
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case schema.Date:
+		x, errX := schema.ParseDate(a)
+		y, errY := schema.ParseDate(b)
+		switch {
+		case errX != nil || errY != nil:
+			return compareBools(errX == nil, errY == nil)
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	case schema.Text, schema.RichText:
+		a, b = schema.SortKey(a), schema.SortKey(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+// Reports whether text contains words, in order, as whole words, ignoring case.
+func containsWords(text string, words []string) bool {
+	textWords := strings.FieldsFunc(strings.ToLower(text), isSeparator)
+	for i := 0; i+len(words) <= len(textWords); i++ {
+		match := true
+		for j, w := range words {
+			if textWords[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func isSeparator(r rune) bool {
+	return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 0x80)
+}
+
+// Sorts docs, by last modification if s is nil. Docs missing the prop sort last, as they do in Solr.
+func sortDocs(docs []*Doc, s *query.Sort) {
+	if s == nil {
+		s = &query.Sort{Prop: query.ModifiedName, Type: schema.Date, Desc: true}
+	}
+
+	// Ties are broken by id, so that pages of results are consistent from one query to the next.
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Id < docs[j].Id })
+	sort.SliceStable(docs, func(i, j int) bool {
+		x, okX := typedValue(docs[i], s.Prop, s.Type)
+		y, okY := typedValue(docs[j], s.Prop, s.Type)
+		if !okX || !okY {
+			return okX && !okY
+		}
+		if s.Desc {
+			return compareTyped(s.Type, x, y) > 0
+		}
+		return compareTyped(s.Type, x, y) < 0
+	})
+}
+
+func copyDoc(doc *Doc) *Doc {
+	return &Doc{Id: doc.Id, Rev: doc.Rev, Created: doc.Created, Modified: doc.Modified, Props: copyProps(doc.Props)}
+}
+
+func copyUser(user *User) *User {
+	return &User{Id: user.Id, PassHash: user.PassHash, Props: copyProps(user.Props)}
+}
+
+func copyProps(props map[string]string) map[string]string {
+	out := make(map[string]string, len(props))
+	for k, v := range props {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,330 @@
+package store
+
+import (
+	"hb/ot"
+	"hb/query"
+	"hb/schema"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func tempStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hbstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "hb.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestDiskCards(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, err := NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.LoadCard("nope"); err != ErrorNotFound {
+		t.Errorf("expected ErrorNotFound, got %v", err)
+	}
+	if err := st.CreateCard("a", 0, map[string]string{"title": "first"}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := st.LoadCard("a")
+	if err := st.SaveCard("a", 0, map[string]string{"title": "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and make sure the last write wins.
+	st, err = NewDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := st.LoadCard("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Props["title"] != "second" {
+		t.Errorf("expected second got %q", doc.Props["title"])
+	}
+	if doc.Created.IsZero() || !doc.Created.Equal(first.Created) {
+		t.Errorf("expected the card to keep its creation time %v, got %v", first.Created, doc.Created)
+	}
+}
+
+func TestDiskChanges(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, _ := NewDiskStore(path)
+	st.AppendChange("a", &Change{Rev: 1, Prop: "title", Ops: ot.Ops{{S: "abc"}}, UserId: "joel"})
+	st.AppendChange("b", &Change{Rev: 1, Prop: "body", Ops: ot.Ops{{S: "xyz"}}})
+	st.AppendChange("a", &Change{Rev: 2, Prop: "title", Ops: ot.Ops{{N: 1}, {N: -2}}})
+
+	st, _ = NewDiskStore(path)
+	changes, err := st.LoadChanges("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes got %d", len(changes))
+	}
+	if changes[0].Rev != 1 || changes[0].UserId != "joel" || !changes[1].Ops.Equal(ot.Ops{{N: 1}, {N: -2}}) {
+		t.Errorf("unexpected changes %+v %+v", changes[0], changes[1])
+	}
+}
+
+func TestDiskUsers(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, _ := NewDiskStore(path)
+	if err := st.CreateUser(&User{Id: "joel", PassHash: "hash", Props: map[string]string{"name": "Joel"}}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := st.FindUser("joel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PassHash != "hash" || user.Props["name"] != "Joel" {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	// Users aren't cards.
+	if total, _, _ := st.Query(Query{}); total != 0 {
+		t.Errorf("expected no cards, got %d", total)
+	}
+}
+
+func TestDiskQuery(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, _ := NewDiskStore(path)
+	st.CreateCard("a", 0, map[string]string{"type": "card", "title": "Buy milk", "done": "true"})
+	st.CreateCard("b", 0, map[string]string{"type": "card", "title": "Walk the dog"})
+	st.CreateCard("c", 0, map[string]string{"type": "comment", "target": "a", "body": "Whole milk?"})
+
+	var queryTests = []struct {
+		q     string
+		total int
+	}{
+		{"", 3},
+		{"type = card", 2},
+		{"type = card -done = true", 1},
+		{"type = comment and target = @a", 1},
+		{"refs @a", 1},
+		{"milk", 2},
+		{"MILK type:card", 1},
+		{"\"whole milk\"", 1},
+		{"\"milk whole\"", 0},
+		{"title = \"buy MILK \"", 1},
+		{"title = buy", 0},
+		{"type = card and (done = true or title:dog)", 2},
+		{"id = b or id = c", 2},
+		{"nope:milk", 0},
+	}
+	for _, c := range queryTests {
+		total, docs, err := st.Query(parse(t, c.q))
+		if err != nil {
+			t.Error(err)
+		}
+		if total != c.total || len(docs) != c.total {
+			t.Errorf("%s: expected %d got %d", c.q, c.total, total)
+		}
+	}
+
+	if total, docs, _ := st.Query(Query{Rows: 1}); total != 3 || len(docs) != 1 {
+		t.Errorf("expected 1 of 3 docs, got %d of %d", len(docs), total)
+	}
+	byType := parse(t, "sort type")
+	_, all, _ := st.Query(byType)
+	byType.Start, byType.Rows = 1, 1
+	total, page, _ := st.Query(byType)
+	if total != 3 || len(page) != 1 || page[0].Id != all[1].Id {
+		t.Errorf("expected the second of 3 docs, got %v of %d", page, total)
+	}
+	if total, docs, _ := st.Query(Query{Start: 3}); total != 3 || len(docs) != 0 {
+		t.Errorf("expected no docs past the end, got %d of %d", len(docs), total)
+	}
+	filtered := parse(t, "milk")
+	filtered.Filters = []query.Expr{parse(t, "type = card").Where}
+	if _, docs, _ := st.Query(filtered); len(docs) != 1 || docs[0].Id != "a" {
+		t.Errorf("expected card a to pass the filter, got %v", docs)
+	}
+
+	// Typed props sort by their types.
+	_, docs, _ := st.Query(parse(t, "type = card sort title"))
+	if len(docs) != 2 || docs[0].Id != "a" {
+		t.Errorf("expected card a first, got %v", docs)
+	}
+
+	// Only the fields asked for are returned, and snippets highlight matches.
+	q := parse(t, "milk target = @a")
+	q.Fields, q.Snippets = []string{"target", "title"}, []string{"body"}
+	_, docs, _ = st.Query(q)
+	if len(docs) != 1 || len(docs[0].Props) != 1 || docs[0].Props["target"] != "a" ||
+		docs[0].Snippets["body"] != "Whole <em>milk</em>?" {
+		t.Errorf("expected comment c's target and a snippet of its body, got %+v", docs)
+	}
+}
+
+func TestDiskQueryTypes(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	schema.Declare("task",
+		&schema.Prop{Name: "points", Type: schema.Number},
+		&schema.Prop{Name: "due", Type: schema.Date},
+		&schema.Prop{Name: "tags", Type: schema.List},
+	)
+	st, _ := NewDiskStore(path)
+	st.CreateCard("a", 0, map[string]string{"type": "task", "points": "1", "due": "2024-01-01", "tags": `["x","y"]`})
+	st.CreateCard("b", 0, map[string]string{"type": "task", "points": "10", "due": "2024-02-01T12:00:00Z"})
+	st.CreateCard("c", 0, map[string]string{"type": "task", "points": "2.5", "tags": `["y"]`})
+	st.CreateCard("d", 0, map[string]string{"type": "note", "points": "5"}) // not a task, so points aren't a number
+
+	var queryTests = []struct {
+		q   string
+		ids string
+	}{
+		{"points > 2 sort id", "bc"},
+		{"points >= 2.5 sort id", "bc"},
+		{"points < 2.5", "a"},
+		{"points = 1e1", "b"},
+		{"points in 1..2.5 sort id", "ac"},
+		{"points > -1 and not points = 10 sort id", "ac"},
+		{"due < 2024-02-01", "a"},
+		{"due = \"2024-02-01T07:00:00-05:00\"", "b"},
+		{"tags = y sort id", "ac"},
+		{"tags != x and type = task sort id", "bc"},
+		{"type = task sort points desc", "bca"},
+		{"type = task sort due", "abc"},
+		{"type = task sort due desc", "bac"},
+	}
+	for _, c := range queryTests {
+		_, docs, err := st.Query(parse(t, c.q))
+		if err != nil {
+			t.Error(err)
+		}
+		var ids string
+		for _, doc := range docs {
+			ids += doc.Id
+		}
+		if ids != c.ids {
+			t.Errorf("%s: expected %s got %s", c.q, c.ids, ids)
+		}
+	}
+
+	facets, err := st.Facets(Query{}, []string{"tags", "type"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(facets, map[string][]Facet{
+		"tags": {{"y", 2}, {"x", 1}},
+		"type": {{"task", 3}, {"note", 1}},
+	}) {
+		t.Errorf("unexpected facets %v", facets)
+	}
+	facets, _ = st.Facets(parse(t, "points > 1"), []string{"tags"})
+	if !reflect.DeepEqual(facets, map[string][]Facet{"tags": {{"y", 1}}}) {
+		t.Errorf("unexpected facets %v", facets)
+	}
+	if _, err := st.Facets(Query{}, []string{"points"}); err == nil {
+		t.Error("expected numbers not to be counted")
+	}
+}
+
+func parse(t *testing.T, s string) Query {
+	q, err := query.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Query{Where: q.Where, Sort: q.Sort}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("lorem ipsum ", 50)
+	var snippetTests = []struct {
+		text    string
+		words   []string
+		snippet string
+	}{
+		{"Buy milk & eggs", nil, "Buy milk &amp; eggs"},
+		{"Buy milk & eggs", []string{"milk", "eggs"}, "Buy <em>milk</em> &amp; <em>eggs</em>"},
+		{"Buy Milk", []string{"milk"}, "Buy <em>Milk</em>"},
+		{"Buy milky", []string{"milk"}, "Buy milky"},
+		{long + "milk", []string{"milk"}, strings.Repeat("lorem ipsum ", 4) + "<em>milk</em>"},
+		{long, nil, strings.TrimSuffix(strings.Repeat("lorem ipsum ", 16), " ") + " lorem"},
+		{strings.Repeat("é", 150), nil, strings.Repeat("é", 100)},
+	}
+	for _, c := range snippetTests {
+		words := make(map[string]bool)
+		for _, w := range c.words {
+			words[w] = true
+		}
+		if got := snippet(c.text, func(word string) bool { return words[strings.ToLower(word)] }); got != c.snippet {
+			t.Errorf("snippet of %q with %v: expected %q, got %q", c.text, c.words, c.snippet, got)
+		}
+	}
+}
+
+func TestDiskQueryReaders(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, _ := NewDiskStore(path)
+	st.CreateCard("legacy", 0, map[string]string{"title": "milk"})
+	st.CreateCard("mine", 0, map[string]string{"title": "milk", "_owner": "joel"})
+	st.CreateCard("shared", 0, map[string]string{"title": "milk", "_owner": "bob", "_viewers": `["group:eng"]`})
+	st.CreateCard("theirs", 0, map[string]string{"title": "milk", "_owner": "bob"})
+
+	var readerTests = []struct {
+		readers []string
+		total   int
+	}{
+		{nil, 4},
+		{[]string{}, 1},
+		{[]string{"joel", "group:everyone"}, 2},
+		{[]string{"joel", "group:everyone", "group:eng"}, 3},
+		{[]string{"bob"}, 3},
+	}
+	for _, c := range readerTests {
+		if total, _, _ := st.Query(Query{Where: query.Contains{Words: []string{"milk"}}, Readers: c.readers}); total != c.total {
+			t.Errorf("%v: expected %d got %d", c.readers, c.total, total)
+		}
+	}
+}
+
+func TestDiskListDeleteUsers(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	st, _ := NewDiskStore(path)
+	for _, id := range []string{"zed", "amy", "joel"} {
+		st.CreateUser(&User{Id: id, Props: map[string]string{}})
+	}
+	if err := st.DeleteUser("joel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteUser("joel"); err != ErrorNotFound {
+		t.Errorf("expected ErrorNotFound deleting twice, got %v", err)
+	}
+
+	// Deletions survive reloading.
+	st, _ = NewDiskStore(path)
+	users, err := st.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Id != "amy" || users[1].Id != "zed" {
+		t.Errorf("expected amy and zed, got %v", users)
+	}
+	if _, err := st.FindUser("joel"); err != ErrorNotFound {
+		t.Errorf("expected deleted user to be gone, got %v", err)
+	}
+}
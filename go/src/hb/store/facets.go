@@ -0,0 +1,59 @@
+package store
+
+import (
+	"fmt"
+	"hb/query"
+	"hb/schema"
+	"sort"
+)
+
+// Gets the index field that a prop's values are counted by, as Store.Facets describes, or an error if they can't be.
+func FacetField(name string) (string, error) {
+	t := query.TypeOf(name)
+	if name == query.IdName || t == schema.Number || t == schema.Date {
+		return "", fmt.Errorf("can't count values of %s, which is %s", name, t)
+	}
+	return query.Field(name, t), nil
+}
+
+// Counts the values of a prop among docs, as Store.Facets describes.
+func countFacet(docs []*Doc, name string) []Facet {
+	t := query.TypeOf(name)
+	counts := make(map[string]int)
+	for _, doc := range docs {
+		value, ok := typedValue(doc, name, t)
+		if !ok {
+			continue
+		}
+		switch t {
+		case schema.Text, schema.RichText:
+			counts[schema.SortKey(value)]++
+		case schema.List:
+			list, _ := schema.ParseList(value)
+			seen := make(map[string]bool, len(list))
+			for _, item := range list {
+				if !seen[item] {
+					seen[item] = true
+					counts[item]++
+				}
+			}
+		default:
+			counts[value]++
+		}
+	}
+
+	facets := make([]Facet, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, Facet{Value: value, Count: count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	if len(facets) > FacetLimit {
+		facets = facets[:FacetLimit]
+	}
+	return facets
+}
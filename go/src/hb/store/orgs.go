@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// The org that users log in to unless they pick another, and the only org of a single-tenant server.
+const DefaultOrg = "hb"
+
+var ErrorNoOrg = errors.New("no such org")
+
+// Org ids name Solr cores and files, so they're restricted to lower-case letters, digits, '-' and '_'.
+var orgIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func ValidOrgId(orgId string) bool {
+	return orgIdPattern.MatchString(orgId)
+}
+
+// Orgs keeps a separate store for each organization, so that their cards and users are fully isolated. Stores are
+// opened on first use, and only for orgs that have been added, so that logins can't create them.
+// Orgs is safe for concurrent use.
+type Orgs struct {
+	lock   sync.Mutex
+	open   func(orgId string) (Store, error)
+	known  map[string]bool
+	stores map[string]Store
+}
+
+// Creates an Orgs that opens stores with the given function, starting with the given orgs.
+func NewOrgs(open func(orgId string) (Store, error), orgIds ...string) (*Orgs, error) {
+	orgs := &Orgs{
+		open:   open,
+		known:  make(map[string]bool),
+		stores: make(map[string]Store),
+	}
+	for _, orgId := range orgIds {
+		if err := orgs.Add(orgId); err != nil {
+			return nil, err
+		}
+	}
+	return orgs, nil
+}
+
+// Adds an org. Its store is opened (and created, if need be) when it's first used.
+func (orgs *Orgs) Add(orgId string) error {
+	if !ValidOrgId(orgId) {
+		return errors.New("invalid org id: " + orgId)
+	}
+	orgs.lock.Lock()
+	defer orgs.lock.Unlock()
+	orgs.known[orgId] = true
+	return nil
+}
+
+// Gets an org's store, opening it if necessary. Returns ErrorNoOrg if the org hasn't been added.
+func (orgs *Orgs) Get(orgId string) (Store, error) {
+	orgs.lock.Lock()
+	defer orgs.lock.Unlock()
+
+	if st, exists := orgs.stores[orgId]; exists {
+		return st, nil
+	}
+	if !orgs.known[orgId] {
+		return nil, ErrorNoOrg
+	}
+	st, err := orgs.open(orgId)
+	if err != nil {
+		return nil, err
+	}
+	orgs.stores[orgId] = st
+	return st, nil
+}
+
+// Lists the ids of all added orgs, in order.
+func (orgs *Orgs) Ids() []string {
+	orgs.lock.Lock()
+	defer orgs.lock.Unlock()
+
+	ids := make([]string, 0, len(orgs.known))
+	for orgId := range orgs.known {
+		ids = append(ids, orgId)
+	}
+	sort.Strings(ids)
+	return ids
+}
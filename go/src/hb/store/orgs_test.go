@@ -0,0 +1,53 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOrgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hborgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opened := 0
+	orgs, err := NewOrgs(func(orgId string) (Store, error) {
+		opened++
+		return Open("disk", dir, orgId)
+	}, DefaultOrg, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewOrgs(nil, "../etc"); err == nil {
+		t.Error("expected an invalid org id to be rejected")
+	}
+
+	hb, err := orgs.Get(DefaultOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, _ := orgs.Get("acme")
+	if again, _ := orgs.Get("acme"); again != acme || opened != 2 {
+		t.Errorf("expected stores to be opened once each, opened %d", opened)
+	}
+	if _, err := orgs.Get("other"); err != ErrorNoOrg {
+		t.Errorf("expected ErrorNoOrg, got %v", err)
+	}
+
+	// Orgs don't see each other's data.
+	hb.CreateCard("a", 0, map[string]string{"title": "milk"})
+	if _, err := acme.LoadCard("a"); err != ErrorNotFound {
+		t.Errorf("expected card to be missing from another org, got %v", err)
+	}
+	if total, _, _ := acme.Query(parse(t, "milk")); total != 0 {
+		t.Errorf("expected no results from another org, got %d", total)
+	}
+
+	orgs.Add("other")
+	if ids := orgs.Ids(); len(ids) != 3 || ids[0] != "acme" || ids[2] != "other" {
+		t.Errorf("unexpected org ids %v", ids)
+	}
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Makes a snippet of text, as described by Query.Snippets. match reports whether a word matches the query; if nil,
+// none do. Words are split as the disk store splits them.
+func snippet(text string, match func(word string) bool) string {
+	type span struct{ start, end int }
+	var words []span
+	first := -1 // index into words of the first match
+	start := -1
+	for i, r := range text + " " {
+		if isSeparator(unicode.ToLower(r)) {
+			if start >= 0 {
+				words = append(words, span{start, i})
+				if first < 0 && match != nil && match(text[start:i]) {
+					first = len(words) - 1
+				}
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+
+	// Start at a word far enough before the first match to give it some context, and end at the last word that
+	// fits, cutting the text short only if a single word doesn't.
+	begin := 0
+	if first >= 0 {
+		for _, w := range words[:first+1] {
+			if w.start >= words[first].start-SnippetLength/4 {
+				begin = w.start
+				break
+			}
+		}
+	}
+	end := len(text)
+	if end-begin > SnippetLength {
+		end = begin
+		for _, w := range words {
+			if w.start >= begin && w.end-begin <= SnippetLength {
+				end = w.end
+			}
+		}
+		if end == begin {
+			end = begin + SnippetLength
+			for end > begin && !utf8.RuneStart(text[end]) {
+				end--
+			}
+		}
+	}
+
+	var buf strings.Builder
+	pos := begin
+	for _, w := range words {
+		if w.start < begin || w.end > end || match == nil || !match(text[w.start:w.end]) {
+			continue
+		}
+		buf.WriteString(html.EscapeString(text[pos:w.start]))
+		buf.WriteString("<em>" + html.EscapeString(text[w.start:w.end]) + "</em>")
+		pos = w.end
+	}
+	buf.WriteString(html.EscapeString(text[pos:end]))
+	return buf.String()
+}
+
+// Copies the named props, where they exist.
+func selectProps(props map[string]string, names []string) map[string]string {
+	selected := make(map[string]string, len(names))
+	for _, name := range names {
+		if value, exists := props[name]; exists {
+			selected[name] = value
+		}
+	}
+	return selected
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"hb/auth"
+	"hb/cherr"
+	"hb/schema"
+	"hb/solr"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users live in the same core as cards, distinguished by this id prefix.
+const userPrefix = "user|"
+
+type solrStore struct {
+	*fileLog
+	orgId string
+}
+
+// Creates a Solr-backed store for the given org, creating its core if necessary.
+// Solr isn't a good fit for append-only change logs, so they're kept in files under logDir.
+func NewSolrStore(orgId, logDir string) (Store, error) {
+	if err := solr.EnsureCore(orgId); err != nil {
+		return nil, err
+	}
+	log, err := newFileLog(logDir)
+	if err != nil {
+		return nil, err
+	}
+	return &solrStore{fileLog: log, orgId: orgId}, nil
+}
+
+func (st *solrStore) LoadCard(cardId string) (*Doc, error) {
+	js, err := st.getDoc(cardId)
+	if err != nil {
+		return nil, err
+	}
+	return docFromJson(js), nil
+}
+
+func (st *solrStore) SaveCard(cardId string, rev int, props map[string]string) error {
+	// Saving replaces the whole doc, so its creation time has to be carried over.
+	fields := cardFields(rev, props)
+	js, err := st.getDoc(cardId)
+	if err != nil && err != ErrorNotFound {
+		return err
+	}
+	if created := js.GetString("created"); created != nil {
+		fields["created"] = *created
+	}
+	return solr.UpdateDoc(st.orgId, cardId, fields, props, true)
+}
+
+func (st *solrStore) CreateCard(cardId string, rev int, props map[string]string) error {
+	fields := cardFields(rev, props)
+	fields["created"] = time.Now().UTC().Format(solr.DateFormat)
+	return solr.UpdateDoc(st.orgId, cardId, fields, props, true)
+}
+
+// Builds the fields stored alongside a card's props: its revision, who can read it, and its props' typed index
+// fields.
+func cardFields(rev int, props map[string]string) map[string]interface{} {
+	fields := map[string]interface{}{"rev": rev, "readers": auth.ACLOf(props).Readers()}
+	for name, value := range schema.IndexFields(props) {
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(solr.DateFormat)
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+func (st *solrStore) FindUser(userId string) (*User, error) {
+	js, err := st.getDoc(userPrefix + userId)
+	if err != nil {
+		return nil, err
+	}
+	return userFromJson(js), nil
+}
+
+func (st *solrStore) CreateUser(user *User) error {
+	var fields map[string]interface{}
+	if user.PassHash != "" {
+		fields = map[string]interface{}{"passhash": user.PassHash}
+	}
+	return solr.UpdateDoc(st.orgId, userPrefix+user.Id, fields, user.Props, true)
+}
+
+// The most users ListUsers returns. Orgs are expected to be far smaller than this.
+const maxUsers = 10000
+
+func (st *solrStore) ListUsers() ([]*User, error) {
+	params := url.Values{
+		"q":    []string{"id:" + solr.Escape(userPrefix) + "*"},
+		"sort": []string{"id asc"},
+		"rows": []string{strconv.Itoa(maxUsers)},
+	}
+	_, results, err := solr.GetDocs(st.orgId, params)
+	if err != nil {
+		return nil, cherr.Errorf(err, "failed to list users")
+	}
+	users := make([]*User, len(results))
+	for i, js := range results {
+		users[i] = userFromJson(js)
+	}
+	return users, nil
+}
+
+func (st *solrStore) DeleteUser(userId string) error {
+	if _, err := st.getDoc(userPrefix + userId); err != nil {
+		return err
+	}
+	return solr.DeleteDoc(st.orgId, userPrefix+userId, true)
+}
+
+// Gets the params that find the cards a query does.
+func matchParams(q Query) url.Values {
+	params := url.Values{
+		"q":  []string{solrQuery(q.Where)},
+		"fq": []string{"-id:" + solr.Escape(userPrefix) + "*"},
+	}
+	if q.Readers != nil {
+		readers := make([]string, len(q.Readers))
+		for i, p := range q.Readers {
+			readers[i] = solr.Escape(p)
+		}
+		// Cards saved before ACLs existed aren't indexed with readers, and are open to everyone.
+		params.Add("fq", "readers:("+strings.Join(readers, " OR ")+") OR (*:* -readers:[* TO *])")
+	}
+	for _, e := range q.Filters {
+		params.Add("fq", solrQuery(e))
+	}
+	return params
+}
+
+func (st *solrStore) Query(q Query) (int, []*Doc, error) {
+	params := matchParams(q)
+	if q.Sort != nil {
+		params.Set("sort", solrSort(q.Sort))
+	}
+	if q.Start > 0 {
+		params.Set("start", strconv.Itoa(q.Start))
+	}
+	if q.Rows > 0 {
+		params.Set("rows", strconv.Itoa(q.Rows))
+	}
+	if q.Fields != nil {
+		// Props to be snipped are fetched too, for docs that Solr doesn't highlight.
+		fields := []string{"id", "rev", "created", "modified"}
+		for _, name := range append(q.Fields, q.Snippets...) {
+			fields = append(fields, "prop_"+name)
+		}
+		params.Set("fl", strings.Join(fields, ","))
+	}
+	if len(q.Snippets) > 0 {
+		fields := make([]string, len(q.Snippets))
+		for i, name := range q.Snippets {
+			fields[i] = "prop_" + name
+		}
+		params.Set("hl", "true")
+		params.Set("hl.fl", strings.Join(fields, ","))
+		params.Set("hl.snippets", "1")
+		params.Set("hl.fragsize", strconv.Itoa(SnippetLength))
+		params.Set("hl.encoder", "html")
+		params.Set("hl.simple.pre", "<em>")
+		params.Set("hl.simple.post", "</em>")
+	}
+
+	total, results, highlighting, err := solr.GetHighlightedDocs(st.orgId, params)
+	if err != nil {
+		return 0, nil, cherr.Errorf(err, "failed to query %s", params.Get("q"))
+	}
+	docs := make([]*Doc, len(results))
+	for i, js := range results {
+		doc := docFromJson(js)
+		if q.Snippets != nil {
+			doc.Snippets = make(map[string]string)
+			for _, name := range q.Snippets {
+				value, exists := doc.Props[name]
+				if !exists {
+					continue
+				}
+				if hl, ok := highlighting[doc.Id].(map[string]interface{}); ok {
+					if frags, ok := hl["prop_"+name].([]interface{}); ok && len(frags) > 0 {
+						if frag, ok := frags[0].(string); ok {
+							doc.Snippets[name] = frag
+							continue
+						}
+					}
+				}
+				doc.Snippets[name] = snippet(value, nil)
+			}
+		}
+		if q.Fields != nil {
+			doc.Props = selectProps(doc.Props, q.Fields)
+		}
+		docs[i] = doc
+	}
+	return total, docs, nil
+}
+
+func (st *solrStore) Facets(q Query, names []string) (map[string][]Facet, error) {
+	params := matchParams(q)
+	params.Set("rows", "0")
+	params.Set("facet", "true")
+	params.Set("facet.mincount", "1")
+	params.Set("facet.limit", strconv.Itoa(FacetLimit))
+	params.Set("facet.sort", "count")
+	fields := make(map[string]string, len(names))
+	for _, name := range names {
+		field, err := FacetField(name)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = field
+		params.Add("facet.field", field)
+	}
+
+	counts, err := solr.GetFacetFields(st.orgId, params)
+	if err != nil {
+		return nil, cherr.Errorf(err, "failed to count facets of %s", params.Get("q"))
+	}
+	facets := make(map[string][]Facet, len(names))
+	for name, field := range fields {
+		facets[name] = []Facet{}
+		values := counts.GetArray(field)
+		for i := 0; i+1 < len(values); i += 2 {
+			value, _ := values[i].(string)
+			count, _ := values[i+1].(float64)
+			facets[name] = append(facets[name], Facet{Value: value, Count: int(count)})
+		}
+	}
+	return facets, nil
+}
+
+// Solr stems and tokenizes text, which matching cards as the disk store does doesn't, so it only guesses.
+func (st *solrStore) Match(q Query, doc *Doc) (bool, bool) {
+	return matchQuery(q, doc), false
+}
+
+func (st *solrStore) getDoc(id string) (solr.JsonObject, error) {
+	js, err := solr.GetDoc(st.orgId, id)
+	if err == solr.ErrorNotFound {
+		return nil, ErrorNotFound
+	}
+	return js, err
+}
+
+func docFromJson(js solr.JsonObject) *Doc {
+	doc := &Doc{Props: propsFromJson(js)}
+	if id := js.GetString("id"); id != nil {
+		doc.Id = *id
+	}
+	if rev := js.GetNumber("rev"); rev != nil {
+		doc.Rev = int(*rev)
+	}
+	if created := js.GetString("created"); created != nil {
+		doc.Created, _ = time.Parse(solr.DateFormat, *created)
+	}
+	if modified := js.GetString("modified"); modified != nil {
+		doc.Modified, _ = time.Parse(solr.DateFormat, *modified)
+	}
+	return doc
+}
+
+func userFromJson(js solr.JsonObject) *User {
+	user := &User{Props: propsFromJson(js)}
+	if id := js.GetString("id"); id != nil {
+		user.Id = strings.TrimPrefix(*id, userPrefix)
+	}
+	if hash := js.GetString("passhash"); hash != nil {
+		user.PassHash = *hash
+	}
+	return user
+}
+
+func propsFromJson(js solr.JsonObject) map[string]string {
+	props := make(map[string]string)
+	for k, v := range js {
+		if s, ok := v.(string); ok && strings.HasPrefix(k, "prop_") {
+			props[k[5:]] = s
+		}
+	}
+	return props
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"hb/query"
+	"hb/schema"
+	"strings"
+)
+
+// The catch-all field that every prop is copied into, for words searched for in any prop. See solr/schema.xml.
+const textField = "text"
+
+// Compiles a query expression to Solr syntax. Every value is quoted, so that nothing in it can change the
+// meaning of the query.
+func solrQuery(e query.Expr) string {
+	switch e := e.(type) {
+	case nil, query.All:
+		return "*:*"
+	case query.And:
+		return "(" + solrQueries(e.Exprs, " AND ") + ")"
+	case query.Or:
+		return "(" + solrQueries(e.Exprs, " OR ") + ")"
+	case query.Not:
+		return "(*:* -" + solrQuery(e.Expr) + ")"
+	case query.Contains:
+		field := textField
+		if e.Prop != "" {
+			field = "prop_" + e.Prop
+		}
+		return field + ":" + quote(strings.Join(e.Words, " "))
+	case query.Equals:
+		field := query.Field(e.Prop, e.Type)
+		if e.Type != schema.Text && e.Type != schema.RichText {
+			return field + ":" + quote(e.Value)
+		}
+		// Sort keys are truncated, so long values must match the prop's words too.
+		key := schema.SortKey(e.Value)
+		q := field + ":" + quote(key)
+		if words := query.Words(e.Value); len(key) < len(strings.ToLower(strings.TrimSpace(e.Value))) && len(words) > 0 {
+			q = "(" + q + " AND prop_" + e.Prop + ":" + quote(strings.Join(words, " ")) + ")"
+		}
+		return q
+	case query.Range:
+		field := query.Field(e.Prop, e.Type)
+		q := field + ":"
+		if e.Min == nil {
+			q += "[*"
+		} else if e.Min.Inclusive {
+			q += "[" + quote(e.Min.Value)
+		} else {
+			q += "{" + quote(e.Min.Value)
+		}
+		q += " TO "
+		if e.Max == nil {
+			q += "*]"
+		} else if e.Max.Inclusive {
+			q += quote(e.Max.Value) + "]"
+		} else {
+			q += quote(e.Max.Value) + "}"
+		}
+		return q
+	case query.Refs:
+		names := schema.PropsOfType(schema.CardRef)
+		if len(names) == 0 {
+			return "(*:* -*:*)"
+		}
+		refs := make([]string, len(names))
+		for i, name := range names {
+			refs[i] = schema.KeyPrefix + name + ":" + quote(e.CardId)
+		}
+		return "(" + strings.Join(refs, " OR ") + ")"
+	}
+	panic("unknown query expression")
+}
+
+func solrQueries(exprs []query.Expr, op string) string {
+	qs := make([]string, len(exprs))
+	for i, e := range exprs {
+		qs[i] = solrQuery(e)
+	}
+	return strings.Join(qs, op)
+}
+
+// Compiles a sort to Solr's sort param. Ties are broken by id, as the disk store breaks them.
+func solrSort(s *query.Sort) string {
+	order := " asc"
+	if s.Desc {
+		order = " desc"
+	}
+	return query.Field(s.Prop, s.Type) + order + ",id asc"
+}
+
+// Quotes a value as a Solr phrase.
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSolrQuery(t *testing.T) {
+	long := strings.Repeat("x", 70)
+	var solrTests = []struct {
+		q    string
+		solr string
+	}{
+		{"", "*:*"},
+		{"Milk", `text:"milk"`},
+		{`title:"whole milk"`, `prop_title:"whole milk"`},
+		{"type = comment and target = @a-b_c", `(sort_type:"comment" AND key_target:"a-b_c")`},
+		{`title = "x\" OR *:*"`, `sort_title:"x\" or *:*"`},
+		{"title = " + long, `(sort_title:"` + long[:64] + `" AND prop_title:"` + long + `")`},
+		{"done != true or kind = note", `((*:* -bool_done:"true") OR key_kind:"note")`},
+		{"modified >= 2014-03-01", `modified:["2014-03-01T00:00:00Z" TO *]`},
+		{"refs @abc", `(key_target:"abc")`},
+	}
+	for _, c := range solrTests {
+		q := parse(t, c.q)
+		if got := solrQuery(q.Where); got != c.solr {
+			t.Errorf("%s: expected %s, got %s", c.q, c.solr, got)
+		}
+	}
+
+	if got := solrSort(parse(t, "sort title desc").Sort); got != "sort_title desc,id asc" {
+		t.Errorf("expected a sort by title then id, got %s", got)
+	}
+}
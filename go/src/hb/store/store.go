@@ -0,0 +1,136 @@
+// Package store abstracts persistence for cards and users.
+//
+// Everything above this package (cards, searches, users) talks to a Store rather than to Solr directly, so that
+// hb can run against an embedded on-disk store on laptops and in tests, or against Solr in production.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"hb/ot"
+	"hb/query"
+	"path/filepath"
+	"time"
+)
+
+var ErrorNotFound = errors.New("no document found")
+
+// Doc is a stored card: its id, creation and last modification times, and string properties.
+// Props reflect the card as of revision Rev; later revisions, if any, are in the card's change log.
+type Doc struct {
+	Id       string
+	Rev      int
+	Created  time.Time // Zero for cards stored before creation times were kept.
+	Modified time.Time
+	Props    map[string]string
+
+	// Snippets of props asked for by a query, keyed by prop name. See Query.Snippets.
+	Snippets map[string]string
+}
+
+// Change is a single accepted change to a card, as recorded in its append-only change log.
+type Change struct {
+	Rev    int // The revision produced by this change; the first change to a card is revision 1.
+	Prop   string
+	Ops    ot.Ops
+	ConnId string
+	UserId string
+	Time   time.Time
+}
+
+// User is a stored user record. PassHash is kept out of Props, which are indexed; see package auth for its format.
+type User struct {
+	Id       string
+	PassHash string
+	Props    map[string]string
+}
+
+// Query describes a search over stored cards.
+type Query struct {
+	Where   query.Expr   // Cards to match; nil matches all of them.
+	Filters []query.Expr // Further expressions that cards must match. Solr caches these separately from Where.
+	Sort    *query.Sort  // If nil, results are in the store's own order.
+	Start   int          // Number of results to skip.
+	Rows    int          // Maximum number of results to return.
+
+	// If not nil, only cards that one of these principals can read match. See package auth.
+	Readers []string
+
+	// If not nil, only these props of the cards found are returned.
+	Fields []string
+
+	// Props to make snippets of: HTML of up to about SnippetLength bytes of the prop's text, around words that
+	// match the query, with those words in <em>. Props with no matches are snipped from their start.
+	Snippets []string
+}
+
+// Roughly how much text snippets hold.
+const SnippetLength = 200
+
+// A value of a prop, and how many cards found have it. See Store.Facets.
+type Facet struct {
+	Value string
+	Count int
+}
+
+// How many of a prop's values Store.Facets counts.
+const FacetLimit = 20
+
+// Store is implemented by each persistence backend.
+// Implementations must be safe for concurrent use, as each card runs in its own goroutine.
+type Store interface {
+	// Loads a card's properties. Returns ErrorNotFound if the card doesn't exist.
+	LoadCard(cardId string) (*Doc, error)
+
+	// Saves a card's properties as of revision rev, replacing whatever was there.
+	SaveCard(cardId string, rev int, props map[string]string) error
+
+	// Creates a new card with the given initial properties as of revision rev.
+	CreateCard(cardId string, rev int, props map[string]string) error
+
+	// Appends a change to a card's change log. Changes must be appended in revision order.
+	AppendChange(cardId string, change *Change) error
+
+	// Loads a card's entire change log, in revision order.
+	LoadChanges(cardId string) ([]*Change, error)
+
+	// Finds a user by id. Returns ErrorNotFound if there's no such user.
+	FindUser(userId string) (*User, error)
+
+	// Creates (or replaces) a user.
+	CreateUser(user *User) error
+
+	// Lists all users, in id order.
+	ListUsers() ([]*User, error)
+
+	// Deletes a user. Returns ErrorNotFound if there's no such user.
+	DeleteUser(userId string) error
+
+	// Queries cards, returning the total number of matches and up to q.Rows of them, from the q.Start'th on.
+	Query(q Query) (total int, docs []*Doc, err error)
+
+	// Counts the values that the named props have among all the cards q finds, regardless of its page, returning
+	// the FacetLimit most common values of each, most common first, and ties in value order. Props are counted by
+	// the values they're indexed by, as query.Field finds them: text by its sort key, and lists by their items.
+	// Props indexed as numbers or dates can't be counted.
+	Facets(q Query, names []string) (map[string][]Facet, error)
+
+	// Reports whether q finds a card with the given id and props, as Query would, and whether that's certain.
+	// Created and Modified aren't looked at. Stores that analyze text in ways this can't repeat can only guess.
+	Match(q Query, doc *Doc) (found, certain bool)
+}
+
+// Opens an org's store of the given kind ("solr" or "disk"), keeping any local data in dir. Each org gets its own
+// Solr core, or its own file on disk.
+func Open(kind, dir, orgId string) (Store, error) {
+	if !ValidOrgId(orgId) {
+		return nil, fmt.Errorf("invalid org id: %q", orgId)
+	}
+	switch kind {
+	case "solr":
+		return NewSolrStore(orgId, filepath.Join(dir, "logs", orgId))
+	case "disk":
+		return NewDiskStore(filepath.Join(dir, orgId+".db"))
+	}
+	return nil, fmt.Errorf("unknown store kind: %s", kind)
+}
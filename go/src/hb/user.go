@@ -1,20 +1,155 @@
 package hb
 
 import (
-	"hb/solr"
-	"hb/ot"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hb/auth"
+	"hb/store"
+	"log"
 )
 
-func FindUser(id string) (solr.JsonObject, error) {
-	return solr.GetDoc("hb", solrId(id))
+// Users stored before passwords were hashed have them in plaintext, in this prop.
+const legacyPassProp = "pass"
+
+// User props managed through the admin API. Roles is a JSON array of role names; disabled users have "true".
+const (
+	rolesProp    = "roles"
+	disabledProp = "disabled"
+)
+
+// Admins can manage their org's users through the admin API.
+const AdminRole = "admin"
+
+// The roles a user can have.
+var Roles = []string{AdminRole}
+
+var (
+	ErrorBadPassword = errors.New("incorrect password")
+	ErrorDisabled    = errors.New("user disabled")
+)
+
+// Finds a user in an org. Returns store.ErrorNoOrg if there's no such org.
+func FindUser(orgId, id string) (*store.User, error) {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return nil, err
+	}
+	return st.FindUser(id)
+}
+
+func NewUser(orgId, id, pass string) error {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(pass)
+	if err != nil {
+		return err
+	}
+	return st.CreateUser(&store.User{Id: id, PassHash: hash, Props: map[string]string{}})
+}
+
+// Finds a user in an org and checks their password. Users with a plaintext password, or a hash weaker than current
+// ones, get it rehashed on their first successful login. Users without a password can't log in. Disabled users are
+// refused with ErrorDisabled, even with the right password.
+func Authenticate(orgId, id, pass string) (*store.User, error) {
+	st, err := orgs.Get(orgId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := st.FindUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, hasLegacy := user.Props[legacyPassProp]
+	rehash := hasLegacy
+	switch {
+	case user.PassHash != "":
+		var ok bool
+		if ok, rehash = auth.CheckPassword(user.PassHash, pass); !ok {
+			return nil, ErrorBadPassword
+		}
+		rehash = rehash || hasLegacy
+	case hasLegacy:
+		if !auth.CheckPlaintext(legacy, pass) {
+			return nil, ErrorBadPassword
+		}
+	default:
+		return nil, ErrorBadPassword
+	}
+
+	if isDisabled(user) {
+		return nil, ErrorDisabled
+	}
+	if rehash {
+		if err := setPassword(st, user, pass); err != nil {
+			// They can still log in; we'll try again next time.
+			log.Printf("error rehashing password for user %s: %s", id, err)
+		}
+	}
+	return user, nil
+}
+
+// Hashes the plaintext passwords of users in all orgs, so that none are left in the stores, and drops those of users
+// who have a hash already. Run on startup: users otherwise keep their plaintext password until they next log in.
+func MigratePasswords() error {
+	for _, orgId := range orgs.Ids() {
+		st, err := orgs.Get(orgId)
+		if err != nil {
+			return err
+		}
+		users, err := st.ListUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			legacy, exists := user.Props[legacyPassProp]
+			if !exists {
+				continue
+			}
+			if user.PassHash == "" {
+				err = setPassword(st, user, legacy)
+			} else {
+				delete(user.Props, legacyPassProp)
+				err = st.CreateUser(user)
+			}
+			if err != nil {
+				return fmt.Errorf("error migrating password for user %s in org %s: %s", user.Id, orgId, err)
+			}
+			log.Printf("hashed plaintext password for user %s in org %s", user.Id, orgId)
+		}
+	}
+	return nil
+}
+
+func userRoles(user *store.User) []string {
+	var roles []string
+	json.Unmarshal([]byte(user.Props[rolesProp]), &roles)
+	return roles
+}
+
+func hasRole(user *store.User, role string) bool {
+	for _, r := range userRoles(user) {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
-func NewUser(id, pass string) (error) {
-	return solr.UpdateDoc("hb", solrId(id), map[string]*ot.Doc{
-			"pass": ot.NewDoc(pass), // TODO: hash this.
-		}, true)
+func isDisabled(user *store.User) bool {
+	return user.Props[disabledProp] == "true"
 }
 
-func solrId(id string) string {
-	return "user|" + id
+// Replaces a user's password, and any plaintext one they had.
+func setPassword(st store.Store, user *store.User, pass string) error {
+	hash, err := auth.HashPassword(pass)
+	if err != nil {
+		return err
+	}
+	user.PassHash = hash
+	delete(user.Props, legacyPassProp)
+	return st.CreateUser(user)
 }
@@ -1,15 +1,39 @@
 package main
 
 import (
-	_ "hb" // Other handlers and initialization are done in hb's init().
+	"context"
+	"flag"
+	"hb" // Other handlers are registered in hb's init().
+	"hb/card"
+	"hb/store"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var tmpls *template.Template
 
+var (
+	storeKind = flag.String("store", "solr", "storage backend: 'solr' or 'disk'")
+	dataDir   = flag.String("data", "data", "directory for local data (change logs, and everything for 'disk')")
+	orgIds    = flag.String("orgs", store.DefaultOrg, "comma-separated ids of the organizations to serve")
+
+	bootstrapAdmin = flag.String("bootstrap-admin", "", "admin user to create in each org that lacks it, with the password in $HB_ADMIN_PASSWORD")
+
+	flushInterval = flag.Duration("flush-interval", card.FlushInterval, "maximum time a card change goes unsaved")
+	flushOps      = flag.Int("flush-ops", card.MaxDirtyOps, "maximum number of unsaved changes per card")
+
+	sessionTTL = flag.Duration("session-ttl", hb.SessionTTL, "how long session tokens stay valid")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for connections to drain on shutdown")
+)
+
 func uiServer(tmplName string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Re-read these every time, so we don't have to restart the server to pick up changes.
@@ -27,8 +51,38 @@ func uiServer(tmplName string) func(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.Parse()
+
+	orgs, err := store.NewOrgs(func(orgId string) (store.Store, error) {
+		return store.Open(*storeKind, *dataDir, orgId)
+	}, strings.Split(*orgIds, ",")...)
+	if err != nil {
+		log.Fatalf("bad -orgs: %s", err)
+	}
+	// Open the orgs' stores up front, so that misconfiguration shows up now rather than on first login.
+	for _, orgId := range orgs.Ids() {
+		if _, err := orgs.Get(orgId); err != nil {
+			log.Fatalf("failed to open %s store for org %s: %s", *storeKind, orgId, err)
+		}
+	}
+	hb.Init(orgs)
+	if err := hb.MigratePasswords(); err != nil {
+		log.Fatalf("failed to migrate passwords: %s", err)
+	}
+	if *bootstrapAdmin != "" {
+		pass := os.Getenv("HB_ADMIN_PASSWORD")
+		if pass == "" {
+			log.Fatalf("-bootstrap-admin needs a password in $HB_ADMIN_PASSWORD")
+		}
+		if err := hb.BootstrapAdmin(*bootstrapAdmin, pass); err != nil {
+			log.Fatalf("failed to bootstrap admin %s: %s", *bootstrapAdmin, err)
+		}
+	}
+	card.FlushInterval = *flushInterval
+	card.MaxDirtyOps = *flushOps
+	hb.SessionTTL = *sessionTTL
+
 	// Parse templates and ui templates.
-	var err error
 	tmpls, err = template.ParseFiles("pub/ui.html", "pub/card.html")
 	if err != nil {
 		panic(err)
@@ -43,6 +97,32 @@ func main() {
 	http.Handle("/ui/", http.HandlerFunc(uiServer("ui.html")))
 	http.Handle("/card/", http.HandlerFunc(uiServer("card.html")))
 
-	// This blocks until crash.
-	log.Fatal(http.ListenAndServe("127.0.0.1:8080", nil))
+	srv := &http.Server{Addr: "127.0.0.1:8080"}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// This blocks until we're told to stop.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	log.Printf("received %s", <-sigs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections, then close the ones we have. Streaming sockjs requests only go idle once their
+	// sessions are closed, so the two have to overlap.
+	srvDone := make(chan error, 1)
+	go func() {
+		srvDone <- srv.Shutdown(ctx)
+	}()
+	if err := hb.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down hb: %s", err)
+	}
+	if err := <-srvDone; err != nil {
+		log.Printf("error shutting down http server: %s", err)
+	}
+	log.Printf("shutdown complete")
 }
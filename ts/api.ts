@@ -7,8 +7,13 @@ module hb {
   export var MsgRevise = "revise";
   export var MsgSubscribeSearch = "subscribesearch";
   export var MsgUnsubscribeSearch = "unsubscribesearch";
+  export var MsgPageSearch = "pagesearch";
   export var MsgSearchResults = "searchresults";
   export var MsgCreateCard = "createcard";
+  export var MsgCursor = "cursor";
+  export var MsgPresence = "presence";
+  export var MsgComment = "comment";
+  export var MsgResolveComment = "resolvecomment";
   export var MsgError = "error";
 
   export interface Change {
@@ -26,7 +31,11 @@ module hb {
     Revise?: ReviseReq;
     SubscribeSearch?: SubscribeSearchReq;
     UnsubscribeSearch?: UnsubscribeSearchReq;
+    PageSearch?: PageSearchReq;
     CreateCard?: CreateCardReq;
+    Cursor?: CursorReq;
+    Comment?: CommentReq;
+    ResolveComment?: ResolveCommentReq;
   }
 
   export interface LoginReq {
@@ -44,19 +53,33 @@ module hb {
   }
 
   export interface ReviseReq {
-    ConnId: string;
     SubId: number;
     CardId: string;
     Rev: number;
     Change: Change;
   }
 
+  // Connection fills in SubId.
   export interface SubscribeSearchReq {
+    SubId?: number;
     Query: string;
+    Filters?: string[];
+    Sort?: string;
+    Start?: number;
+    Rows?: number;
+    Fields?: string[];
+    Snippets?: string[];
+    Facets?: string[];
   }
 
   export interface UnsubscribeSearchReq {
-    Query: string;
+    SubId: number;
+  }
+
+  export interface PageSearchReq {
+    SubId: number;
+    Start: number;
+    Rows: number;
   }
 
   export interface CreateCardReq {
@@ -64,6 +87,33 @@ module hb {
     Props: {[prop: string]: string};
   }
 
+  export interface Cursor {
+    Prop: string;
+    Rev: number;
+    Start: number;
+    End: number;
+  }
+
+  export interface CursorReq {
+    SubId: number;
+    Cursor: Cursor;
+  }
+
+  export interface CommentReq {
+    SubId: number;
+    Prop: string;
+    Rev: number;
+    Start: number;
+    End: number;
+    Body: string;
+  }
+
+  export interface ResolveCommentReq {
+    SubId: number;
+    CommentId: string;
+    Resolved: boolean;
+  }
+
   // Responses.
   export interface Rsp {
     Type: string;
@@ -75,6 +125,9 @@ module hb {
     SubscribeSearch?: SubscribeSearchRsp;
     UnsubscribeSearch?: UnsubscribeSearchRsp;
     CreateCard?: CreateCardRsp;
+    Presence?: PresenceRsp;
+    Comment?: CommentRsp;
+    ResolveComment?: ResolveCommentRsp;
 
     SearchResults?: SearchResultsRsp;
     Error?: ErrorRsp;
@@ -90,6 +143,51 @@ module hb {
     SubId: number;
     Rev:   number;
     Props: {[prop: string]: string};
+    Present?: Presence[];
+    Comments?: Comment[];
+  }
+
+  export interface Comment {
+    Id: string;
+    UserId: string;
+    Prop: string;
+    Start: number;
+    End: number;
+    Resolved: boolean;
+    Orphaned: boolean;
+  }
+
+  export interface CommentRsp {
+    CardId: string;
+    SubId: number;
+    CommentId: string;
+    Rev: number;
+  }
+
+  export interface ResolveCommentRsp {
+    CardId: string;
+    SubId: number;
+    CommentId: string;
+    Resolved: boolean;
+    Rev: number;
+  }
+
+  export interface Presence {
+    ConnId: string;
+    SubId: number;
+    UserId: string;
+    Cursor?: Cursor;
+  }
+
+  export var PresenceJoin = "join";
+  export var PresenceLeave = "leave";
+  export var PresenceCursor = "cursor";
+
+  export interface PresenceRsp {
+    CardId: string;
+    SubIds: number[];
+    Event: string;
+    Presence: Presence;
   }
 
   export interface UnsubscribeCardRsp {
@@ -99,6 +197,7 @@ module hb {
   export interface ReviseRsp {
     OrigConnId: string;
     OrigSubId:  number;
+    AuthorId:   string;
     CardId:  string;
     SubIds: number[];
     Rev:    number;
@@ -106,11 +205,12 @@ module hb {
   }
 
   export interface SubscribeSearchRsp {
+    SubId: number;
     Query: string;
   }
 
   export interface UnsubscribeSearchRsp {
-    Query: string;
+    SubId: number;
   }
 
   export interface CreateCardRsp {
@@ -118,16 +218,42 @@ module hb {
     CardId: string;
   }
 
+  // See api.SearchResultsRsp for how to apply changes to a page. Connection does, filling in Results.
   export interface SearchResultsRsp {
+    SubId: number;
     Query: string;
+    Start: number;
+    Rows: number;
     Total: number;
-    Results: SearchResult[];
+    Reset?: boolean;
+    Results?: SearchResult[];
+    Removed?: string[];
+    Added?: AddedSearchResult[];
+    Moved?: MovedSearchResult[];
+    Updated?: SearchResult[];
+    Facets?: {[prop: string]: Facet[]};
+  }
+
+  export interface Facet {
+    Value: string;
+    Count: number;
   }
 
+  // Snippets are HTML, escaped by the server.
   export interface SearchResult {
     CardId: string;
-    Title: string;
-    Body: string;
+    Modified: string;
+    Props?: {[prop: string]: string};
+    Snippets?: {[prop: string]: string};
+  }
+
+  export interface AddedSearchResult extends SearchResult {
+    Index: number;
+  }
+
+  export interface MovedSearchResult {
+    CardId: string;
+    Index: number;
   }
 
   export interface ErrorRsp {
@@ -45,7 +45,7 @@ module hb {
     }
 
     setCardId(cardId: string) {
-      var query = "prop_type: comment AND prop_target:" + cardId;
+      var query = "type = comment and target = @" + cardId;
       if (this._sub) {
         if (this._sub.query == query) {
           return;
@@ -56,7 +56,7 @@ module hb {
       this._cardId = cardId;
       this._sub = this._ctx.connection().subscribeSearch(query, (rsp) => {
         this.render(rsp);
-      });
+      }, ["body"], []);
     }
 
     private render(rsp: SearchResultsRsp) {
@@ -69,7 +69,7 @@ module hb {
     private createItem(result: SearchResult): HTMLElement {
       var item = document.createElement("div");
       item.className = "item";
-      item.textContent = result.Body;
+      item.textContent = (result.Props || {})["body"] || "";
       return item;
     }
   }
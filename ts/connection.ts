@@ -23,7 +23,7 @@ module hb {
     revise(rev: number, change: Change) {
       var req: Req = {
         Type: MsgRevise,
-        Revise: { ConnId: this._conn.connId(), SubId: this._subId, CardId: this.cardId, Rev: rev, Change: change }
+        Revise: { SubId: this._subId, CardId: this.cardId, Rev: rev, Change: change }
       };
       this._conn._send(req);
     }
@@ -38,22 +38,32 @@ module hb {
   }
 
   export class SearchSubscription {
+    _subId: number;
+
     constructor(
         private _conn: Connection,
         public query: string,
-        public _onsearchresults: (rsp: SearchResultsRsp) => void) { }
+        public _onsearchresults: (rsp: SearchResultsRsp) => void) {
+      this._subId = ++_conn._curSubId;
+    }
 
     unsubscribe() {
-      var subs = this._conn._searchSubs[this.query];
-      subs.splice(subs.indexOf(this), 1);
-      if (subs.length == 0) {
-        var req: Req = {
-          Type: MsgUnsubscribeSearch,
-          UnsubscribeSearch: { Query: this.query }
-        };
-        this._conn._send(req);
-        delete this._conn._searchSubs[this.query];
-      }
+      var req: Req = {
+        Type: MsgUnsubscribeSearch,
+        UnsubscribeSearch: { SubId: this._subId }
+      };
+      this._conn._send(req);
+      delete this._conn._searchSubs[this._subId];
+      delete this._conn._searchPages[this._subId];
+    }
+
+    // Moves the subscription to another page of results.
+    page(start: number, rows: number) {
+      var req: Req = {
+        Type: MsgPageSearch,
+        PageSearch: { SubId: this._subId, Start: start, Rows: rows }
+      };
+      this._conn._send(req);
     }
   }
 
@@ -63,7 +73,8 @@ module hb {
     private _onCreates: {[createId: number]: (rsp: CreateCardRsp) => void} = {};
 
     _cardSubs: {[key: string]: CardSubscription} = {};
-    _searchSubs: {[query: string]: SearchSubscription[]} = {};
+    _searchSubs: {[subId: number]: SearchSubscription} = {};
+    _searchPages: {[subId: number]: SearchResultsRsp} = {};
     _curSubId = 0;
     _curCreateId = 0;
 
@@ -121,18 +132,19 @@ module hb {
       return sub;
     }
 
-    subscribeSearch(query: string, onSearchResults: (rsp: SearchResultsRsp) => void): SearchSubscription {
-      if (!(query in this._searchSubs)) {
-        this._searchSubs[query] = [];
-        var req: Req = {
-          Type: MsgSubscribeSearch,
-          SubscribeSearch: { Query: query }
-        };
-        this._send(req);
-      }
+    // Results hold the given props, and snippets of others, or the server's default ones if these are omitted. Each
+    // subscription has its own page, even if others are to the same query.
+    subscribeSearch(query: string, onSearchResults: (rsp: SearchResultsRsp) => void,
+        fields?: string[], snippets?: string[]): SearchSubscription {
+      return this.subscribeSearchWith({ Query: query, Fields: fields, Snippets: snippets }, onSearchResults);
+    }
 
-      var sub = new SearchSubscription(this, query, onSearchResults);
-      this._searchSubs[query].push(sub);
+    // Like subscribeSearch, with the filters, sort, page and fields of req.
+    subscribeSearchWith(req: SubscribeSearchReq, onSearchResults: (rsp: SearchResultsRsp) => void): SearchSubscription {
+      var sub = new SearchSubscription(this, req.Query, onSearchResults);
+      this._searchSubs[sub._subId] = sub;
+      req.SubId = sub._subId;
+      this._send({ Type: MsgSubscribeSearch, SubscribeSearch: req });
       return sub;
     }
 
@@ -189,15 +201,77 @@ module hb {
     }
 
     private handleSearchResults(rsp: SearchResultsRsp) {
-      var subs = this._searchSubs[rsp.Query];
-      if (!subs) {
+      var sub = this._searchSubs[rsp.SubId];
+      if (!sub) {
         this._ctx.log("got results for search " + rsp.Query + " with no local subscription");
         return;
       }
+      if (!this.applyResults(rsp)) {
+        this._ctx.log("dropping results for search " + rsp.Query + " that don't apply to its page");
+        return;
+      }
+      sub._onsearchresults(rsp);
+    }
+
+    // Applies results to the page last received for their subscription, filling in rsp.Results with the whole page, and
+    // rsp.Facets with the latest ones.
+    private applyResults(rsp: SearchResultsRsp): boolean {
+      if (rsp.Reset) {
+        rsp.Results = rsp.Results || [];
+        this._searchPages[rsp.SubId] = rsp;
+        return true;
+      }
+      var page = this._searchPages[rsp.SubId];
+      if (!page || page.Start != rsp.Start || page.Rows != rsp.Rows) {
+        return false;
+      }
+
+      var removed = rsp.Removed || [], added = rsp.Added || [], moved = rsp.Moved || [], updated = rsp.Updated || [];
+      var n = page.Results.length - removed.length + added.length;
+      var results: SearchResult[] = new Array(n);
+      var skip: {[cardId: string]: boolean} = {};
+      var byId: {[cardId: string]: SearchResult} = {};
+      for (var i = 0; i < removed.length; ++i) {
+        skip[removed[i]] = true;
+      }
+      for (var i = 0; i < page.Results.length; ++i) {
+        byId[page.Results[i].CardId] = page.Results[i];
+      }
+      for (var i = 0; i < added.length; ++i) {
+        var a = added[i];
+        results[a.Index] = { CardId: a.CardId, Modified: a.Modified, Props: a.Props, Snippets: a.Snippets };
+      }
+      for (var i = 0; i < moved.length; ++i) {
+        results[moved[i].Index] = byId[moved[i].CardId];
+        skip[moved[i].CardId] = true;
+      }
+      var j = 0;
+      for (var i = 0; i < page.Results.length; ++i) {
+        if (page.Results[i].CardId in skip) {
+          continue;
+        }
+        while (j < n && results[j]) {
+          ++j;
+        }
+        if (j == n) {
+          return false;
+        }
+        results[j] = page.Results[i];
+      }
+      for (var i = 0; i < updated.length; ++i) {
+        for (var j = 0; j < n; ++j) {
+          if (results[j] && results[j].CardId == updated[i].CardId) {
+            results[j] = updated[i];
+          }
+        }
+      }
 
-      for (var i = 0; i < subs.length; ++i) {
-        subs[i]._onsearchresults(rsp);
+      rsp.Results = results;
+      if (!rsp.Facets) {
+        rsp.Facets = page.Facets;
       }
+      this._searchPages[rsp.SubId] = rsp;
+      return true;
     }
 
     private handleCreateCard(rsp: CreateCardRsp) {
@@ -4,27 +4,88 @@ module hb {
     constructor(public _name: string, public _search: string, public _elem: HTMLAnchorElement) { }
   }
 
+  // The query that saved searches narrow down.
+  var ALL_CARDS = "type = card";
+
+  // Efforts are listed apart from completed ones, as they were before searches were counted.
+  var EFFORTS = ALL_CARDS + " and kind = effort";
+  var OPEN_EFFORTS = EFFORTS + " and done != true";
+  var COMPLETED = EFFORTS + " and done = true";
+
   export class SavedSearches extends TemplateView {
     private _items: SearchItem[] = [];
+    private _sub: SearchSubscription;
+    private _effortsSub: SearchSubscription;
+    // The latest totals and facets of each subscription. Updates only hold facets when they've changed.
+    private _cards: SearchResultsRsp;
+    private _efforts: SearchResultsRsp;
     onSearch: (search: string) => void;
 
     constructor(private _ctx: Context) {
       super("SavedSearches");
-
-      // TODO: Make all this dynamic.
-      this.addItem("Notes", "prop_type:card prop_kind:note");
-      this.addItem("Ideas", "prop_type:card prop_kind:idea");
-      this.addItem("Efforts", "prop_type:card prop_kind:effort -prop_done:true");
-      this.addItem("Completed", "prop_type:card prop_kind:effort prop_done:true");
+      this.addItem("All cards", ALL_CARDS);
     }
 
     selectFirst() {
       this.onSearch(this._items[0]._search);
     }
 
-    private addItem(name: string, search: string) {
+    // Lists a search for each kind of card, as counted by facets of all of them, and for completed efforts, as
+    // counted by facets of efforts. The subscriptions are ones of their own, so they don't share a page with the
+    // search box when that shows the same cards.
+    subscribe() {
+      if (this._sub) {
+        return;
+      }
+      var req: SubscribeSearchReq = {
+        Query: ALL_CARDS, Rows: 1, Fields: [], Snippets: [], Facets: ["kind"]
+      };
+      this._sub = this._ctx.connection().subscribeSearchWith(req, (rsp) => {
+        this._cards = latest(this._cards, rsp);
+        this.showFacets();
+      });
+      var effortsReq: SubscribeSearchReq = {
+        Query: EFFORTS, Rows: 1, Fields: [], Snippets: [], Facets: ["done"]
+      };
+      this._effortsSub = this._ctx.connection().subscribeSearchWith(effortsReq, (rsp) => {
+        this._efforts = latest(this._efforts, rsp);
+        this.showFacets();
+      });
+    }
+
+    private showFacets() {
+      if (!this._cards || !this._efforts) {
+        return;
+      }
+      while (this._items.length > 1) {
+        this.elem().removeChild(this._items.pop()._elem);
+      }
+      this._items[0]._elem.textContent = this._items[0]._name + " (" + this._cards.Total + ")";
+
+      var completed = 0;
+      var done = (this._efforts.Facets || {})["done"] || [];
+      for (var i = 0; i < done.length; ++i) {
+        if (done[i].Value == "true") {
+          completed = done[i].Count;
+        }
+      }
+      var kinds = (this._cards.Facets || {})["kind"] || [];
+      for (var i = 0; i < kinds.length; ++i) {
+        var name = kinds[i].Value.charAt(0).toUpperCase() + kinds[i].Value.substring(1) + "s";
+        if (kinds[i].Value == "effort") {
+          this.addItem(name, OPEN_EFFORTS, this._efforts.Total - completed);
+        } else {
+          this.addItem(name, ALL_CARDS + " and kind = " + quote(kinds[i].Value), kinds[i].Count);
+        }
+      }
+      if (completed > 0) {
+        this.addItem("Completed", COMPLETED, completed);
+      }
+    }
+
+    private addItem(name: string, search: string, count?: number) {
       var a = <HTMLAnchorElement>document.createElement("a");
-      a.textContent = name;
+      a.textContent = count === undefined ? name : name + " (" + count + ")";
       a.href = "#";
       a.onclick = (e) => {
         this.onSearch(search);
@@ -34,4 +95,17 @@ module hb {
       this._items.push(new SearchItem(name, search, a));
     }
   }
+
+  // Takes a search's total, and its facets if they changed, from the latest of its results.
+  function latest(prev: SearchResultsRsp, rsp: SearchResultsRsp): SearchResultsRsp {
+    if (prev && !rsp.Facets) {
+      rsp.Facets = prev.Facets;
+    }
+    return rsp;
+  }
+
+  // Quotes a value as a string in a query.
+  function quote(value: string): string {
+    return '"' + value.replace(/[\\"]/g, "\\$&") + '"';
+  }
 }
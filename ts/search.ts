@@ -7,8 +7,8 @@ module hb {
 
     constructor(result: SearchResult) {
       super("SearchCard");
-      this.$(".title").textContent = result.Title;
-      this.$(".body").textContent = result.Body;
+      this.$(".title").textContent = (result.Props || {})["title"] || "";
+      this.$(".body").innerHTML = (result.Snippets || {})["body"] || "";
     }
   }
 
@@ -138,6 +138,7 @@ module hb {
     private onLogin() {
       this.initHistory();
       this.setStatus("logged in");
+      this._savedSearches.subscribe();
       if (!this._searchBox.curQuery()) {
         // Do a default search to get the ball rolling.
         this._savedSearches.selectFirst();